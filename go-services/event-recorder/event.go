@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Event is one line of a recording. A message that is JSON is kept in
+// Payload so recordings stay readable; anything else is kept in Text. A
+// line with Gap set marks a reconnect, where messages may have been missed.
+type Event struct {
+	Time    time.Time       `json:"time"`
+	Channel string          `json:"channel,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Text    *string         `json:"text,omitempty"`
+	Gap     bool            `json:"gap,omitempty"`
+}
+
+// NewEvent records a message received at t
+func NewEvent(t time.Time, channel, message string) Event {
+	event := Event{Time: t.UTC(), Channel: channel}
+	if json.Valid([]byte(message)) && (message[0] == '{' || message[0] == '[') {
+		event.Payload = json.RawMessage(message)
+	} else {
+		event.Text = &message
+	}
+	return event
+}
+
+// Message returns what was published
+func (e Event) Message() string {
+	if e.Text != nil {
+		return *e.Text
+	}
+	return string(e.Payload)
+}
+
+// readEvents reads the events in files, in order, calling fn for each
+func readEvents(files []string, fn func(file string, line int, event Event) error) error {
+	for _, file := range files {
+		if err := readFile(file, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readFile(file string, fn func(file string, line int, event Event) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if len(data) > 0 {
+			var event Event
+			if jsonErr := json.Unmarshal(data, &event); jsonErr != nil {
+				// A recording cut off mid-write ends in a partial line
+				if err == io.EOF {
+					return nil
+				}
+				return fmt.Errorf("%s:%d: %w", file, line, jsonErr)
+			}
+			if err := fn(file, line, event); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
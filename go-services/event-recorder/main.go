@@ -0,0 +1,90 @@
+// Command event-recorder records the system's Redis pub/sub traffic to
+// NDJSON files and replays it, so a production dispatch bug can be
+// reproduced locally against order-dispatch and location-tracker.
+//
+//	event-recorder record [flags]          subscribe and write events to files
+//	event-recorder replay [flags] file...  publish recorded events again
+//
+// The Redis connection comes from the shared configuration (REDIS_ADDR,
+// REDIS_PASSWORD, CONFIG_FILE and so on), so record and replay are pointed at
+// different Redis servers through the environment.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/foodo/shared/config"
+	"github.com/go-redis/redis/v8"
+)
+
+// Every channel the NestJS API and the Go services publish or subscribe to
+var defaultChannels = []string{
+	"new_order",
+	"order_status_update",
+	"order_assigned",
+	"order_unassigned",
+	"driver_location_updated",
+	"driver_disconnected",
+	"location_updates",
+	"notifications",
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	switch os.Args[1] {
+	case "record":
+		err = record(ctx, os.Args[2:])
+	case "replay":
+		err = replay(ctx, os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: event-recorder record [flags]")
+	fmt.Fprintln(os.Stderr, "       event-recorder replay [flags] file...")
+	os.Exit(2)
+}
+
+// Connect to the Redis named by the environment or CONFIG_FILE
+func connect() (*config.Config, redis.UniversalClient, error) {
+	cfg, err := config.Load("event-recorder", "0", nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	client, err := config.NewRedisClient(cfg.Redis)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, client, nil
+}
+
+// Parse a -channels flag, falling back to every channel the system uses
+func parseChannels(value string) []string {
+	var channels []string
+	for _, channel := range strings.Split(value, ",") {
+		if channel = strings.TrimSpace(channel); channel != "" {
+			channels = append(channels, channel)
+		}
+	}
+	if len(channels) == 0 {
+		return defaultChannels
+	}
+	return channels
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/foodo/shared/health"
+	"github.com/foodo/shared/pubsub"
+	"github.com/go-redis/redis/v8"
+)
+
+// Subscribe to the channels and write every message to NDJSON files in dir
+// until interrupted
+func record(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("record", flag.ExitOnError)
+	dir := fs.String("dir", ".", "directory to write recordings to")
+	channels := fs.String("channels", "", "comma-separated channels to record (default every channel the system uses)")
+	rotate := fs.Duration("rotate", time.Hour, "start a new file this often; 0 writes a single file")
+	fs.Parse(args)
+
+	cfg, client, err := connect()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err := os.MkdirAll(*dir, 0o755); err != nil {
+		return err
+	}
+
+	// A write error stops the recording rather than leaving holes in it
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	r := &recorder{dir: *dir, rotate: *rotate, counts: make(map[string]int), stop: cancel}
+	defer r.close()
+
+	subscriber := pubsub.New(cfg, client, parseChannels(*channels)...)
+	subscriber.State = &health.Consumer{}
+	subscriber.Handle = func(msg *redis.Message) {
+		r.write(NewEvent(time.Now(), msg.Channel, msg.Payload))
+	}
+	// Anything published while disconnected is lost; say so in the recording
+	subscriber.Resync = func(ctx context.Context) error {
+		r.write(Event{Time: time.Now().UTC(), Gap: true})
+		return nil
+	}
+	log.Printf("Recording %v to %s", subscriber.Channels, *dir)
+	subscriber.Run(ctx)
+
+	r.report()
+	return r.err
+}
+
+// recorder writes events to the current file, starting a new one every
+// rotate. Messages arrive one at a time, so it needs no lock.
+type recorder struct {
+	dir    string
+	rotate time.Duration
+	stop   func()
+
+	file    *os.File
+	started time.Time
+	counts  map[string]int
+	err     error
+}
+
+func (r *recorder) write(event Event) {
+	if r.err != nil {
+		return
+	}
+	if r.file == nil || r.rotate > 0 && event.Time.Sub(r.started) >= r.rotate {
+		if r.err = r.open(event.Time); r.err != nil {
+			r.stop()
+			return
+		}
+	}
+
+	line, _ := json.Marshal(event)
+	if _, r.err = r.file.Write(append(line, '\n')); r.err != nil {
+		r.stop()
+		return
+	}
+	if event.Gap {
+		log.Printf("Resubscribed; messages may have been missed")
+		return
+	}
+	r.counts[event.Channel]++
+}
+
+// Start a new file named for when it starts, so names sort in time order
+func (r *recorder) open(t time.Time) error {
+	r.close()
+	path := filepath.Join(r.dir, "events-"+t.Format("20060102T150405Z")+".ndjson")
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	log.Printf("Writing %s", path)
+	r.file, r.started = file, t
+	return nil
+}
+
+func (r *recorder) close() {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+}
+
+func (r *recorder) report() {
+	channels := make([]string, 0, len(r.counts))
+	for channel := range r.counts {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	for _, channel := range channels {
+		fmt.Printf("%-24s %d\n", channel, r.counts[channel])
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Publish the events in the recordings named by args, keeping their spacing
+// divided by -speed
+func replay(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "replay speed; 1 is real time, 10 is ten times faster, 0 sends without waiting")
+	maxWait := fs.Duration("max-wait", 0, "longest pause between two events before speed is applied; 0 keeps every pause")
+	channels := fs.String("channels", "", "comma-separated channels to replay (default every channel recorded)")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("replay needs at least one recording")
+	}
+	if *speed < 0 {
+		return fmt.Errorf("-speed must not be negative")
+	}
+
+	_, client, err := connect()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var only map[string]bool
+	if *channels != "" {
+		only = make(map[string]bool)
+		for _, channel := range parseChannels(*channels) {
+			only[channel] = true
+		}
+	}
+
+	log.Printf("Replaying %v at %gx", fs.Args(), *speed)
+	counts := make(map[string]int)
+	var previous time.Time
+	deadline := time.Now()
+	err = readEvents(fs.Args(), func(file string, line int, event Event) error {
+		if event.Gap {
+			log.Printf("%s:%d: the recorder reconnected here; messages may be missing", file, line)
+			return nil
+		}
+		if only != nil && !only[event.Channel] {
+			return nil
+		}
+
+		// Wait out the recorded pause from a running deadline, so time spent
+		// publishing doesn't add up
+		if *speed > 0 && !previous.IsZero() {
+			pause := event.Time.Sub(previous)
+			if *maxWait > 0 && pause > *maxWait {
+				pause = *maxWait
+			}
+			if pause > 0 {
+				deadline = deadline.Add(time.Duration(float64(pause) / *speed))
+			}
+			select {
+			case <-time.After(time.Until(deadline)):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		previous = event.Time
+
+		if err := client.Publish(ctx, event.Channel, event.Message()).Err(); err != nil {
+			return fmt.Errorf("%s:%d: %w", file, line, err)
+		}
+		counts[event.Channel]++
+		return nil
+	})
+
+	channelNames := make([]string, 0, len(counts))
+	for channel := range counts {
+		channelNames = append(channelNames, channel)
+	}
+	sort.Strings(channelNames)
+	for _, channel := range channelNames {
+		fmt.Printf("%-24s %d\n", channel, counts[channel])
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,15 @@
+module github.com/foodo/foodoctl
+
+go 1.21
+
+require (
+	github.com/foodo/shared v0.0.0
+	github.com/go-redis/redis/v8 v8.11.5
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+)
+
+replace github.com/foodo/shared => ../shared
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// List each zone's pending orders in queue order, or the held orders
+func listOrders(ctx context.Context, client redis.UniversalClient, args []string) error {
+	fs := flag.NewFlagSet("orders", flag.ExitOnError)
+	zone := fs.String("zone", "", "only this zone; \"unzoned\" for orders outside every zone")
+	held := fs.Bool("held", false, "list held orders instead of pending ones")
+	fs.Parse(args)
+
+	zones, err := orderZones(ctx, client)
+	if err != nil {
+		return err
+	}
+	switch *zone {
+	case "":
+	case "unzoned":
+		zones = []string{""}
+	default:
+		zones = []string{*zone}
+	}
+
+	w := newTable("ZONE", "#", "ORDER", "NUMBER", "RESTAURANT", "STATUS", "ADDRESS", "ETA")
+	for _, zone := range zones {
+		var entries []string
+		if *held {
+			entries, err = client.HVals(ctx, heldKey(zone)).Result()
+		} else {
+			entries, err = client.LRange(ctx, queueKey(zone), 0, -1).Result()
+		}
+		if err != nil {
+			return err
+		}
+		for i, entry := range entries {
+			var order Order
+			if err := json.Unmarshal([]byte(entry), &order); err != nil {
+				w.row(zoneName(zone), i+1, "(invalid: "+err.Error()+")")
+				continue
+			}
+			restaurant := order.RestaurantID
+			if order.Restaurant != nil && order.Restaurant.Name != "" {
+				restaurant = order.Restaurant.Name
+			}
+			w.row(zoneName(zone), i+1, order.ID, order.OrderNumber, restaurant, order.Status, order.DeliveryAddress, formatTime(order.EstimatedDeliveryTime))
+		}
+	}
+	return w.Flush()
+}
+
+// List drivers sorted by status, with a count of each
+func listDrivers(ctx context.Context, client redis.UniversalClient, args []string) error {
+	fs := flag.NewFlagSet("drivers", flag.ExitOnError)
+	status := fs.String("status", "", "only drivers with this status: available, busy or offline")
+	fs.Parse(args)
+
+	records, err := readDrivers(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	drivers := make([]Driver, 0, len(records))
+	for id, record := range records {
+		driver := Driver{ID: id, Status: "(invalid)"}
+		json.Unmarshal([]byte(record.JSON), &driver)
+		driver.ID = id
+		if *status == "" || driver.Status == *status {
+			drivers = append(drivers, driver)
+		}
+	}
+	sort.Slice(drivers, func(i, j int) bool {
+		if drivers[i].Status != drivers[j].Status {
+			return drivers[i].Status < drivers[j].Status
+		}
+		return drivers[i].ID < drivers[j].ID
+	})
+
+	counts := make(map[string]int)
+	w := newTable("STATUS", "DRIVER", "NAME", "ZONE", "VEHICLE", "LATITUDE", "LONGITUDE", "LAST SEEN")
+	for _, driver := range drivers {
+		counts[driver.Status]++
+		vehicle := "-"
+		if driver.Vehicle != nil {
+			vehicle = driver.Vehicle.Type
+		}
+		w.row(driver.Status, driver.ID, driver.Name, zoneName(driver.ZoneID), vehicle, driver.Latitude, driver.Longitude, formatTime(records[driver.ID].LastSeen))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	statuses := make([]string, 0, len(counts))
+	for status := range counts {
+		statuses = append(statuses, fmt.Sprintf("%s=%d", status, counts[status]))
+	}
+	sort.Strings(statuses)
+	fmt.Printf("\n%d drivers: %s\n", len(drivers), strings.Join(statuses, " "))
+	return nil
+}
+
+// List assignments, or clear them with "assignments clear"
+func assignments(ctx context.Context, client redis.UniversalClient, args []string) error {
+	if len(args) > 0 && args[0] == "clear" {
+		return clearAssignments(ctx, client, args[1:])
+	}
+	fs := flag.NewFlagSet("assignments", flag.ExitOnError)
+	driver := fs.String("driver", "", "only this driver's assignments")
+	fs.Parse(args)
+
+	records, err := client.HGetAll(ctx, assignmentsKey).Result()
+	if err != nil {
+		return err
+	}
+	orders, err := client.HGetAll(ctx, assignedOrdersKey).Result()
+	if err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(records))
+	for id := range records {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	w := newTable("ORDER", "NUMBER", "DRIVER", "RESTAURANT", "ASSIGNED", "AGE")
+	for _, id := range ids {
+		var assignment OrderAssignment
+		if err := json.Unmarshal([]byte(records[id]), &assignment); err != nil {
+			w.row(id, "(invalid: "+err.Error()+")")
+			continue
+		}
+		if *driver != "" && assignment.DriverID != *driver {
+			continue
+		}
+		var order Order
+		json.Unmarshal([]byte(orders[id]), &order)
+		w.row(id, order.OrderNumber, assignment.DriverID, assignment.RestaurantID, formatTime(assignment.AssignedAt), time.Since(assignment.AssignedAt).Round(time.Second))
+	}
+	return w.Flush()
+}
+
+// Remove assignments and free their drivers, as the admin API's cancel does,
+// for when order-dispatch itself can't be reached. The driver isn't told
+// over its WebSocket.
+func clearAssignments(ctx context.Context, client redis.UniversalClient, args []string) error {
+	fs := flag.NewFlagSet("assignments clear", flag.ExitOnError)
+	reason := fs.String("reason", "", "why the assignments are being cleared (required)")
+	all := fs.Bool("all", false, "clear every assignment")
+	fs.Parse(args)
+
+	if strings.TrimSpace(*reason) == "" {
+		return errors.New("-reason is required")
+	}
+	ids := fs.Args()
+	if *all {
+		var err error
+		if ids, err = client.HKeys(ctx, assignmentsKey).Result(); err != nil {
+			return err
+		}
+	}
+	if len(ids) == 0 {
+		return errors.New("name the orders to clear, or pass -all")
+	}
+
+	for _, id := range ids {
+		record, err := client.HGet(ctx, assignmentsKey, id).Result()
+		if errors.Is(err, redis.Nil) {
+			fmt.Printf("%s: no assignment\n", id)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var assignment OrderAssignment
+		json.Unmarshal([]byte(record), &assignment)
+
+		// Only one caller gets to remove a given assignment
+		removed, err := client.HDel(ctx, assignmentsKey, id).Result()
+		if err != nil {
+			return err
+		}
+		if removed == 0 {
+			fmt.Printf("%s: no assignment\n", id)
+			continue
+		}
+		client.HDel(ctx, assignedOrdersKey, id)
+
+		if assignment.DriverID != "" {
+			if err := freeDriver(ctx, client, assignment.DriverID); err != nil {
+				return err
+			}
+		}
+		event, _ := json.Marshal(map[string]interface{}{
+			"orderId":  id,
+			"driverId": assignment.DriverID,
+			"reason":   *reason,
+		})
+		if err := client.Publish(ctx, "order_unassigned", event).Err(); err != nil {
+			return err
+		}
+		if err := recordAction(ctx, client, "cancel_assignment", id, *reason, map[string]interface{}{
+			"driverId": assignment.DriverID,
+			"requeued": false,
+		}); err != nil {
+			return err
+		}
+		fmt.Printf("%s: cleared, driver %s freed\n", id, assignment.DriverID)
+	}
+	return nil
+}
+
+// A stored driver record, the zone index it was found in and when the
+// driver was last seen
+type driverRecord struct {
+	JSON     string
+	Zone     string
+	LastSeen time.Time
+}
+
+// Read every indexed driver by ID, zone by zone as order-dispatch lists
+// them. An index entry for a driver that's moved or gone is skipped;
+// order-dispatch drops those as it finds them.
+func readDrivers(ctx context.Context, client redis.UniversalClient) (map[string]driverRecord, error) {
+	members, err := client.SMembers(ctx, driverZonesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	zones := []string{""}
+	for _, zone := range members {
+		if zone != "" {
+			zones = append(zones, zone)
+		}
+	}
+
+	records := make(map[string]driverRecord)
+	for _, zone := range zones {
+		ids, err := client.SMembers(ctx, driverZoneKey(zone)).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		pipe := client.Pipeline()
+		recordCmds := make([]*redis.StringCmd, len(ids))
+		seenCmds := make([]*redis.StringCmd, len(ids))
+		for i, id := range ids {
+			recordCmds[i] = pipe.Get(ctx, driverKey(id))
+			seenCmds[i] = pipe.Get(ctx, driverLastSeenKey(id))
+		}
+		if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+			return nil, err
+		}
+		for i, id := range ids {
+			record, err := recordCmds[i].Result()
+			if err != nil {
+				continue
+			}
+			var located struct {
+				ZoneID string `json:"zoneId"`
+			}
+			if json.Unmarshal([]byte(record), &located) == nil && located.ZoneID != zone {
+				continue
+			}
+			entry := driverRecord{JSON: record, Zone: zone}
+			if ms, err := seenCmds[i].Int64(); err == nil {
+				entry.LastSeen = time.UnixMilli(ms)
+			}
+			records[id] = entry
+		}
+	}
+	return records, nil
+}
+
+// Mark a driver available, keeping the rest of its record. A driver without
+// a record is indexed as unzoned, as order-dispatch would on its first save.
+func freeDriver(ctx context.Context, client redis.UniversalClient, id string) error {
+	record, err := client.Get(ctx, driverKey(id)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+	var driver map[string]interface{}
+	if json.Unmarshal([]byte(record), &driver) != nil || driver == nil {
+		driver = map[string]interface{}{"id": id}
+	}
+	driver["status"] = "available"
+	driverJSON, _ := json.Marshal(driver)
+
+	var indexed *redis.StringCmd
+	_, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, driverKey(id), driverJSON, 0)
+		pipe.Set(ctx, driverLastSeenKey(id), time.Now().UnixMilli(), 0)
+		indexed = pipe.Get(ctx, driverIndexedZoneKey(id))
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+	zone, _ := driver["zoneId"].(string)
+	if current, err := indexed.Result(); err == nil && current == zone {
+		return nil
+	}
+	pipe := client.Pipeline()
+	pipe.SAdd(ctx, driverZoneKey(zone), id)
+	pipe.SAdd(ctx, driverZonesKey, zone)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	return client.Set(ctx, driverIndexedZoneKey(id), zone, 0).Err()
+}
+
+// Add an entry to the admin audit log. The stream gives it its ID.
+func recordAction(ctx context.Context, client redis.UniversalClient, action, target, reason string, details map[string]interface{}) error {
+	entryJSON, _ := json.Marshal(AdminAction{
+		Actor:   "foodoctl",
+		Action:  action,
+		Target:  target,
+		Reason:  reason,
+		Details: details,
+		At:      time.Now().UTC(),
+	})
+	return client.XAdd(ctx, &redis.XAddArgs{
+		Stream: auditLogKey,
+		Values: map[string]interface{}{"action": entryJSON},
+	}).Err()
+}
+
+// The zones with queued or held orders, always including unzoned ("")
+func orderZones(ctx context.Context, client redis.UniversalClient) ([]string, error) {
+	values, err := client.HVals(ctx, orderZonesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{"": true}
+	zones := []string{""}
+	for _, zone := range values {
+		if !seen[zone] {
+			seen[zone] = true
+			zones = append(zones, zone)
+		}
+	}
+	sort.Strings(zones[1:])
+	return zones, nil
+}
+
+func zoneName(zone string) string {
+	if zone == "" {
+		return "unzoned"
+	}
+	return zone
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// table writes aligned columns to stdout
+type table struct {
+	*tabwriter.Writer
+}
+
+func newTable(headers ...string) table {
+	t := table{tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)}
+	fmt.Fprintln(t, strings.Join(headers, "\t"))
+	return t
+}
+
+func (t table) row(values ...interface{}) {
+	cells := make([]string, len(values))
+	for i, value := range values {
+		cells[i] = fmt.Sprint(value)
+	}
+	fmt.Fprintln(t, strings.Join(cells, "\t"))
+}
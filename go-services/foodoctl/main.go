@@ -0,0 +1,86 @@
+// Command foodoctl inspects and repairs the dispatch state the Go services
+// keep in Redis.
+//
+//	foodoctl [connection flags] <command> [flags] [args]
+//
+// Connection settings come from flags, the environment or a config file,
+// the same as the services: -redis-addr or REDIS_ADDR, REDIS_PASSWORD or
+// REDIS_PASSWORD_FILE, -config or CONFIG_FILE, and so on.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/foodo/shared/config"
+	"github.com/go-redis/redis/v8"
+)
+
+// A subcommand, given the Redis client and its own arguments
+type command struct {
+	name, usage string
+	run         func(ctx context.Context, client redis.UniversalClient, args []string) error
+}
+
+var commands = []command{
+	{"ping", "check the connection", ping},
+	{"orders", "list pending or held orders", listOrders},
+	{"drivers", "list drivers by status", listDrivers},
+	{"assignments", "list assignments, or clear them with: assignments clear", assignments},
+	{"tail", "print messages on channels as they arrive", tail},
+	{"validate", "check stored orders, drivers and assignments decode cleanly", validate},
+}
+
+func main() {
+	log.SetFlags(0)
+	cfg, args, err := config.LoadArgs("foodoctl", "0", os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if len(args) == 0 {
+		usage()
+	}
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == args[0] {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		usage()
+	}
+
+	client, err := config.NewRedisClient(cfg.Redis)
+	if err != nil {
+		log.Fatalf("Failed to create Redis client: %v", err)
+	}
+	defer client.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := cmd.run(ctx, client, args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: foodoctl [connection flags] <command> [flags] [args]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", cmd.name, cmd.usage)
+	}
+	os.Exit(2)
+}
+
+func ping(ctx context.Context, client redis.UniversalClient, args []string) error {
+	pong, err := client.Ping(ctx).Result()
+	if err != nil {
+		return fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+	fmt.Println(pong)
+	return nil
+}
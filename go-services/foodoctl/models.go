@@ -0,0 +1,147 @@
+package main
+
+import (
+	"time"
+
+	"github.com/foodo/shared/rediskeys"
+)
+
+// The records order-dispatch keeps in Redis. These mirror the types in
+// go-services/order-dispatch/main.go, which is a separate command and can't
+// be imported; change them together.
+
+// Order is a pending, held or assigned order
+type Order struct {
+	ID                    string             `json:"id"`
+	OrderNumber           string             `json:"orderNumber"`
+	RestaurantID          string             `json:"restaurantId"`
+	UserID                string             `json:"userId"`
+	Status                string             `json:"status"`
+	DeliveryAddress       string             `json:"deliveryAddress"`
+	EstimatedDeliveryTime time.Time          `json:"estimatedDeliveryTime"`
+	Restaurant            *OrderRestaurant   `json:"restaurant,omitempty"`
+	ZoneID                string             `json:"zoneId,omitempty"`
+	Requirements          *OrderRequirements `json:"requirements,omitempty"`
+}
+
+// OrderRequirements is what an order needs from the delivering vehicle
+type OrderRequirements struct {
+	DistanceKm   float64 `json:"distanceKm,omitempty"`
+	WeightKg     float64 `json:"weightKg,omitempty"`
+	Items        int     `json:"items,omitempty"`
+	InsulatedBag bool    `json:"insulatedBag,omitempty"`
+}
+
+// OrderRestaurant is the restaurant embedded in an order
+type OrderRestaurant struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	ZipCode   string   `json:"zipCode"`
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+}
+
+// Driver is a driver record
+type Driver struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Phone     string   `json:"phone"`
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Status    string   `json:"status"`
+	ZoneID    string   `json:"zoneId,omitempty"`
+	Vehicle   *Vehicle `json:"vehicle,omitempty"`
+}
+
+// Vehicle is what a driver delivers with
+type Vehicle struct {
+	Type          string  `json:"type"`
+	MaxDistanceKm float64 `json:"maxDistanceKm,omitempty"`
+	MaxWeightKg   float64 `json:"maxWeightKg,omitempty"`
+	MaxItems      int     `json:"maxItems,omitempty"`
+	InsulatedBag  bool    `json:"insulatedBag,omitempty"`
+}
+
+// OrderAssignment is an order assigned to a driver
+type OrderAssignment struct {
+	OrderID      string    `json:"orderId"`
+	DriverID     string    `json:"driverId"`
+	RestaurantID string    `json:"restaurantId,omitempty"`
+	AssignedAt   time.Time `json:"assignedAt"`
+}
+
+// AdminAction is an entry in the admin audit log
+type AdminAction struct {
+	ID      string                 `json:"id"`
+	Actor   string                 `json:"actor"`
+	Action  string                 `json:"action"`
+	Target  string                 `json:"target"`
+	Reason  string                 `json:"reason"`
+	Details map[string]interface{} `json:"details,omitempty"`
+	At      time.Time              `json:"at"`
+}
+
+// Driver statuses order-dispatch accepts
+var driverStatuses = map[string]bool{
+	"available": true,
+	"busy":      true,
+	"offline":   true,
+}
+
+// Vehicle types order-dispatch accepts
+var vehicleTypes = map[string]bool{
+	"bicycle": true,
+	"scooter": true,
+	"car":     true,
+}
+
+// Redis keys, as laid out in go-services/order-dispatch/keys.go
+const (
+	driverZonesKey    = "driver_zones"
+	orderZonesKey     = "{orders}:zones"
+	assignmentsKey    = "{assignments}:active"
+	assignedOrdersKey = "{assignments}:orders"
+	auditLogKey       = "admin_audit"
+)
+
+// A driver's record
+func driverKey(id string) string {
+	return "driver:" + rediskeys.Tag(id) + ":record"
+}
+
+// When a driver was last saved, in Unix milliseconds
+func driverLastSeenKey(id string) string {
+	return "driver:" + rediskeys.Tag(id) + ":last_seen"
+}
+
+// The zone a driver was last added to the index of
+func driverIndexedZoneKey(id string) string {
+	return "driver:" + rediskeys.Tag(id) + ":indexed_zone"
+}
+
+// The driver index for a zone
+func driverZoneKey(zone string) string {
+	return "zone:" + zoneTag(zone) + ":drivers"
+}
+
+// The pending list for a zone, or the unzoned orders for ""
+func queueKey(zone string) string {
+	return "zone:" + zoneTag(zone) + ":pending_orders"
+}
+
+// The pending orders for a zone by ID, each as its queue entry
+func queuedKey(zone string) string {
+	return "zone:" + zoneTag(zone) + ":queued_orders"
+}
+
+// The held orders for a zone
+func heldKey(zone string) string {
+	return "zone:" + zoneTag(zone) + ":held_orders"
+}
+
+func zoneTag(zone string) string {
+	if zone == "" {
+		zone = "unzoned"
+	}
+	return rediskeys.Tag(zone)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Print messages on the channels matching the patterns, every channel by
+// default, until interrupted
+func tail(ctx context.Context, client redis.UniversalClient, args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	compact := fs.Bool("compact", false, "print each JSON message on one line")
+	fs.Parse(args)
+	patterns := fs.Args()
+	if len(patterns) == 0 {
+		patterns = []string{"*"}
+	}
+
+	sub := client.PSubscribe(ctx, patterns...)
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		return err
+	}
+
+	messages := sub.Channel()
+	for {
+		select {
+		case msg := <-messages:
+			fmt.Printf("%s %s\n%s\n", time.Now().Format("15:04:05.000"), msg.Channel, formatPayload(msg.Payload, *compact))
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Indent JSON payloads; print anything else as it is
+func formatPayload(payload string, compact bool) string {
+	var b bytes.Buffer
+	var err error
+	if compact {
+		err = json.Compact(&b, []byte(payload))
+	} else {
+		err = json.Indent(&b, []byte(payload), "", "  ")
+	}
+	if err != nil {
+		return payload
+	}
+	return b.String()
+}
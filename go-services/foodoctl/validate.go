@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Check every stored driver, order and assignment decodes into its struct
+// with no unknown fields and is consistent with the keys it's under. Exits
+// non-zero if any problem is found.
+func validate(ctx context.Context, client redis.UniversalClient, args []string) error {
+	v := &validator{}
+
+	drivers, err := readDrivers(ctx, client)
+	if err != nil {
+		return err
+	}
+	for id, record := range drivers {
+		var driver Driver
+		if !v.decode("driver "+id, record.JSON, &driver) {
+			continue
+		}
+		if driver.ID != "" && driver.ID != id {
+			v.problem("driver "+id, "record has id %q", driver.ID)
+		}
+		if !driverStatuses[driver.Status] {
+			v.problem("driver "+id, "unknown status %q", driver.Status)
+		}
+		if driver.Vehicle != nil && !vehicleTypes[driver.Vehicle.Type] {
+			v.problem("driver "+id, "unknown vehicle type %q", driver.Vehicle.Type)
+		}
+	}
+
+	// Every order should be in exactly one place
+	placed := make(map[string]string)
+	place := func(id, where string) {
+		if previous, ok := placed[id]; ok {
+			v.problem("order "+id, "is both %s and %s", previous, where)
+		}
+		placed[id] = where
+	}
+
+	index, err := client.HGetAll(ctx, orderZonesKey).Result()
+	if err != nil {
+		return err
+	}
+	zones, err := orderZones(ctx, client)
+	if err != nil {
+		return err
+	}
+	for _, zone := range zones {
+		pending, err := client.LRange(ctx, queueKey(zone), 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		queued, err := client.HGetAll(ctx, queuedKey(zone)).Result()
+		if err != nil {
+			return err
+		}
+		for i, entry := range pending {
+			name := fmt.Sprintf("pending order %d in %s", i+1, zoneName(zone))
+			var order Order
+			if !v.decode(name, entry, &order) {
+				continue
+			}
+			v.checkOrder(name, order, zone, index)
+			place(order.ID, "pending in "+zoneName(zone))
+			if queued[order.ID] != entry {
+				v.problem(name, "order %s doesn't match its entry in the zone's queued orders", order.ID)
+			}
+			delete(queued, order.ID)
+		}
+		for id := range queued {
+			v.problem("queued order "+id, "is in %s's queued orders but not its queue", zoneName(zone))
+		}
+
+		held, err := client.HGetAll(ctx, heldKey(zone)).Result()
+		if err != nil {
+			return err
+		}
+		for id, entry := range held {
+			name := "held order " + id
+			var order Order
+			if !v.decode(name, entry, &order) {
+				continue
+			}
+			if order.ID != id {
+				v.problem(name, "record has id %q", order.ID)
+			}
+			v.checkOrder(name, order, zone, index)
+			place(id, "held in "+zoneName(zone))
+		}
+	}
+
+	assignments, err := client.HGetAll(ctx, assignmentsKey).Result()
+	if err != nil {
+		return err
+	}
+	assignedOrders, err := client.HGetAll(ctx, assignedOrdersKey).Result()
+	if err != nil {
+		return err
+	}
+	for id, record := range assignments {
+		name := "assignment " + id
+		var assignment OrderAssignment
+		if v.decode(name, record, &assignment) {
+			if assignment.OrderID != id {
+				v.problem(name, "record has orderId %q", assignment.OrderID)
+			}
+			if _, ok := drivers[assignment.DriverID]; !ok {
+				v.problem(name, "driver %q doesn't exist", assignment.DriverID)
+			}
+			if assignment.AssignedAt.IsZero() {
+				v.problem(name, "has no assignedAt")
+			}
+		}
+		place(id, "assigned")
+
+		orderJSON, ok := assignedOrders[id]
+		if !ok {
+			v.problem(name, "has no stored order")
+			continue
+		}
+		var order Order
+		if v.decode("assigned order "+id, orderJSON, &order) && order.ID != id {
+			v.problem("assigned order "+id, "record has id %q", order.ID)
+		}
+	}
+	for id := range assignedOrders {
+		if _, ok := assignments[id]; !ok {
+			v.problem("assigned order "+id, "has no assignment")
+		}
+	}
+
+	fmt.Printf("Checked %d records, %d problems\n", v.checked, v.problems)
+	if v.problems > 0 {
+		return errors.New("validation failed")
+	}
+	return nil
+}
+
+type validator struct {
+	checked  int
+	problems int
+}
+
+// Decode a record strictly, reporting whether it could be
+func (v *validator) decode(name, record string, target interface{}) bool {
+	v.checked++
+	decoder := json.NewDecoder(bytes.NewReader([]byte(record)))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(target)
+	if err == nil && decoder.Decode(&struct{}{}) != io.EOF {
+		err = errors.New("trailing data after the record")
+	}
+	if err != nil {
+		v.problem(name, "%v", err)
+		return false
+	}
+	return true
+}
+
+// Check a queued or held order is indexed under the zone it's stored in
+func (v *validator) checkOrder(name string, order Order, zone string, index map[string]string) {
+	if order.ID == "" {
+		v.problem(name, "has no id")
+		return
+	}
+	if order.ZoneID != zone {
+		v.problem(name, "order %s has zoneId %q", order.ID, order.ZoneID)
+	}
+	if indexed, ok := index[order.ID]; !ok || indexed != zone {
+		v.problem(name, "order %s is indexed under zone %q", order.ID, indexed)
+	}
+}
+
+func (v *validator) problem(name, format string, args ...interface{}) {
+	v.problems++
+	fmt.Printf("%s: %s\n", name, fmt.Sprintf(format, args...))
+}
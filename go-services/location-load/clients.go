@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Message sent by a simulated driver, as location-tracker reads it from the
+// driver socket
+type driverMessage struct {
+	OrderID  string   `json:"orderId"`
+	Location location `json:"location"`
+}
+
+type location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Timestamp int64   `json:"timestamp"`
+}
+
+// Message received by a watcher: a broadcast update, the last known location
+// on connect, or a control message such as "reconnect"
+type watcherMessage struct {
+	Type     string   `json:"type"`
+	UserID   string   `json:"userId"`
+	Location location `json:"location"`
+}
+
+// An order being delivered, with the number of watcher sockets open on it
+type order struct {
+	id       string
+	watchers atomic.Int64
+}
+
+// Driver moves along a random route around the test area and reports its
+// position at a fixed rate
+type Driver struct {
+	ID string
+	// The driver's user token
+	Token string
+	Order *order
+	Area  Area
+	// Time between location updates
+	Interval time.Duration
+	// Ground speed in km/h
+	Speed float64
+	Rand  *rand.Rand
+	Stats *Stats
+
+	lat, lng       float64
+	wayLat, wayLng float64
+}
+
+// Run connects and sends updates until ctx is done
+func (d *Driver) Run(ctx context.Context, baseURL string) {
+	conn, err := dial(ctx, baseURL+"/ws/location/driver/"+d.ID, d.Token)
+	if err != nil {
+		d.Stats.ConnectFailures.Add(1)
+		return
+	}
+	d.Stats.DriversConnected.Add(1)
+	defer d.Stats.DriversConnected.Add(-1)
+	defer conn.Close()
+
+	// The server echoes the driver's own updates and may ask it to slow
+	// down; read them so its send queue never fills
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			var msg watcherMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				if ctx.Err() == nil {
+					d.Stats.Disconnected("driver: " + disconnectReason(err))
+				}
+				return
+			}
+			if msg.Type == "throttled" {
+				d.Stats.Throttled.Add(1)
+			}
+		}
+	}()
+
+	d.lat, d.lng = d.Area.RandomPoint(d.Rand)
+	d.wayLat, d.wayLng = d.Area.RandomPoint(d.Rand)
+
+	// Spread drivers over the interval rather than sending in lockstep
+	select {
+	case <-time.After(time.Duration(d.Rand.Int63n(int64(d.Interval)))):
+	case <-ctx.Done():
+		return
+	case <-closed:
+		return
+	}
+
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+	for {
+		d.move()
+		now := time.Now()
+		key := updateKey(d.ID, d.lat, d.lng)
+		d.Stats.Expect(key, int(d.Order.watchers.Load()), now)
+		err := conn.WriteJSON(driverMessage{
+			OrderID:  d.Order.id,
+			Location: location{Latitude: d.lat, Longitude: d.lng, Timestamp: now.Unix()},
+		})
+		if err != nil {
+			d.Stats.Forget(key)
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			return
+		case <-closed:
+			return
+		}
+	}
+}
+
+// Advance one interval towards the waypoint, picking a new one on arrival
+func (d *Driver) move() {
+	step := d.Speed * d.Interval.Hours()
+	remaining := distanceKm(d.lat, d.lng, d.wayLat, d.wayLng)
+	if remaining <= step {
+		d.lat, d.lng = d.wayLat, d.wayLng
+		d.wayLat, d.wayLng = d.Area.RandomPoint(d.Rand)
+		return
+	}
+	f := step / remaining
+	d.lat += (d.wayLat - d.lat) * f
+	d.lng += (d.wayLng - d.lng) * f
+}
+
+// Watcher is a customer following an order's driver
+type Watcher struct {
+	Order *order
+	// The customer's user token
+	Token string
+	Stats *Stats
+}
+
+// Run connects and records deliveries until ctx is done
+func (w *Watcher) Run(ctx context.Context, baseURL string) {
+	conn, err := dial(ctx, baseURL+"/ws/location/order/"+w.Order.id, w.Token)
+	if err != nil {
+		w.Stats.ConnectFailures.Add(1)
+		return
+	}
+	w.Stats.WatchersConnected.Add(1)
+	w.Order.watchers.Add(1)
+	defer w.Stats.WatchersConnected.Add(-1)
+	defer w.Order.watchers.Add(-1)
+
+	// Unblock the read when the run ends
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	defer conn.Close()
+
+	for {
+		var msg watcherMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			if ctx.Err() == nil {
+				w.Stats.Disconnected("watcher: " + disconnectReason(err))
+			}
+			return
+		}
+		// Only broadcasts name the driver
+		if msg.UserID == "" {
+			continue
+		}
+		w.Stats.Delivered(updateKey(msg.UserID, msg.Location.Latitude, msg.Location.Longitude), time.Now())
+	}
+}
+
+func dial(ctx context.Context, url, token string) (*websocket.Conn, error) {
+	dialer := websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+	conn, _, err := dialer.DialContext(ctx, url, http.Header{"Authorization": {"Bearer " + token}})
+	return conn, err
+}
+
+// Sign a user token for userID the way the API does at login
+func signToken(secret, userID string, ttl time.Duration) string {
+	encode := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	unsigned := encode(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." +
+		encode(map[string]interface{}{"sub": userID, "exp": time.Now().Add(ttl).Unix()})
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Describe why the server closed a socket: its close code, or the error
+func disconnectReason(err error) string {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		return "close " + strconv.Itoa(closeErr.Code)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	return "error"
+}
+
+// Area is the circle drivers move within
+type Area struct {
+	Latitude, Longitude float64
+	RadiusKm            float64
+}
+
+// RandomPoint returns a point spread evenly over the area
+func (a Area) RandomPoint(r *rand.Rand) (float64, float64) {
+	dist := a.RadiusKm * math.Sqrt(r.Float64())
+	bearing := 2 * math.Pi * r.Float64()
+	lat := a.Latitude + dist*math.Cos(bearing)/111.32
+	lng := a.Longitude + dist*math.Sin(bearing)/(111.32*math.Cos(a.Latitude*math.Pi/180))
+	return lat, lng
+}
+
+// Great-circle distance between two points
+func distanceKm(lat1, lng1, lat2, lng2 float64) float64 {
+	const earthRadiusKm = 6371
+	dLat := (lat2 - lat1) * math.Pi / 180
+	dLng := (lng2 - lng1) * math.Pi / 180
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*math.Pi/180)*math.Cos(lat2*math.Pi/180)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
@@ -0,0 +1,5 @@
+module github.com/foodo/location-load
+
+go 1.21
+
+require github.com/gorilla/websocket v1.4.2
@@ -0,0 +1,216 @@
+// Command location-load drives location-tracker with simulated drivers and
+// customers to find how many drivers one instance can handle.
+//
+// Each driver connects to /ws/location/driver/{id} and sends positions along
+// a random route at a fixed rate. Watchers connect to /ws/location/order/{id}
+// for the drivers' orders and time how long each update takes to reach
+// them. The server's CPU, memory and goroutines are read from /metrics.
+//
+// Every socket connects with a user token signed with the API's JWT_SECRET,
+// so each simulated driver and customer has its own identity.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+func main() {
+	target := flag.String("url", "http://localhost:8081", "location-tracker base URL")
+	drivers := flag.Int("drivers", 100, "simulated driver sockets")
+	watchers := flag.Int("watchers", 100, "customer sockets each watching one driver's order, at most -drivers")
+	rate := flag.Float64("rate", 1, "location updates per second per driver")
+	speed := flag.Float64("speed", 30, "driver speed in km/h")
+	duration := flag.Duration("duration", time.Minute, "how long drivers send updates once connected")
+	ramp := flag.Duration("ramp", 10*time.Second, "time over which sockets are opened")
+	drain := flag.Duration("drain", 2*time.Second, "time to wait for in-flight updates before counting them dropped")
+	interval := flag.Duration("report-interval", 5*time.Second, "how often to print progress and sample server metrics")
+	center := flag.String("center", "40.7128,-74.0060", "latitude,longitude of the area drivers move in")
+	radius := flag.Float64("radius", 5, "radius of the area in km")
+	prefix := flag.String("prefix", "load", "prefix for driver and order IDs, to keep runs apart")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "random seed for routes")
+	secret := flag.String("jwt-secret", os.Getenv("JWT_SECRET"), "the API's JWT secret, to sign each simulated user's token (default $JWT_SECRET)")
+	flag.Parse()
+
+	if *drivers < 1 || *watchers < 0 || *rate <= 0 || *speed <= 0 {
+		log.Fatal("-drivers, -rate and -speed must be positive and -watchers not negative")
+	}
+	if *secret == "" {
+		log.Fatal("-jwt-secret or JWT_SECRET is required to sign user tokens")
+	}
+	// Tokens outlive the run, ramp and drain included
+	tokenTTL := *ramp + *duration + *drain + time.Hour
+	// location-tracker keeps one socket per order, replacing the previous one
+	if *watchers > *drivers {
+		log.Printf("Only one watcher per order is supported; using %d watchers", *drivers)
+		*watchers = *drivers
+	}
+	area := Area{RadiusKm: *radius}
+	if _, err := fmt.Sscanf(*center, "%f,%f", &area.Latitude, &area.Longitude); err != nil {
+		log.Fatalf("Invalid -center %q: %v", *center, err)
+	}
+	baseURL := strings.TrimSuffix(*target, "/")
+	wsURL := "ws" + strings.TrimPrefix(baseURL, "http")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	stats := NewStats()
+	orders := make([]*order, *drivers)
+	for i := range orders {
+		orders[i] = &order{id: fmt.Sprintf("%s-order-%d", *prefix, i)}
+	}
+
+	// Sample the server before any load for a baseline
+	var samples []ServerSample
+	if sample, err := sampleServer(ctx, baseURL); err != nil {
+		log.Printf("Server metrics unavailable, reporting client side only: %v", err)
+	} else {
+		samples = append(samples, sample)
+	}
+
+	// Watchers first, so every update has its audience when it's sent
+	var wg sync.WaitGroup
+	runCtx, stopClients := context.WithCancel(ctx)
+	defer stopClients()
+	watcherCtx, stopWatchers := context.WithCancel(ctx)
+	defer stopWatchers()
+	total := *drivers + *watchers
+	spacing := *ramp / time.Duration(total)
+	log.Printf("Opening %d watcher and %d driver sockets over %s", *watchers, *drivers, *ramp)
+	for i := 0; i < *watchers && ctx.Err() == nil; i++ {
+		w := &Watcher{
+			Order: orders[i],
+			Token: signToken(*secret, fmt.Sprintf("%s-customer-%d", *prefix, i), tokenTTL),
+			Stats: stats,
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.Run(watcherCtx, wsURL)
+		}()
+		time.Sleep(spacing)
+	}
+	var driversDone sync.WaitGroup
+	for i := 0; i < *drivers && ctx.Err() == nil; i++ {
+		id := fmt.Sprintf("%s-driver-%d", *prefix, i)
+		d := &Driver{
+			ID:       id,
+			Token:    signToken(*secret, id, tokenTTL),
+			Order:    orders[i],
+			Area:     area,
+			Interval: time.Duration(float64(time.Second) / *rate),
+			Speed:    *speed,
+			Rand:     rand.New(rand.NewSource(*seed + int64(i))),
+			Stats:    stats,
+		}
+		driversDone.Add(1)
+		go func() {
+			defer driversDone.Done()
+			d.Run(runCtx, wsURL)
+		}()
+		time.Sleep(spacing)
+	}
+
+	// Run at full load, reporting progress
+	log.Printf("Sending for %s", *duration)
+	deadline := time.After(*duration)
+	ticker := time.NewTicker(*interval)
+	start := time.Now()
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			if sample, err := sampleServer(ctx, baseURL); err == nil {
+				samples = append(samples, sample)
+			}
+			printProgress(time.Since(start), stats, samples)
+		case <-deadline:
+			break loop
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	ticker.Stop()
+
+	// Stop sending, give in-flight updates time to land, then hang up
+	stopClients()
+	driversDone.Wait()
+	if sample, err := sampleServer(context.Background(), baseURL); err == nil {
+		samples = append(samples, sample)
+	}
+	time.Sleep(*drain)
+	stopWatchers()
+	wg.Wait()
+
+	printReport(os.Stdout, stats, samples, time.Since(start))
+}
+
+func printProgress(elapsed time.Duration, stats *Stats, samples []ServerSample) {
+	d := stats.Delivery()
+	line := fmt.Sprintf("%6s drivers=%d watchers=%d sent=%d delivered=%d p99=%s",
+		elapsed.Truncate(time.Second), stats.DriversConnected.Load(), stats.WatchersConnected.Load(),
+		stats.Sent.Load(), d.Delivered, d.P99.Round(time.Microsecond))
+	if len(samples) > 0 {
+		last := samples[len(samples)-1]
+		line += fmt.Sprintf(" server_rss=%s server_goroutines=%.0f", formatBytes(last.RSSBytes), last.Goroutines)
+	}
+	log.Print(line)
+}
+
+func printReport(out *os.File, stats *Stats, samples []ServerSample, elapsed time.Duration) {
+	d := stats.Delivery()
+	expected := d.Delivered + d.Dropped
+
+	fmt.Fprintf(out, "\nRun: %s\n", elapsed.Round(time.Second))
+	fmt.Fprintf(out, "Connect failures:   %d\n", stats.ConnectFailures.Load())
+	fmt.Fprintf(out, "Updates sent:       %d (%.1f/s)\n", stats.Sent.Load(), float64(stats.Sent.Load())/elapsed.Seconds())
+	fmt.Fprintf(out, "Send errors:        %d\n", stats.SendErrors.Load())
+	fmt.Fprintf(out, "Throttled:          %d\n", stats.Throttled.Load())
+	fmt.Fprintf(out, "Deliveries:         %d of %d expected\n", d.Delivered, expected)
+	if expected > 0 {
+		fmt.Fprintf(out, "Dropped:            %d (%.3f%%)\n", d.Dropped, 100*float64(d.Dropped)/float64(expected))
+	}
+	if n := stats.Unexpected.Load(); n > 0 {
+		fmt.Fprintf(out, "Unmatched messages: %d\n", n)
+	}
+	if d.Delivered > 0 {
+		fmt.Fprintf(out, "Latency:            p50=%s p90=%s p99=%s max=%s\n",
+			d.P50.Round(time.Microsecond), d.P90.Round(time.Microsecond),
+			d.P99.Round(time.Microsecond), d.Max.Round(time.Microsecond))
+	}
+
+	disconnects := stats.Disconnects()
+	if len(disconnects) > 0 {
+		reasons := make([]string, 0, len(disconnects))
+		for reason := range disconnects {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		fmt.Fprintln(out, "Server disconnects:")
+		for _, reason := range reasons {
+			fmt.Fprintf(out, "  %-20s %d\n", reason, disconnects[reason])
+		}
+	}
+
+	if r, ok := summariseResources(samples); ok {
+		fmt.Fprintf(out, "Server CPU:         %.2f cores average\n", r.CPUCores)
+		fmt.Fprintf(out, "Server memory:      %s peak RSS\n", formatBytes(r.PeakRSSBytes))
+		fmt.Fprintf(out, "Server goroutines:  %.0f peak\n", r.PeakGoroutines)
+		fmt.Fprintf(out, "Server throttled:   %.0f\n", r.RateLimited)
+	}
+}
+
+func formatBytes(b float64) string {
+	return fmt.Sprintf("%.1fMiB", b/(1<<20))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServerSample is the location-tracker's resource use at one moment, read
+// from its /metrics endpoint
+type ServerSample struct {
+	At          time.Time
+	CPUSeconds  float64
+	RSSBytes    float64
+	Goroutines  float64
+	Connections float64
+	RateLimited float64
+}
+
+// Scrape /metrics and pick out the process and connection metrics. Series
+// with labels are summed.
+func sampleServer(ctx context.Context, baseURL string) (ServerSample, error) {
+	sample := ServerSample{At: time.Now()}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/metrics", nil)
+	if err != nil {
+		return sample, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return sample, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return sample, fmt.Errorf("GET /metrics: %s", resp.Status)
+	}
+
+	fields := map[string]*float64{
+		"process_cpu_seconds_total":     &sample.CPUSeconds,
+		"process_resident_memory_bytes": &sample.RSSBytes,
+		"go_goroutines":                 &sample.Goroutines,
+		"foodo_websocket_connections":   &sample.Connections,
+		"foodo_rate_limited_total":      &sample.RateLimited,
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 || line[0] == '#' {
+			continue
+		}
+		name, _, _ := strings.Cut(line[:i], "{")
+		field, ok := fields[name]
+		if !ok {
+			continue
+		}
+		if v, err := strconv.ParseFloat(line[i+1:], 64); err == nil {
+			*field += v
+		}
+	}
+	return sample, scanner.Err()
+}
+
+// Resources summarises server samples taken over a run
+type Resources struct {
+	// Average cores used between the first and last sample
+	CPUCores       float64
+	PeakRSSBytes   float64
+	PeakGoroutines float64
+	RateLimited    float64
+}
+
+func summariseResources(samples []ServerSample) (Resources, bool) {
+	if len(samples) < 2 {
+		return Resources{}, false
+	}
+	first, last := samples[0], samples[len(samples)-1]
+	r := Resources{RateLimited: last.RateLimited - first.RateLimited}
+	if elapsed := last.At.Sub(first.At).Seconds(); elapsed > 0 {
+		r.CPUCores = (last.CPUSeconds - first.CPUSeconds) / elapsed
+	}
+	for _, s := range samples {
+		r.PeakRSSBytes = max(r.PeakRSSBytes, s.RSSBytes)
+		r.PeakGoroutines = max(r.PeakGoroutines, s.Goroutines)
+	}
+	return r, true
+}
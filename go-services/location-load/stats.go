@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An update sent by a driver that watchers haven't all received yet
+type pendingUpdate struct {
+	sentAt    time.Time
+	remaining int
+}
+
+// Stats collects what the simulated clients see
+type Stats struct {
+	DriversConnected  atomic.Int64
+	WatchersConnected atomic.Int64
+	ConnectFailures   atomic.Int64
+	Sent              atomic.Int64
+	SendErrors        atomic.Int64
+	Throttled         atomic.Int64
+	Unexpected        atomic.Int64
+
+	mu          sync.Mutex
+	pending     map[string]*pendingUpdate
+	latencies   []time.Duration
+	disconnects map[string]int64
+}
+
+// NewStats returns empty Stats
+func NewStats() *Stats {
+	return &Stats{
+		pending:     make(map[string]*pendingUpdate),
+		disconnects: make(map[string]int64),
+	}
+}
+
+// Expect records that an update was sent and should reach that many
+// watchers
+func (s *Stats) Expect(key string, watchers int, sentAt time.Time) {
+	s.Sent.Add(1)
+	if watchers == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending[key] = &pendingUpdate{sentAt: sentAt, remaining: watchers}
+}
+
+// Forget withdraws an update that couldn't be sent
+func (s *Stats) Forget(key string) {
+	s.Sent.Add(-1)
+	s.SendErrors.Add(1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pending, key)
+}
+
+// Delivered records a watcher receiving an update
+func (s *Stats) Delivered(key string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.pending[key]
+	if !ok {
+		s.Unexpected.Add(1)
+		return
+	}
+	s.latencies = append(s.latencies, at.Sub(p.sentAt))
+	p.remaining--
+	if p.remaining == 0 {
+		delete(s.pending, key)
+	}
+}
+
+// Disconnected records a socket the server closed, by close code or error
+func (s *Stats) Disconnected(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.disconnects[reason]++
+}
+
+// Delivery is a snapshot of the delivery counts and latency percentiles
+type Delivery struct {
+	Delivered     int64
+	Dropped       int64
+	P50, P90, P99 time.Duration
+	Max           time.Duration
+}
+
+// Delivery summarises deliveries so far. Updates still pending count as
+// dropped, so call it after in-flight updates have had time to arrive.
+func (s *Stats) Delivery() Delivery {
+	s.mu.Lock()
+	latencies := append([]time.Duration(nil), s.latencies...)
+	var dropped int64
+	for _, p := range s.pending {
+		dropped += int64(p.remaining)
+	}
+	s.mu.Unlock()
+
+	d := Delivery{Delivered: int64(len(latencies)), Dropped: dropped}
+	if len(latencies) == 0 {
+		return d
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	d.P50 = percentile(latencies, 0.50)
+	d.P90 = percentile(latencies, 0.90)
+	d.P99 = percentile(latencies, 0.99)
+	d.Max = latencies[len(latencies)-1]
+	return d
+}
+
+// Disconnects returns the count of server-closed sockets by reason
+func (s *Stats) Disconnects() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]int64, len(s.disconnects))
+	for reason, n := range s.disconnects {
+		out[reason] = n
+	}
+	return out
+}
+
+// Nearest-rank percentile of sorted durations
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// Key identifying an update across the driver that sent it and the watchers
+// that receive it. Each point on a route is distinct, so driver and
+// coordinates are enough.
+func updateKey(driverID string, latitude, longitude float64) string {
+	return fmt.Sprintf("%s|%v|%v", driverID, latitude, longitude)
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/foodo/shared/contract"
+)
+
+// Payloads published on each channel, shared with the other services
+const contractsDir = "../contracts"
+
+func TestLocationUpdateContract(t *testing.T) {
+	contract.Verify(t, contractsDir, contract.Contract{
+		Channel:  "location_updates",
+		Type:     LocationUpdate{},
+		Required: []string{"userId", "userType", "location.latitude", "location.longitude"},
+	})
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"time"
+
+	"github.com/foodo/shared/health"
+)
+
+// Register the readiness checks for Redis, the location update subscriber and
+// the location WebSocket hub
+func (s *Server) setupHealthChecks() {
+	s.Readiness = health.NewChecker(s.Config.Service, s.Config.Duration("HEALTH_CHECK_TIMEOUT", 2*time.Second))
+	s.Readiness.Add("redis", health.RedisCheck(s.Redis, s.Config.Duration("HEALTH_REDIS_MAX_LATENCY", 500*time.Millisecond)))
+	s.Readiness.Add("subscriber", s.LocationEvents.Check(s.Config.Duration("HEALTH_SUBSCRIBER_MAX_IDLE", 0)))
+	s.Readiness.Add("websocket_hub", health.ConnectionsCheck(s.Hub.Len, s.Config.Int("WS_MAX_CONNECTIONS", 0)))
+}
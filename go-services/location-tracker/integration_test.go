@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/foodo/shared/auth"
+	"github.com/foodo/shared/config"
+	"github.com/foodo/shared/eventbus"
+	"github.com/foodo/shared/janitor"
+	"github.com/foodo/shared/ratelimit"
+	"github.com/foodo/shared/wshub"
+	"github.com/gorilla/websocket"
+)
+
+// testService is location-tracker running against miniredis, with its
+// router behind an httptest server and the location subscriber running
+type testService struct {
+	server *Server
+	http   *httptest.Server
+}
+
+// The secret the test API signs user tokens with
+const testJWTSecret = "test-jwt-secret"
+
+func startTestService(t *testing.T) *testService {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	t.Setenv("REDIS_ADDR", mr.Addr())
+	t.Setenv("ADMIN_TOKENS", "ops=test-token")
+	t.Setenv("JWT_SECRET", testJWTSecret)
+	t.Setenv("REDIS_ALLOW_NO_AUTH", "true")
+
+	cfg, err := config.Load("location-tracker", "0", nil)
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	redisClient, err := config.NewRedisClient(cfg.Redis)
+	if err != nil {
+		t.Fatalf("create Redis client: %v", err)
+	}
+
+	// Wired as in main, without Postgres or rate limits
+	s := &Server{
+		Config:      cfg,
+		Redis:       redisClient,
+		Locations:   NewRedisLocationStore(redisClient, nil, 1000),
+		Events:      eventbus.NewRedis(redisClient),
+		Hub:         wshub.New(cfg),
+		AdminTokens: auth.ParseAdminTokens(cfg.List("ADMIN_TOKENS")),
+		Users:       auth.NewUsers(cfg.String("JWT_SECRET", ""), auth.RevokedInRedis(redisClient)),
+		Janitor:     janitor.New(cfg, redisClient),
+	}
+	s.addJanitorTasks(s.Janitor)
+	s.setupHealthChecks()
+	r, err := s.newRouter()
+	if err != nil {
+		t.Fatalf("build router: %v", err)
+	}
+	srv := httptest.NewServer(r)
+
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.subscribeToLocationUpdates(ctx)
+	}()
+	t.Cleanup(func() {
+		stop()
+		<-done
+		srv.Close()
+		s.Hub.Close(context.Background(), websocket.CloseGoingAway, "test over")
+		redisClient.Close()
+	})
+
+	waitFor(t, "location subscriber", s.LocationEvents.Running)
+	return &testService{server: s, http: srv}
+}
+
+// Connect to /ws/location/{type}/{id} and wait until the hub has registered
+// the connection. Drivers and customers connect with their own token, order
+// watchers with a customer's.
+func (ts *testService) connect(t *testing.T, userType, id string) *websocket.Conn {
+	t.Helper()
+	token := userToken(id)
+	if userType == "order" {
+		token = userToken("customer-1")
+	}
+	return ts.connectWith(t, token, userType, id)
+}
+
+// Connect to /ws/location/{type}/{id} with token and wait until the hub has
+// registered the connection
+func (ts *testService) connectWith(t *testing.T, token, userType, id string) *websocket.Conn {
+	t.Helper()
+	url := ts.socketURL(userType, id)
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer " + token}})
+	if err != nil {
+		t.Fatalf("dial %s: %v", url, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	waitFor(t, userType+":"+id+" to register", func() bool {
+		_, ok := ts.server.Hub.Get(userType + ":" + id)
+		return ok
+	})
+	return conn
+}
+
+func (ts *testService) socketURL(userType, id string) string {
+	return "ws" + strings.TrimPrefix(ts.http.URL, "http") + "/ws/location/" + userType + "/" + id
+}
+
+// Post a location update as an operator
+func (ts *testService) postUpdate(t *testing.T, body string) {
+	t.Helper()
+	if status := ts.sendUpdate(t, "test-token", body); status != http.StatusOK {
+		t.Fatalf("update status = %d, want 200", status)
+	}
+}
+
+// Post a location update with a bearer token, if given, and return the
+// status
+func (ts *testService) sendUpdate(t *testing.T, token, body string) int {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, ts.http.URL+"/api/location/update", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("post update: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// Sign a user token the way the API does at login
+func userToken(userID string) string {
+	encode := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	unsigned := encode(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." +
+		encode(map[string]interface{}{"sub": userID, "exp": time.Now().Add(time.Hour).Unix()})
+	mac := hmac.New(sha256.New, []byte(testJWTSecret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Read the next location update broadcast to conn
+func readUpdate(t *testing.T, conn *websocket.Conn) LocationUpdate {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	var update LocationUpdate
+	if err := conn.ReadJSON(&update); err != nil {
+		t.Fatalf("waiting for location update: %v", err)
+	}
+	return update
+}
+
+// Poll cond until it holds or five seconds pass
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Changing the log level takes an admin token, which is checked before the
+// body is
+func TestLogLevelNeedsAdminToken(t *testing.T) {
+	ts := startTestService(t)
+
+	for _, tc := range []struct {
+		token, body string
+		want        int
+	}{
+		{"", `{"level": "info"}`, http.StatusUnauthorized},
+		{"", `{"level": "loud"}`, http.StatusUnauthorized},
+		{"wrong", `{"level": "info"}`, http.StatusUnauthorized},
+		{"test-token", `{"level": "loud"}`, http.StatusBadRequest},
+		{"test-token", `{"level": "info"}`, http.StatusOK},
+	} {
+		req, _ := http.NewRequest(http.MethodPut, ts.http.URL+"/debug/log-level", strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", "application/json")
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("set log level: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("token %q, body %s: status = %d, want %d", tc.token, tc.body, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+// Users send their own location with their user token
+func TestLocationUpdateNeedsUserToken(t *testing.T) {
+	ts := startTestService(t)
+	body := `{"userId": "driver-1", "userType": "driver", "location": {"latitude": 40.7128, "longitude": -74.006}}`
+
+	for _, tc := range []struct {
+		name, token string
+		want        int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"bad token", "not-a-token", http.StatusUnauthorized},
+		{"another user's token", userToken("driver-2"), http.StatusForbidden},
+		{"own token", userToken("driver-1"), http.StatusOK},
+	} {
+		if status := ts.sendUpdate(t, tc.token, body); status != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, status, tc.want)
+		}
+	}
+
+	// Authentication comes before validation
+	if status := ts.sendUpdate(t, "", `{"userId": 7}`); status != http.StatusUnauthorized {
+		t.Errorf("invalid body without a token: status = %d, want 401", status)
+	}
+}
+
+// Sockets are opened with a user token, as the user themselves, and
+// watchers can't move the order they watch
+func TestLocationWebSocketNeedsUserToken(t *testing.T) {
+	ts := startTestService(t)
+	for _, tc := range []struct {
+		name, url string
+		header    http.Header
+		want      int
+	}{
+		{"no token", ts.socketURL("driver", "driver-1"), nil, http.StatusUnauthorized},
+		{"another user's token", ts.socketURL("driver", "driver-1"), http.Header{"Authorization": {"Bearer " + userToken("driver-2")}}, http.StatusForbidden},
+		{"watcher without a token", ts.socketURL("order", "order-1"), nil, http.StatusUnauthorized},
+	} {
+		conn, resp, err := websocket.DefaultDialer.Dial(tc.url, tc.header)
+		if err == nil {
+			conn.Close()
+			t.Errorf("%s: connected, want %d", tc.name, tc.want)
+			continue
+		}
+		if resp == nil || resp.StatusCode != tc.want {
+			t.Errorf("%s: %v, want %d", tc.name, err, tc.want)
+		}
+	}
+
+	// Browsers pass the token as access_token
+	conn, _, err := websocket.DefaultDialer.Dial(ts.socketURL("customer", "customer-1")+"?access_token="+userToken("customer-1"), nil)
+	if err != nil {
+		t.Fatalf("own token as access_token: %v", err)
+	}
+	conn.Close()
+
+	watcher := ts.connect(t, "order", "order-1")
+	err = watcher.WriteJSON(map[string]interface{}{"location": map[string]interface{}{"latitude": 3, "longitude": 4}})
+	if err != nil {
+		t.Fatalf("send update: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := ts.server.Locations.Get(context.Background(), "order", "order-1"); err == nil {
+		t.Fatal("watcher moved the order")
+	}
+}
+
+// WebSocket messages draw from the sender's bucket, whichever socket they
+// come on
+func TestWebSocketMessagesLimitedBySender(t *testing.T) {
+	ts := startTestService(t)
+	limiter, err := ratelimit.New(ts.server.Config, ts.server.Redis, map[string]string{"ws_message": "1/m,1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.server.Limiter = limiter
+
+	// An operator standing in for two drivers
+	first := ts.connectWith(t, "test-token", "driver", "driver-1")
+	second := ts.connectWith(t, "test-token", "driver", "driver-2")
+	update := map[string]interface{}{"location": map[string]interface{}{"latitude": 3, "longitude": 4}}
+	if err := first.WriteJSON(update); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "first update", func() bool {
+		_, err := ts.server.Locations.Get(context.Background(), "driver", "driver-1")
+		return err == nil
+	})
+	if err := second.WriteJSON(update); err != nil {
+		t.Fatal(err)
+	}
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg map[string]interface{}
+		if err := second.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for throttled: %v", err)
+		}
+		if msg["type"] == "throttled" {
+			break
+		}
+	}
+}
+
+// Operators read the last janitor pass with an admin token
+func TestJanitorReportNeedsAdminToken(t *testing.T) {
+	ts := startTestService(t)
+	get := func(token string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, ts.http.URL+"/api/location/admin/janitor", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("get janitor report: %v", err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	if resp := get(""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without a token: status = %d, want 401", resp.StatusCode)
+	}
+	if resp := get("test-token"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("before a pass: status = %d, want 404", resp.StatusCode)
+	}
+
+	ts.server.Janitor.RunOnce(context.Background())
+	resp := get("test-token")
+	var report janitor.Report
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("after a pass: status = %d, %v", resp.StatusCode, err)
+	}
+	if report.Service != "location-tracker" {
+		t.Errorf("report service = %q", report.Service)
+	}
+}
+
+func TestDriverUpdateReachesOrderWatcher(t *testing.T) {
+	ts := startTestService(t)
+	watcher := ts.connect(t, "order", "order-1")
+	other := ts.connect(t, "order", "order-2")
+
+	ts.postUpdate(t, `{"userId": "driver-1", "userType": "driver", "orderId": "order-1",
+		"location": {"latitude": 40.7128, "longitude": -74.006, "timestamp": 1700000000}}`)
+
+	update := readUpdate(t, watcher)
+	if update.UserID != "driver-1" || update.UserType != "driver" || update.OrderID != "order-1" {
+		t.Fatalf("update = %+v", update)
+	}
+	if update.Location.Latitude != 40.7128 || update.Location.Longitude != -74.006 {
+		t.Fatalf("location = %+v", update.Location)
+	}
+
+	// Watchers of other orders hear nothing
+	other.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, msg, err := other.ReadMessage(); err == nil {
+		t.Fatalf("watcher of another order got %s", msg)
+	}
+
+	// The order's last location is kept for watchers that join later
+	resp, err := http.Get(ts.http.URL + "/api/location/order/order-1")
+	if err != nil {
+		t.Fatalf("get order location: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("order location status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestWatcherGetsLastKnownLocationOnConnect(t *testing.T) {
+	ts := startTestService(t)
+	ts.postUpdate(t, `{"userId": "driver-1", "userType": "driver", "orderId": "order-1",
+		"location": {"latitude": 1.5, "longitude": 2.5, "timestamp": 1700000000}}`)
+
+	watcher := ts.connect(t, "order", "order-1")
+	watcher.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var location Location
+	if err := watcher.ReadJSON(&location); err != nil {
+		t.Fatalf("read initial location: %v", err)
+	}
+	if location.Latitude != 1.5 || location.Longitude != 2.5 {
+		t.Fatalf("initial location = %+v", location)
+	}
+}
+
+func TestDriverWebSocketUpdateReachesOrderWatcher(t *testing.T) {
+	ts := startTestService(t)
+	watcher := ts.connect(t, "order", "order-1")
+	driver := ts.connect(t, "driver", "driver-1")
+
+	// The connection decides who is moving, whatever the message says
+	err := driver.WriteJSON(map[string]interface{}{
+		"userId":   "someone-else",
+		"orderId":  "order-1",
+		"location": map[string]interface{}{"latitude": 3, "longitude": 4},
+	})
+	if err != nil {
+		t.Fatalf("send update: %v", err)
+	}
+
+	update := readUpdate(t, watcher)
+	if update.UserID != "driver-1" || update.UserType != "driver" {
+		t.Fatalf("update = %+v, want from driver-1", update)
+	}
+	if update.Location.Latitude != 3 || update.Location.Longitude != 4 {
+		t.Fatalf("location = %+v", update.Location)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/foodo/shared/janitor"
+	"github.com/foodo/shared/logging"
+	"github.com/foodo/shared/tracking"
+)
+
+// Trails handled per batch; a pass keeps taking batches until none are idle
+const trailBatchSize = 100
+
+// Add the location retention tasks to j. A trail whose order has had no
+// driver update for JANITOR_TRAIL_IDLE is taken to be finished.
+func (s *Server) addJanitorTasks(j *janitor.Janitor) {
+	trailIdle := s.Config.Duration("JANITOR_TRAIL_IDLE", time.Hour)
+
+	j.Add("trails", func(ctx context.Context, report *janitor.Report) error {
+		return s.archiveTrails(ctx, report, time.Now().Add(-trailIdle))
+	})
+}
+
+// Move trails idle since cutoff to Postgres and out of Redis. Without a
+// database, or for orders Postgres doesn't know, trails are discarded.
+func (s *Server) archiveTrails(ctx context.Context, report *janitor.Report, cutoff time.Time) error {
+	for {
+		orderIDs, err := s.Locations.IdleTrails(ctx, cutoff, trailBatchSize)
+		if err != nil || len(orderIDs) == 0 {
+			return err
+		}
+		for _, orderID := range orderIDs {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err := s.archiveTrail(logging.WithOrderID(ctx, orderID), report, orderID, cutoff); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *Server) archiveTrail(ctx context.Context, report *janitor.Report, orderID string, cutoff time.Time) error {
+	points, err := s.Locations.Trail(ctx, orderID)
+	if err != nil {
+		return err
+	}
+
+	kind := "trails_discarded"
+	if s.Tracking != nil && len(points) > 0 {
+		err := s.Tracking.ArchiveTrail(ctx, orderID, points)
+		switch {
+		case err == nil:
+			kind = "trails_archived"
+		case tracking.IsForeignKeyViolation(err):
+			slog.DebugContext(ctx, "Discarding trail for unknown order")
+		default:
+			return err
+		}
+	}
+
+	deleted, err := s.Locations.DeleteTrail(ctx, orderID, cutoff)
+	if err != nil {
+		return err
+	}
+	// The order moved again while it was being archived. The next archive
+	// adds only the points after these.
+	if !deleted {
+		return nil
+	}
+	s.Tracking.Forget(orderID)
+	report.Add(kind, 1)
+	return nil
+}
+
+// Report the most recent janitor pass from any replica
+func (s *Server) getJanitorReportHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+
+	report, err := s.Janitor.LastReport(ctx)
+	if err != nil {
+		http.Error(w, "Failed to get janitor report", http.StatusInternalServerError)
+		return
+	}
+	if report == nil {
+		http.Error(w, "No recent janitor pass", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -4,15 +4,31 @@ import (
 	"context"
 	"encoding/json"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
-	"os/signal"
-	"syscall"
+	"strings"
 	"time"
 
+	"github.com/foodo/shared/auth"
+	"github.com/foodo/shared/bootstrap"
+	"github.com/foodo/shared/config"
+	"github.com/foodo/shared/eventbus"
+	"github.com/foodo/shared/health"
+	"github.com/foodo/shared/janitor"
+	"github.com/foodo/shared/logging"
+	"github.com/foodo/shared/metrics"
+	"github.com/foodo/shared/openapi"
+	"github.com/foodo/shared/pubsub"
+	"github.com/foodo/shared/ratelimit"
+	"github.com/foodo/shared/rediskeys"
+	"github.com/foodo/shared/tracing"
+	"github.com/foodo/shared/wshub"
 	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Location represents a geographical point
@@ -30,85 +46,231 @@ type LocationUpdate struct {
 	OrderID  string   `json:"orderId,omitempty"`
 }
 
+// Server holds what the location handlers depend on; the handlers are its
+// methods. main wires it to Redis, and the in-memory store lets it run
+// without.
+type Server struct {
+	Config *config.Config
+	// The location subscriber and readiness checks use it directly
+	Redis redis.UniversalClient
+
+	Locations LocationStore
+	Events    eventbus.Bus
+
+	// Connected clients, keyed by "<type>:<id>"
+	Hub *wshub.Hub
+	// Background writer for the Postgres OrderTracking table (nil if disabled)
+	Tracking *TrackingWriter
+	// Per-client limits on location updates, shared across replicas (nil if
+	// disabled)
+	Limiter *ratelimit.Limiter
+	// Admin bearer tokens for the operational endpoints, mapped to the
+	// operator's name
+	AdminTokens map[string]string
+	// Verifies the API's user tokens, which location updates are sent with
+	Users *auth.Users
+	// Trail archiving passes (nil if not running)
+	Janitor *janitor.Janitor
+
+	// Readiness checks served at /readyz
+	Readiness *health.Checker
+	// State of the location update subscriber
+	LocationEvents health.Consumer
+}
+
 var (
-	redisClient *redis.Client
-	upgrader    = websocket.Upgrader{
+	upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
 		CheckOrigin: func(r *http.Request) bool {
 			return true // Allow all connections in development
 		},
 	}
-	// In-memory storage for active connections
-	connections = make(map[string]*websocket.Conn)
+	tracer = tracing.Tracer("github.com/foodo/location-tracker")
 )
 
 func main() {
-	// Initialize Redis client with Redis Cloud connection
-	redisClient = redis.NewClient(&redis.Options{
-		Addr:     getEnv("REDIS_ADDR", "redis-18764.c292.ap-southeast-1-1.ec2.redns.redis-cloud.com:18764"),
-		Username: getEnv("REDIS_USERNAME", "default"),
-		Password: getEnv("REDIS_PASSWORD", "dljBc2IR2S1CPZyZMBBtFDb8nwYxhkwb"),
-		DB:       0,
-	})
+	// Load configuration from file, environment and flags
+	cfg, err := config.Load("location-tracker", "8081", os.Args[1:], rediskeys.MigrateFlag)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	logging.Setup(cfg)
 
-	// Create router
-	r := mux.NewRouter()
+	// Initialize Redis client
+	redisClient, err := config.NewRedisClient(cfg.Redis)
+	if err != nil {
+		logging.Fatal("Failed to create Redis client", "error", err)
+	}
+	redisClient.AddHook(metrics.RedisHook{})
+	redisClient.AddHook(tracing.RedisHook{})
+
+	// Move keys to the cluster layout and exit when asked to
+	if cfg.Bool("REDIS_MIGRATE_KEYS", false) {
+		m := rediskeys.NewMigration(redisClient)
+		if err := migrateKeys(context.Background(), m); err != nil {
+			logging.Fatal("Failed to migrate Redis keys", "error", err, "moved", m.Moved)
+		}
+		slog.Info("Redis keys migrated", "moved", m.Moved)
+		redisClient.Close()
+		return
+	}
 
-	// API routes
-	r.HandleFunc("/health", healthCheckHandler).Methods("GET")
-	r.HandleFunc("/api/location/update", updateLocationHandler).Methods("POST")
-	r.HandleFunc("/api/location/user/{id}", getUserLocationHandler).Methods("GET")
-	r.HandleFunc("/api/location/driver/{id}", getDriverLocationHandler).Methods("GET")
-	r.HandleFunc("/api/location/order/{id}", getOrderLocationHandler).Methods("GET")
+	// Export traces when an exporter is configured
+	shutdownTracing, err := tracing.Init(context.Background(), cfg)
+	if err != nil {
+		logging.Fatal("Failed to initialize tracing", "error", err)
+	}
 
-	// WebSocket route for real-time location updates
-	r.HandleFunc("/ws/location/{type}/{id}", locationWebSocketHandler)
+	// Each kind of location expires after its own retention without updates
+	retention := map[string]time.Duration{
+		"driver":   cfg.Duration("LOCATION_RETENTION_DRIVER", 24*time.Hour),
+		"customer": cfg.Duration("LOCATION_RETENTION_CUSTOMER", 24*time.Hour),
+		"order":    cfg.Duration("LOCATION_RETENTION_ORDER", 24*time.Hour),
+		"trail":    cfg.Duration("LOCATION_RETENTION_TRAIL", 24*time.Hour),
+	}
+	s := &Server{
+		Config:      cfg,
+		Redis:       redisClient,
+		Locations:   NewRedisLocationStore(redisClient, retention, cfg.Int("TRAIL_MAX_POINTS", 1000)),
+		Events:      eventbus.NewRedis(redisClient),
+		AdminTokens: auth.ParseAdminTokens(cfg.List("ADMIN_TOKENS")),
+		Users:       auth.NewUsers(cfg.String("JWT_SECRET", ""), auth.RevokedInRedis(redisClient)),
+	}
 
-	// Start listening for Redis messages in a goroutine
-	go subscribeToLocationUpdates()
+	// Persist driver locations to Postgres when a database is configured
+	if cfg.DatabaseURL != "" {
+		writer, err := NewTrackingWriter(context.Background(), cfg)
+		if err != nil {
+			slog.Warn("Order tracking persistence disabled", "error", err)
+		} else {
+			s.Tracking = writer
+		}
+	}
+
+	// Connected clients and their send queues
+	s.Hub = wshub.New(cfg)
 
-	// Create HTTP server
-	srv := &http.Server{
-		Addr:         ":" + getEnv("PORT", "8081"),
-		Handler:      r,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+	// Rate limits, overridable with RATE_LIMIT_<ROUTE>
+	s.Limiter, err = ratelimit.New(cfg, redisClient, map[string]string{
+		"location_update": "5/s,10",
+		"ws_message":      "10/s,20",
+	})
+	if err != nil {
+		logging.Fatal("Invalid rate limit", "error", err)
+	}
+
+	// Readiness checks for /readyz
+	s.setupHealthChecks()
+
+	// Archive finished orders' trails, one replica at a time
+	s.Janitor = janitor.New(cfg, redisClient)
+	s.addJanitorTasks(s.Janitor)
+
+	// Create router
+	r, err := s.newRouter()
+	if err != nil {
+		logging.Fatal("Invalid OpenAPI document", "error", err)
 	}
 
-	// Start server in a goroutine
+	// Refuse to start on settings that didn't parse rather than run with
+	// their defaults
+	drainDelay := cfg.Duration("SHUTDOWN_DRAIN_DELAY", 0)
+	reconnectSpread := cfg.Duration("SHUTDOWN_RECONNECT_SPREAD", 10*time.Second)
+	if err := cfg.Err(); err != nil {
+		logging.Fatal("Invalid configuration", "error", err)
+	}
+
+	// Start listening for Redis messages in a goroutine
+	subscriberCtx, stopSubscriber := context.WithCancel(context.Background())
+	subscriberDone := make(chan struct{})
 	go func() {
-		log.Printf("Starting server on port %s", getEnv("PORT", "8081"))
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Could not listen on %s: %v", getEnv("PORT", "8081"), err)
-		}
+		defer close(subscriberDone)
+		s.subscribeToLocationUpdates(subscriberCtx)
 	}()
+	janitorCtx, stopJanitor := context.WithCancel(context.Background())
+	go s.Janitor.Run(janitorCtx)
+
+	// Run the HTTP server until interrupted
+	srv := bootstrap.NewServer(cfg, r)
+	bootstrap.Run(cfg, srv, func(ctx context.Context) error {
+		// Fail readiness and give load balancers time to notice
+		s.Readiness.Drain(ctx, drainDelay)
+
+		// Stop accepting connections, location broadcasts and HTTP requests
+		s.Hub.StopAccepting()
+		stopSubscriber()
+		stopJanitor()
+		httpDone := make(chan error, 1)
+		go func() { httpDone <- srv.Shutdown(ctx) }()
+
+		// Ask clients to reconnect elsewhere, spread out over time
+		s.Hub.SendReconnect(reconnectSpread)
+		s.Hub.Flush(ctx)
+
+		// Wait for the in-flight broadcast and HTTP requests
+		select {
+		case <-subscriberDone:
+		case <-ctx.Done():
+		}
+		err := <-httpDone
 
-	// Wait for interrupt signal to gracefully shutdown the server
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	log.Println("Shutting down server...")
+		// Deliver anything still queued, then close with 1012
+		s.Hub.Close(ctx, websocket.CloseServiceRestart, "server restarting")
 
-	// Create a deadline to wait for
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+		// Flush pending tracking writes
+		s.Tracking.Close()
 
-	// Close all WebSocket connections
-	for _, conn := range connections {
-		conn.Close()
-	}
+		// Close Redis client
+		redisClient.Close()
+
+		// Flush buffered spans
+		shutdownTracing(ctx)
 
-	// Close Redis client
-	redisClient.Close()
+		return err
+	})
+}
 
-	// Shutdown server
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+// Build the router with its middleware, the operational endpoints and the
+// service's routes. Requests are validated against the OpenAPI document.
+func (s *Server) newRouter() (*mux.Router, error) {
+	spec, err := openapi.Load(openAPISpec)
+	if err != nil {
+		return nil, err
 	}
 
-	log.Println("Server exiting")
+	// Authenticate before validating
+	guard := auth.NewGuard()
+	r := mux.NewRouter()
+	r.Use(tracing.Middleware("location-tracker"))
+	r.Use(logging.Middleware)
+	r.Use(guard.Middleware)
+	r.Use(spec.Middleware)
+
+	// API routes
+	r.HandleFunc("/health", healthCheckHandler).Methods("GET")
+	r.HandleFunc("/livez", s.Readiness.LivenessHandler).Methods("GET")
+	r.HandleFunc("/readyz", s.Readiness.ReadinessHandler).Methods("GET")
+	r.HandleFunc("/openapi.json", spec.Handler).Methods("GET")
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
+	guard.Require(r.HandleFunc("/debug/log-level", logging.LevelHandler).Methods("GET", "PUT"), auth.Admin(s.AdminTokens))
+	s.registerRoutes(r, guard)
+	return r, nil
+}
+
+// Register the location API and WebSocket routes. Users send their own
+// location and open sockets with their user token; the janitor report takes
+// an admin token.
+func (s *Server) registerRoutes(r *mux.Router, guard *auth.Guard) {
+	user := auth.UserOrAdmin(s.Users, s.AdminTokens)
+	guard.Require(r.HandleFunc("/api/location/update", s.updateLocationHandler).Methods("POST"), user)
+	r.HandleFunc("/api/location/user/{id}", s.getUserLocationHandler).Methods("GET")
+	r.HandleFunc("/api/location/driver/{id}", s.getDriverLocationHandler).Methods("GET")
+	r.HandleFunc("/api/location/order/{id}", s.getOrderLocationHandler).Methods("GET")
+	guard.Require(r.HandleFunc("/api/location/admin/janitor", s.getJanitorReportHandler).Methods("GET"), auth.Admin(s.AdminTokens))
+
+	// WebSocket route for real-time location updates
+	guard.Require(r.HandleFunc("/ws/location/{type}/{id}", s.locationWebSocketHandler), user)
 }
 
 // Health check handler
@@ -122,8 +284,8 @@ func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // Update location handler
-func updateLocationHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
+func (s *Server) updateLocationHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
 
 	// Parse request body
 	var update LocationUpdate
@@ -132,132 +294,171 @@ func updateLocationHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if update.UserType == "driver" {
+		ctx = logging.WithDriverID(ctx, update.UserID)
+	}
+	if update.OrderID != "" {
+		ctx = logging.WithOrderID(ctx, update.OrderID)
+	}
+
+	if !auth.ActsFor(ctx, update.UserID) {
+		http.Error(w, "Users can only update their own location", http.StatusForbidden)
+		return
+	}
+
+	// Limit each user, not each caller, so one client can't drown the rest
+	if !s.Limiter.Check(w, r, "location_update") {
+		return
+	}
+
 	// Set timestamp if not provided
 	if update.Location.Timestamp == 0 {
 		update.Location.Timestamp = time.Now().Unix()
 	}
 
-	// Store location in Redis
-	locationKey := getLocationKey(update.UserType, update.UserID)
-	locationJSON, _ := json.Marshal(update.Location)
-	redisClient.Set(ctx, locationKey, locationJSON, 24*time.Hour)
+	// Store location
+	s.Locations.Save(ctx, update.UserType, update.UserID, update.Location)
 
 	// If this is a driver with an active order, update order location
 	if update.UserType == "driver" && update.OrderID != "" {
-		orderLocationKey := "order_location:" + update.OrderID
-		redisClient.Set(ctx, orderLocationKey, locationJSON, 24*time.Hour)
+		s.Locations.Save(ctx, "order", update.OrderID, update.Location)
+		s.recordTrail(ctx, update)
 	}
 
 	// Publish location update
 	updateJSON, _ := json.Marshal(update)
-	redisClient.Publish(ctx, "location_updates", string(updateJSON))
+	s.Events.Publish(ctx, "location_updates", updateJSON)
+	locationUpdates.WithLabelValues(update.UserType, "http").Inc()
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"status": "ok"}`))
 }
 
-// Get user location handler
-func getUserLocationHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
-	vars := mux.Vars(r)
-	userID := vars["id"]
-
-	// Get location from Redis
-	locationKey := getLocationKey("customer", userID)
-	locationJSON, err := redisClient.Get(ctx, locationKey).Result()
-	if err != nil {
-		http.Error(w, "Location not found", http.StatusNotFound)
-		return
+// Add a driver's update to its order's trail and persist the latest
+// position
+func (s *Server) recordTrail(ctx context.Context, update LocationUpdate) {
+	point := TrailPoint{DriverID: update.UserID, Location: update.Location}
+	if err := s.Locations.AppendTrail(ctx, update.OrderID, point); err != nil {
+		slog.WarnContext(ctx, "Failed to record trail", "error", err)
 	}
+	s.Tracking.RecordLocation(update.OrderID, update.UserID, update.Location)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(locationJSON))
+// Get user location handler
+func (s *Server) getUserLocationHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeLocation(w, r, "customer")
 }
 
 // Get driver location handler
-func getDriverLocationHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
-	vars := mux.Vars(r)
-	driverID := vars["id"]
-
-	// Get location from Redis
-	locationKey := getLocationKey("driver", driverID)
-	locationJSON, err := redisClient.Get(ctx, locationKey).Result()
-	if err != nil {
-		http.Error(w, "Location not found", http.StatusNotFound)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(locationJSON))
+func (s *Server) getDriverLocationHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeLocation(w, r, "driver")
 }
 
 // Get order location handler (returns driver location for the order)
-func getOrderLocationHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
+func (s *Server) getOrderLocationHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeLocation(w, r, "order")
+}
+
+// Respond with the last known location of the given kind for {id}
+func (s *Server) writeLocation(w http.ResponseWriter, r *http.Request, kind string) {
+	ctx := context.WithoutCancel(r.Context())
 	vars := mux.Vars(r)
-	orderID := vars["id"]
 
-	// Get order location from Redis
-	orderLocationKey := "order_location:" + orderID
-	locationJSON, err := redisClient.Get(ctx, orderLocationKey).Result()
+	location, err := s.Locations.Get(ctx, kind, vars["id"])
 	if err != nil {
 		http.Error(w, "Location not found", http.StatusNotFound)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(locationJSON))
+	json.NewEncoder(w).Encode(location)
 }
 
 // WebSocket handler for real-time location updates
-func locationWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) locationWebSocketHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userType := vars["type"] // driver, customer, order
 	id := vars["id"]
 
+	// Generate connection ID
+	connectionID := userType + ":" + id
+	connCtx := logging.WithConnectionID(r.Context(), connectionID)
+	switch userType {
+	case "driver":
+		connCtx = logging.WithDriverID(connCtx, id)
+	case "order":
+		connCtx = logging.WithOrderID(connCtx, id)
+	}
+
+	// Users connect as themselves. Anyone signed in can watch an order, but
+	// a watcher's messages aren't locations, since there's nobody to check
+	// them against.
+	sends := userType != "order"
+	if sends && !auth.ActsFor(connCtx, id) {
+		http.Error(w, "Users can only connect as themselves", http.StatusForbidden)
+		return
+	}
+	// Messages are limited by who sent them, not the socket they came on
+	limitKey := s.Limiter.Identity(r)
+
+	// Send new connections elsewhere while draining
+	if s.Hub.Draining() {
+		http.Error(w, "Server is draining", http.StatusServiceUnavailable)
+		return
+	}
+
 	// Upgrade HTTP connection to WebSocket
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("Failed to upgrade connection: %v", err)
+		slog.WarnContext(connCtx, "Failed to upgrade connection", "error", err)
 		return
 	}
 
-	// Generate connection ID
-	connectionID := userType + ":" + id
-
 	// Store connection
-	connections[connectionID] = conn
+	client, err := s.Hub.Register(connectionID, conn)
+	if err != nil {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseServiceRestart, err.Error()), time.Now().Add(time.Second))
+		conn.Close()
+		return
+	}
+	metrics.WebSocketConnections.WithLabelValues(userType).Inc()
+	slog.InfoContext(connCtx, "Location client connected")
 
-	// Clean up on disconnect
+	// Clean up on disconnect, including peers that stopped answering pings
+	var readErr error
 	defer func() {
-		conn.Close()
-		delete(connections, connectionID)
+		reason := wshub.DisconnectReason(readErr)
+		s.Hub.Unregister(client)
+		metrics.WebSocketConnections.WithLabelValues(userType).Dec()
+		metrics.WebSocketDisconnects.WithLabelValues(userType, reason).Inc()
+		slog.InfoContext(connCtx, "Location client disconnected", "reason", reason)
 	}()
 
 	// Send initial location if available
-	ctx := context.Background()
-	var locationKey string
-	if userType == "order" {
-		locationKey = "order_location:" + id
-	} else {
-		locationKey = getLocationKey(userType, id)
-	}
-
-	locationJSON, err := redisClient.Get(ctx, locationKey).Result()
-	if err == nil {
-		conn.WriteMessage(websocket.TextMessage, []byte(locationJSON))
-	}
+	s.sendCurrentLocation(context.WithoutCancel(connCtx), client, userType, id)
 
 	// Handle incoming messages (client can send location updates)
 	for {
 		_, message, err := conn.ReadMessage()
 		if err != nil {
-			log.Printf("Error reading message: %v", err)
+			readErr = err
+			slog.DebugContext(connCtx, "Error reading message", "error", err)
 			break
 		}
 
+		// Drop messages over the limit and tell the client to slow down
+		if !sends {
+			continue
+		}
+		if result := s.Limiter.Allow(connCtx, "ws_message", limitKey); !result.Allowed {
+			client.SendJSON(map[string]interface{}{
+				"type":         "throttled",
+				"retryAfterMs": result.RetryAfter.Milliseconds(),
+			})
+			continue
+		}
+
 		// Parse location update
 		var update LocationUpdate
 		if err := json.Unmarshal(message, &update); err != nil {
@@ -270,38 +471,86 @@ func locationWebSocketHandler(w http.ResponseWriter, r *http.Request) {
 
 		// Process update
 		// Send the update to the location update handler
-		ctx := context.Background()
-		locationKey := getLocationKey(update.UserType, update.UserID)
-		locationJSON, _ := json.Marshal(update.Location)
-		redisClient.Set(ctx, locationKey, locationJSON, 24*time.Hour)
+		msgCtx := connCtx
+		if update.OrderID != "" {
+			msgCtx = logging.WithOrderID(msgCtx, update.OrderID)
+		}
+		ctx, span := tracer.Start(context.WithoutCancel(msgCtx), "websocket location update", trace.WithAttributes(
+			attribute.String("user.type", update.UserType),
+			attribute.String("user.id", update.UserID),
+		))
+		s.Locations.Save(ctx, update.UserType, update.UserID, update.Location)
+
+		// Persist driver progress on an active order
+		if update.UserType == "driver" && update.OrderID != "" {
+			s.recordTrail(ctx, update)
+		}
 
 		// Publish location update
 		updateJSON, _ := json.Marshal(update)
-		redisClient.Publish(ctx, "location_updates", string(updateJSON))
+		s.Events.Publish(ctx, "location_updates", updateJSON)
+		locationUpdates.WithLabelValues(update.UserType, "websocket").Inc()
+		span.End()
 	}
 }
 
-// Subscribe to Redis channel for location updates
-func subscribeToLocationUpdates() {
-	ctx := context.Background()
-	pubsub := redisClient.Subscribe(ctx, "location_updates")
-	defer pubsub.Close()
+// Subscribe to Redis channel for location updates, resubscribing and
+// resyncing if the connection drops
+func (s *Server) subscribeToLocationUpdates(ctx context.Context) {
+	subscriber := pubsub.New(s.Config, s.Redis, "location_updates")
+	subscriber.Handle = s.handleLocationMessage
+	subscriber.Resync = s.resyncLocations
+	subscriber.State = &s.LocationEvents
+	subscriber.Run(ctx)
+}
 
-	ch := pubsub.Channel()
-	for msg := range ch {
-		var update LocationUpdate
-		if err := json.Unmarshal([]byte(msg.Payload), &update); err != nil {
-			log.Printf("Failed to parse location update: %v", err)
+// Broadcast a location update received over pub/sub
+func (s *Server) handleLocationMessage(msg *redis.Message) {
+	metrics.PubSubMessages.WithLabelValues(msg.Channel).Inc()
+
+	var update LocationUpdate
+	if err := json.Unmarshal([]byte(msg.Payload), &update); err != nil {
+		slog.Warn("Failed to parse location update", "error", err)
+		return
+	}
+
+	// Notify connected clients, continuing the publisher's trace
+	ctx := tracing.ExtractPayload(context.Background(), []byte(msg.Payload))
+	_, span := tracer.Start(ctx, "broadcast location update", trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(
+		attribute.String("user.type", update.UserType),
+		attribute.String("user.id", update.UserID),
+	))
+	s.notifyLocationUpdate(update)
+	span.End()
+}
+
+// Resend every connected client its latest location, replacing any updates
+// missed while the subscription was down
+func (s *Server) resyncLocations(ctx context.Context) error {
+	clients := s.Hub.Clients()
+	for _, client := range clients {
+		userType, id, ok := strings.Cut(client.ID, ":")
+		if !ok {
 			continue
 		}
+		s.sendCurrentLocation(ctx, client, userType, id)
+	}
+	slog.InfoContext(ctx, "Resynced locations", "connections", len(clients))
+	return nil
+}
 
-		// Notify connected clients
-		notifyLocationUpdate(update)
+// Send the last known location for a connection, if there is one
+func (s *Server) sendCurrentLocation(ctx context.Context, client *wshub.Client, userType, id string) {
+	if location, err := s.Locations.Get(ctx, userType, id); err == nil {
+		client.SendJSON(location)
 	}
 }
 
 // Notify connected clients about location update
-func notifyLocationUpdate(update LocationUpdate) {
+func (s *Server) notifyLocationUpdate(update LocationUpdate) {
+	start := time.Now()
+	defer func() { broadcastLatency.Observe(time.Since(start).Seconds()) }()
+
 	// Convert update to JSON
 	updateJSON, _ := json.Marshal(update)
 
@@ -311,8 +560,8 @@ func notifyLocationUpdate(update LocationUpdate) {
 		// Notify customers tracking this driver's order
 		if update.OrderID != "" {
 			orderConnectionID := "order:" + update.OrderID
-			if conn, ok := connections[orderConnectionID]; ok {
-				conn.WriteMessage(websocket.TextMessage, updateJSON)
+			if client, ok := s.Hub.Get(orderConnectionID); ok {
+				client.Send(updateJSON)
 			}
 		}
 	case "customer":
@@ -322,20 +571,7 @@ func notifyLocationUpdate(update LocationUpdate) {
 
 	// Notify specific user
 	connectionID := update.UserType + ":" + update.UserID
-	if conn, ok := connections[connectionID]; ok {
-		conn.WriteMessage(websocket.TextMessage, updateJSON)
-	}
-}
-
-// Helper function to get location key for Redis
-func getLocationKey(userType, userID string) string {
-	return userType + "_location:" + userID
-}
-
-// Helper function to get environment variable with fallback
-func getEnv(key, fallback string) string {
-	if value, exists := os.LookupEnv(key); exists {
-		return value
+	if client, ok := s.Hub.Get(connectionID); ok {
+		client.Send(updateJSON)
 	}
-	return fallback
 }
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/foodo/shared/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// Location updates accepted, by reporter type and transport; rate() of
+	// this gives updates per second
+	locationUpdates = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "location",
+		Name:      "updates_total",
+		Help:      "Location updates received.",
+	}, []string{"user_type", "source"})
+
+	// Time to push one update to every interested socket
+	broadcastLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "location",
+		Name:      "broadcast_seconds",
+		Help:      "Fan-out latency for a location update.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	})
+)
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/foodo/shared/rediskeys"
+)
+
+// Move locations from the flat key layout, where they were under
+// "<kind>_location:<id>", to the hash-tagged one in store.go. Run it with
+// every replica stopped. It can be run again after a failure.
+func migrateKeys(ctx context.Context, m *rediskeys.Migration) error {
+	return rediskeys.Scan(ctx, m.Client, "*_location:*", func(key string) error {
+		kind, id, _ := strings.Cut(key, "_location:")
+		if strings.ContainsAny(kind, ":{") {
+			return nil
+		}
+		return m.String(ctx, "locations", key, getLocationKey(kind, id))
+	})
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/foodo/shared/rediskeys"
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrNotFound is returned by a LocationStore when there is no location
+var ErrNotFound = errors.New("not found")
+
+// LocationStore holds the last known location of each driver, customer and
+// order, and the trail of points each order's driver has reported. kind is
+// "driver", "customer" or "order".
+type LocationStore interface {
+	Get(ctx context.Context, kind, id string) (Location, error)
+	Save(ctx context.Context, kind, id string, location Location) error
+
+	// AppendTrail adds a point to an order's trail and marks it active now
+	AppendTrail(ctx context.Context, orderID string, point TrailPoint) error
+	// IdleTrails returns up to limit orders whose trail hasn't grown since
+	// before
+	IdleTrails(ctx context.Context, before time.Time, limit int) ([]string, error)
+	// Trail returns an order's points, oldest first
+	Trail(ctx context.Context, orderID string) ([]TrailPoint, error)
+	// DeleteTrail removes an order's trail unless it has grown since before,
+	// reporting whether it did
+	DeleteTrail(ctx context.Context, orderID string, before time.Time) (bool, error)
+}
+
+// TrailPoint is one location a driver reported while delivering an order
+type TrailPoint struct {
+	DriverID string `json:"driverId"`
+	Location
+}
+
+// RedisLocationStore keeps each location under "<kind>:{<id>}:location",
+// expiring after its kind's ttl without updates. Trails are lists under
+// "order:{<id>}:trail", capped at trailPoints, beside "order:{<id>}:trail_at"
+// holding when the trail last grew. The "order_trails" index scores each
+// order by the same time, so the janitor can find idle trails.
+type RedisLocationStore struct {
+	client      redis.UniversalClient
+	ttl         map[string]time.Duration
+	trailPoints int
+}
+
+// NewRedisLocationStore returns a LocationStore backed by client. Kinds
+// missing from ttl, and trails, expire after a day.
+func NewRedisLocationStore(client redis.UniversalClient, ttl map[string]time.Duration, trailPoints int) *RedisLocationStore {
+	return &RedisLocationStore{client: client, ttl: ttl, trailPoints: trailPoints}
+}
+
+func (s *RedisLocationStore) ttlFor(kind string) time.Duration {
+	if ttl, ok := s.ttl[kind]; ok {
+		return ttl
+	}
+	return 24 * time.Hour
+}
+
+func (s *RedisLocationStore) Get(ctx context.Context, kind, id string) (Location, error) {
+	var location Location
+	locationJSON, err := s.client.Get(ctx, getLocationKey(kind, id)).Result()
+	if err == redis.Nil {
+		return location, ErrNotFound
+	}
+	if err != nil {
+		return location, err
+	}
+	err = json.Unmarshal([]byte(locationJSON), &location)
+	return location, err
+}
+
+func (s *RedisLocationStore) Save(ctx context.Context, kind, id string, location Location) error {
+	locationJSON, _ := json.Marshal(location)
+	return s.client.Set(ctx, getLocationKey(kind, id), locationJSON, s.ttlFor(kind)).Err()
+}
+
+func (s *RedisLocationStore) AppendTrail(ctx context.Context, orderID string, point TrailPoint) error {
+	key := trailKey(orderID)
+	now := time.Now().UnixMilli()
+	pointJSON, _ := json.Marshal(point)
+	pipe := s.client.TxPipeline()
+	pipe.RPush(ctx, key, pointJSON)
+	pipe.LTrim(ctx, key, int64(-s.trailPoints), -1)
+	// A backstop in case the janitor isn't running
+	pipe.Expire(ctx, key, s.ttlFor("trail"))
+	pipe.Set(ctx, trailAtKey(orderID), now, s.ttlFor("trail"))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	// The index is in another slot, so it's written on its own
+	return s.client.ZAdd(ctx, trailsIndexKey, &redis.Z{Score: float64(now), Member: orderID}).Err()
+}
+
+func (s *RedisLocationStore) IdleTrails(ctx context.Context, before time.Time, limit int) ([]string, error) {
+	return s.client.ZRangeByScore(ctx, trailsIndexKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   "(" + strconv.FormatInt(before.UnixMilli(), 10),
+		Count: int64(limit),
+	}).Result()
+}
+
+func (s *RedisLocationStore) Trail(ctx context.Context, orderID string) ([]TrailPoint, error) {
+	pointsJSON, err := s.client.LRange(ctx, trailKey(orderID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	points := make([]TrailPoint, 0, len(pointsJSON))
+	for _, pointJSON := range pointsJSON {
+		var point TrailPoint
+		if err := json.Unmarshal([]byte(pointJSON), &point); err != nil {
+			continue
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+// Delete a trail (KEYS[1]) only if the time it last grew (KEYS[2]) is still
+// older than ARGV[1]
+var deleteIdleTrail = redis.NewScript(`
+local active = redis.call("GET", KEYS[2])
+if active and tonumber(active) >= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call("DEL", KEYS[1], KEYS[2])
+return 1
+`)
+
+// Remove an order from the index (KEYS[1]) only if its score is still older
+// than ARGV[2]
+var unindexIdleTrail = redis.NewScript(`
+local active = redis.call("ZSCORE", KEYS[1], ARGV[1])
+if active and tonumber(active) >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call("ZREM", KEYS[1], ARGV[1])
+return 1
+`)
+
+func (s *RedisLocationStore) DeleteTrail(ctx context.Context, orderID string, before time.Time) (bool, error) {
+	deleted, err := deleteIdleTrail.Run(ctx, s.client, []string{trailKey(orderID), trailAtKey(orderID)}, before.UnixMilli()).Int()
+	if err != nil || deleted == 0 {
+		return false, err
+	}
+	// A point appended since leaves a newer score, keeping the order indexed
+	return true, unindexIdleTrail.Run(ctx, s.client, []string{trailsIndexKey}, orderID, before.UnixMilli()).Err()
+}
+
+// MemoryLocationStore is a LocationStore held in process memory. Locations
+// and trails don't expire.
+type MemoryLocationStore struct {
+	mu          sync.Mutex
+	locations   map[string]Location
+	trails      map[string][]TrailPoint
+	trailActive map[string]time.Time
+}
+
+// NewMemoryLocationStore returns an empty MemoryLocationStore
+func NewMemoryLocationStore() *MemoryLocationStore {
+	return &MemoryLocationStore{
+		locations:   make(map[string]Location),
+		trails:      make(map[string][]TrailPoint),
+		trailActive: make(map[string]time.Time),
+	}
+}
+
+func (s *MemoryLocationStore) Get(ctx context.Context, kind, id string) (Location, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	location, ok := s.locations[getLocationKey(kind, id)]
+	if !ok {
+		return Location{}, ErrNotFound
+	}
+	return location, nil
+}
+
+func (s *MemoryLocationStore) Save(ctx context.Context, kind, id string, location Location) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.locations[getLocationKey(kind, id)] = location
+	return nil
+}
+
+func (s *MemoryLocationStore) AppendTrail(ctx context.Context, orderID string, point TrailPoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trails[orderID] = append(s.trails[orderID], point)
+	s.trailActive[orderID] = time.Now()
+	return nil
+}
+
+func (s *MemoryLocationStore) IdleTrails(ctx context.Context, before time.Time, limit int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for id, active := range s.trailActive {
+		if len(ids) == limit {
+			break
+		}
+		if active.Before(before) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (s *MemoryLocationStore) Trail(ctx context.Context, orderID string) ([]TrailPoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]TrailPoint{}, s.trails[orderID]...), nil
+}
+
+func (s *MemoryLocationStore) DeleteTrail(ctx context.Context, orderID string, before time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	active, ok := s.trailActive[orderID]
+	if !ok || !active.Before(before) {
+		return false, nil
+	}
+	delete(s.trails, orderID)
+	delete(s.trailActive, orderID)
+	return true, nil
+}
+
+// Orders by when their trail last grew
+const trailsIndexKey = "order_trails"
+
+// Helper function to get location key for Redis. Everything about an ID
+// shares its hash tag, so an order's location and trail are in one slot.
+func getLocationKey(userType, userID string) string {
+	return userType + ":" + rediskeys.Tag(userID) + ":location"
+}
+
+// An order's trail
+func trailKey(orderID string) string {
+	return "order:" + rediskeys.Tag(orderID) + ":trail"
+}
+
+// When an order's trail last grew, in Unix milliseconds
+func trailAtKey(orderID string) string {
+	return "order:" + rediskeys.Tag(orderID) + ":trail_at"
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/foodo/shared/config"
+	"github.com/foodo/shared/tracking"
+)
+
+// TrackingWriter persists driver positions to OrderTracking and finished
+// trails to OrderTrail
+type TrackingWriter struct {
+	*tracking.Writer
+
+	// Location writes are throttled per order since drivers report every
+	// few seconds but the database only needs a recent position. Orders
+	// that go quiet are swept out on a ticker.
+	locationInterval time.Duration
+	lastLocationMu   sync.Mutex
+	lastLocation     map[string]time.Time
+	stopSweep        chan struct{}
+	sweepDone        chan struct{}
+}
+
+// Append a finished order's points to its OrderTrail row, creating it on the
+// first archive. Points no later than the row's endedAt are already stored,
+// so archiving the same trail twice changes nothing.
+const archiveTrailSQL = `
+INSERT INTO "OrderTrail" ("id", "orderId", "driverId", "points", "startedAt", "endedAt", "createdAt")
+VALUES (gen_random_uuid()::text, $1, $2, $3::jsonb, $4, $5, NOW())
+ON CONFLICT ("orderId") DO UPDATE SET
+	"driverId" = COALESCE(EXCLUDED."driverId", "OrderTrail"."driverId"),
+	"points"   = "OrderTrail"."points" || (
+		SELECT COALESCE(jsonb_agg(p), '[]'::jsonb)
+		FROM jsonb_array_elements(EXCLUDED."points") AS p
+		WHERE (p->>'timestamp')::bigint > EXTRACT(EPOCH FROM "OrderTrail"."endedAt")
+	),
+	"endedAt"  = GREATEST(EXCLUDED."endedAt", "OrderTrail"."endedAt")`
+
+// NewTrackingWriter connects to Postgres and starts the background workers
+func NewTrackingWriter(ctx context.Context, cfg *config.Config) (*TrackingWriter, error) {
+	writer, err := tracking.New(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	t := &TrackingWriter{
+		Writer:           writer,
+		locationInterval: cfg.Duration("TRACKING_LOCATION_INTERVAL", 15*time.Second),
+		lastLocation:     make(map[string]time.Time),
+		stopSweep:        make(chan struct{}),
+		sweepDone:        make(chan struct{}),
+	}
+	go t.sweep()
+	return t, nil
+}
+
+// RecordLocation persists a driver's position for an order, at most once per
+// locationInterval for each order
+func (t *TrackingWriter) RecordLocation(orderID, driverID string, location Location) {
+	if t == nil || orderID == "" {
+		return
+	}
+
+	now := time.Now()
+	t.lastLocationMu.Lock()
+	if last, ok := t.lastLocation[orderID]; ok && now.Sub(last) < t.locationInterval {
+		t.lastLocationMu.Unlock()
+		return
+	}
+	t.lastLocation[orderID] = now
+	t.lastLocationMu.Unlock()
+
+	locationJSON, _ := json.Marshal(location)
+	t.Enqueue(tracking.Update{
+		OrderID:        orderID,
+		DriverID:       &driverID,
+		DriverLocation: locationJSON,
+	})
+}
+
+// Forget stops throttling a finished order's location writes
+func (t *TrackingWriter) Forget(orderID string) {
+	if t == nil {
+		return
+	}
+	t.lastLocationMu.Lock()
+	delete(t.lastLocation, orderID)
+	t.lastLocationMu.Unlock()
+}
+
+// Drop orders that have gone quiet so the throttle map doesn't grow forever
+func (t *TrackingWriter) sweep() {
+	defer close(t.sweepDone)
+	ticker := time.NewTicker(10 * t.locationInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			t.lastLocationMu.Lock()
+			for id, last := range t.lastLocation {
+				if now.Sub(last) > 10*t.locationInterval {
+					delete(t.lastLocation, id)
+				}
+			}
+			t.lastLocationMu.Unlock()
+		case <-t.stopSweep:
+			return
+		}
+	}
+}
+
+// ArchiveTrail writes an order's trail to the OrderTrail table, waiting for
+// the result. Unlike tracking updates it isn't queued: the caller deletes
+// the trail from Redis only once it's stored.
+func (t *TrackingWriter) ArchiveTrail(ctx context.Context, orderID string, points []TrailPoint) error {
+	if len(points) == 0 {
+		return nil
+	}
+	var driverID *string
+	if id := points[len(points)-1].DriverID; id != "" {
+		driverID = &id
+	}
+	pointsJSON, _ := json.Marshal(points)
+	startedAt := time.Unix(points[0].Timestamp, 0)
+	endedAt := time.Unix(points[len(points)-1].Timestamp, 0)
+
+	_, err := t.Pool().Exec(ctx, archiveTrailSQL, orderID, driverID, string(pointsJSON), startedAt, endedAt)
+	return err
+}
+
+// Close stops the sweeper, flushes pending writes and closes the pool
+func (t *TrackingWriter) Close() {
+	if t == nil {
+		return
+	}
+	close(t.stopSweep)
+	<-t.sweepDone
+	t.Writer.Close()
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foodo/shared/auth"
+	"github.com/foodo/shared/logging"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// AdminAction is one entry in the admin audit log
+type AdminAction struct {
+	ID      string                 `json:"id"`
+	Actor   string                 `json:"actor"`
+	Action  string                 `json:"action"`
+	Target  string                 `json:"target"`
+	Reason  string                 `json:"reason"`
+	Details map[string]interface{} `json:"details,omitempty"`
+	At      time.Time              `json:"at"`
+}
+
+// ActiveAssignment is an assignment as listed for operators
+type ActiveAssignment struct {
+	OrderAssignment
+	DriverName   string  `json:"driverName,omitempty"`
+	DriverStatus string  `json:"driverStatus,omitempty"`
+	Connected    bool    `json:"connected"`
+	AgeSeconds   float64 `json:"ageSeconds"`
+}
+
+var driverStatuses = map[string]bool{
+	"available": true,
+	"busy":      true,
+	"offline":   true,
+}
+
+// Register the admin API under /api/dispatch/admin. Every route requires a
+// bearer token from AdminTokens; the operator's name is recorded as the
+// actor in the audit log.
+func (s *Server) registerAdminRoutes(r *mux.Router, guard *auth.Guard) {
+	if len(s.AdminTokens) == 0 {
+		slog.Warn("ADMIN_TOKENS is empty; the admin API will reject every request")
+	}
+
+	admin := r.PathPrefix("/api/dispatch/admin").Subrouter()
+	admin.HandleFunc("/assignments", s.getActiveAssignmentsHandler).Methods("GET")
+	admin.HandleFunc("/assignments/{id}/cancel", s.cancelAssignmentHandler).Methods("POST")
+	admin.HandleFunc("/orders/held", s.getHeldOrdersHandler).Methods("GET")
+	admin.HandleFunc("/orders/{id}/assign", s.forceAssignHandler).Methods("POST")
+	admin.HandleFunc("/orders/{id}/hold", s.holdOrderHandler).Methods("POST")
+	admin.HandleFunc("/orders/{id}/release", s.releaseOrderHandler).Methods("POST")
+	admin.HandleFunc("/drivers/{id}/status", s.setDriverStatusHandler).Methods("PUT")
+	admin.HandleFunc("/drivers/{id}/disconnect", s.disconnectDriverHandler).Methods("POST")
+	admin.HandleFunc("/audit", s.getAdminAuditHandler).Methods("GET")
+	admin.HandleFunc("/janitor", s.getJanitorReportHandler).Methods("GET")
+	guard.RequireAll(admin, auth.Admin(s.AdminTokens))
+}
+
+// Append an action to the audit log
+func (s *Server) recordAdminAction(ctx context.Context, action, target, reason string, details map[string]interface{}) {
+	actor := auth.AdminActor(ctx)
+	entry := AdminAction{
+		Actor:   actor,
+		Action:  action,
+		Target:  target,
+		Reason:  reason,
+		Details: details,
+		At:      time.Now().UTC(),
+	}
+	if err := s.Audit.Record(ctx, entry); err != nil {
+		slog.ErrorContext(ctx, "Failed to record admin action", "action", action, "error", err)
+	}
+	slog.InfoContext(ctx, "Admin action", "actor", actor, "action", action, "target", target, "reason", reason)
+}
+
+// Decode a JSON admin request body, insisting on a reason
+func decodeAdminRequest(w http.ResponseWriter, r *http.Request, v interface{ reason() string }) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return false
+	}
+	if strings.TrimSpace(v.reason()) == "" {
+		http.Error(w, "reason is required", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+type adminRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (a *adminRequest) reason() string { return a.Reason }
+
+// List active assignments with their drivers and age
+func (s *Server) getActiveAssignmentsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+
+	assignmentList, err := s.Assignments.List(ctx)
+	if err != nil {
+		http.Error(w, "Failed to get assignments", http.StatusInternalServerError)
+		return
+	}
+	drivers, err := s.Drivers.List(ctx)
+	if err != nil {
+		http.Error(w, "Failed to get drivers", http.StatusInternalServerError)
+		return
+	}
+	driversByID := make(map[string]Driver, len(drivers))
+	for _, driver := range drivers {
+		driversByID[driver.ID] = driver
+	}
+
+	assignments := make([]ActiveAssignment, 0, len(assignmentList))
+	for _, assignment := range assignmentList {
+		active := ActiveAssignment{OrderAssignment: assignment}
+		if driver, ok := driversByID[active.DriverID]; ok {
+			active.DriverName = driver.Name
+			active.DriverStatus = driver.Status
+		}
+		_, active.Connected = s.Hub.Get(active.DriverID)
+		active.AgeSeconds = time.Since(active.AssignedAt).Seconds()
+		assignments = append(assignments, active)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(assignments)
+}
+
+// Assign an order to a driver regardless of its current state. A pending or
+// held order is taken off its list; an assigned order is moved from its
+// current driver.
+func (s *Server) forceAssignHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+	orderID := mux.Vars(r)["id"]
+	ctx = logging.WithOrderID(ctx, orderID)
+
+	var requestBody struct {
+		adminRequest
+		DriverID string `json:"driverId"`
+	}
+	if !decodeAdminRequest(w, r, &requestBody) {
+		return
+	}
+	if requestBody.DriverID == "" {
+		http.Error(w, "driverId is required", http.StatusBadRequest)
+		return
+	}
+	ctx = logging.WithDriverID(ctx, requestBody.DriverID)
+
+	details := map[string]interface{}{"driverId": requestBody.DriverID}
+	order, err := s.takeOrderForAssignment(ctx, orderID, requestBody.Reason, details)
+	if err != nil {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+
+	assignment := s.assignOrder(ctx, order, requestBody.DriverID)
+	s.recordAdminAction(ctx, "force_assign", orderID, requestBody.Reason, details)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(assignment)
+}
+
+// Find an order wherever it is and take it out of that state, noting where
+// it came from in details
+func (s *Server) takeOrderForAssignment(ctx context.Context, orderID, reason string, details map[string]interface{}) (Order, error) {
+	// Pending
+	if order, err := s.Orders.Take(ctx, orderID); err == nil {
+		details["from"] = "pending"
+		return order, nil
+	}
+
+	// On hold
+	if order, err := s.Orders.TakeHeld(ctx, orderID); err == nil {
+		details["from"] = "held"
+		return order, nil
+	}
+
+	// Assigned to another driver
+	previous, order, err := s.unassignOrder(ctx, orderID, reason)
+	if err != nil {
+		return Order{}, err
+	}
+	details["from"] = "assigned"
+	details["previousDriverId"] = previous.DriverID
+	return order, nil
+}
+
+// Cancel an assignment, freeing the driver and optionally requeueing the order
+func (s *Server) cancelAssignmentHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+	orderID := mux.Vars(r)["id"]
+	ctx = logging.WithOrderID(ctx, orderID)
+
+	var requestBody struct {
+		adminRequest
+		Requeue bool `json:"requeue"`
+	}
+	if !decodeAdminRequest(w, r, &requestBody) {
+		return
+	}
+
+	assignment, order, err := s.unassignOrder(ctx, orderID, requestBody.Reason)
+	if err != nil {
+		http.Error(w, "Assignment not found", http.StatusNotFound)
+		return
+	}
+
+	// Put the order back at the front of the queue
+	requeued := false
+	if requestBody.Requeue {
+		requeued = s.Orders.Requeue(ctx, order) == nil
+	}
+
+	s.recordAdminAction(ctx, "cancel_assignment", orderID, requestBody.Reason, map[string]interface{}{
+		"driverId": assignment.DriverID,
+		"requeued": requeued,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"orderId":  orderID,
+		"driverId": assignment.DriverID,
+		"requeued": requeued,
+	})
+}
+
+// Remove an order's assignment and free its driver. Returns the assignment
+// and the order it was made for.
+func (s *Server) unassignOrder(ctx context.Context, orderID, reason string) (OrderAssignment, Order, error) {
+	assignment, order, err := s.Assignments.Remove(ctx, orderID)
+	if err != nil {
+		return assignment, order, err
+	}
+	s.setDriverStatus(ctx, assignment.DriverID, "available")
+
+	// Let the driver and other services know
+	event, _ := json.Marshal(map[string]interface{}{
+		"orderId":  orderID,
+		"driverId": assignment.DriverID,
+		"reason":   reason,
+	})
+	s.Events.Publish(ctx, "order_unassigned", event)
+	if client, ok := s.Hub.Get(assignment.DriverID); ok {
+		client.SendJSON(map[string]interface{}{
+			"type":    "assignment_cancelled",
+			"orderId": orderID,
+		})
+	}
+
+	return assignment, order, nil
+}
+
+// Move a pending order on hold so it isn't offered or assigned
+func (s *Server) holdOrderHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+	orderID := mux.Vars(r)["id"]
+	ctx = logging.WithOrderID(ctx, orderID)
+
+	var requestBody adminRequest
+	if !decodeAdminRequest(w, r, &requestBody) {
+		return
+	}
+
+	if err := s.Orders.Hold(ctx, orderID); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "Pending order not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to hold order", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	s.recordAdminAction(ctx, "hold_order", orderID, requestBody.Reason, nil)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status": "held"}`))
+}
+
+// Return a held order to the front of the pending queue
+func (s *Server) releaseOrderHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+	orderID := mux.Vars(r)["id"]
+	ctx = logging.WithOrderID(ctx, orderID)
+
+	var requestBody adminRequest
+	if !decodeAdminRequest(w, r, &requestBody) {
+		return
+	}
+
+	if _, err := s.Orders.Release(ctx, orderID); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "Held order not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to release order", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	s.recordAdminAction(ctx, "release_order", orderID, requestBody.Reason, nil)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status": "pending"}`))
+}
+
+// List orders on hold
+func (s *Server) getHeldOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+
+	orders, err := s.Orders.Held(ctx)
+	if err != nil {
+		http.Error(w, "Failed to get held orders", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orders)
+}
+
+// Change a driver's status
+func (s *Server) setDriverStatusHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+	driverID := mux.Vars(r)["id"]
+	ctx = logging.WithDriverID(ctx, driverID)
+
+	var requestBody struct {
+		adminRequest
+		Status string `json:"status"`
+	}
+	if !decodeAdminRequest(w, r, &requestBody) {
+		return
+	}
+	if !driverStatuses[requestBody.Status] {
+		http.Error(w, "status must be available, busy or offline", http.StatusBadRequest)
+		return
+	}
+
+	previous, _ := s.Drivers.Get(ctx, driverID)
+	driver, err := s.setDriverStatus(ctx, driverID, requestBody.Status)
+	if err != nil {
+		http.Error(w, "Failed to update driver", http.StatusInternalServerError)
+		return
+	}
+
+	s.recordAdminAction(ctx, "set_driver_status", driverID, requestBody.Reason, map[string]interface{}{
+		"from": previous.Status,
+		"to":   requestBody.Status,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(driver)
+}
+
+// Close a driver's WebSocket
+func (s *Server) disconnectDriverHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+	driverID := mux.Vars(r)["id"]
+	ctx = logging.WithDriverID(ctx, driverID)
+
+	var requestBody adminRequest
+	if !decodeAdminRequest(w, r, &requestBody) {
+		return
+	}
+
+	if !s.Hub.Disconnect(driverID, websocket.ClosePolicyViolation, "disconnected by operator") {
+		http.Error(w, "Driver not connected", http.StatusNotFound)
+		return
+	}
+
+	s.recordAdminAction(ctx, "disconnect_driver", driverID, requestBody.Reason, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Get a page of the admin audit log, newest first. ?before= takes the ID of
+// the last action on the previous page.
+func (s *Server) getAdminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, _ = strconv.Atoi(value)
+	}
+	actions, err := s.Audit.List(ctx, r.URL.Query().Get("before"), limit)
+	if err != nil {
+		http.Error(w, "Failed to get audit log", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(actions)
+}
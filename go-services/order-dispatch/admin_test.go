@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Mutating routes turn away callers without a token before looking at the
+// body, and drivers can only act for themselves
+func TestRoutesAuthenticateBeforeValidating(t *testing.T) {
+	ts := startTestService(t)
+	ts.addDriver(t, Driver{ID: "driver-1", Status: "available"})
+	invalid := map[string]interface{}{"unexpected": true}
+
+	for _, route := range []struct{ method, path string }{
+		{"POST", "/api/dispatch/orders/order-1/assign"},
+		{"POST", "/api/dispatch/drivers/driver-1/location"},
+		{"PUT", "/api/dispatch/drivers/driver-1/vehicle"},
+		{"POST", "/api/dispatch/admin/orders/order-1/hold"},
+		{"POST", "/api/dispatch/webhooks"},
+		{"PUT", "/debug/log-level"},
+	} {
+		if resp := ts.request(t, "", route.method, route.path, invalid); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s %s without a token = %d, want 401", route.method, route.path, resp.StatusCode)
+		}
+		if resp := ts.request(t, "not-a-token", route.method, route.path, invalid); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s %s with a bad token = %d, want 401", route.method, route.path, resp.StatusCode)
+		}
+	}
+
+	// Drivers can't use the operator routes
+	if resp := ts.driverRequest(t, "driver-1", "PUT", "/api/dispatch/drivers/driver-1/vehicle", map[string]string{"type": "car"}); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("vehicle with a driver token = %d, want 401", resp.StatusCode)
+	}
+
+	// or act for other drivers
+	location := map[string]float64{"latitude": 40.7, "longitude": -74}
+	if resp := ts.driverRequest(t, "driver-2", "POST", "/api/dispatch/drivers/driver-1/location", location); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("another driver's location = %d, want 403", resp.StatusCode)
+	}
+	if resp := ts.driverRequest(t, "driver-2", "POST", "/api/dispatch/orders/order-1/assign", map[string]string{"driverId": "driver-1"}); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("assign to another driver = %d, want 403", resp.StatusCode)
+	}
+	if resp := ts.driverRequest(t, "driver-1", "POST", "/api/dispatch/drivers/driver-1/location", location); resp.StatusCode != http.StatusOK {
+		t.Errorf("own location = %d, want 200", resp.StatusCode)
+	}
+	if resp := ts.adminRequest(t, "POST", "/api/dispatch/drivers/driver-1/location", location); resp.StatusCode != http.StatusOK {
+		t.Errorf("location with an admin token = %d, want 200", resp.StatusCode)
+	}
+
+	// Expired and logged out tokens are refused
+	expired := userToken("driver-1", time.Now().Add(-time.Minute))
+	if resp := ts.request(t, expired, "POST", "/api/dispatch/drivers/driver-1/location", location); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expired token = %d, want 401", resp.StatusCode)
+	}
+	token := userToken("driver-1", time.Now().Add(time.Hour))
+	redisClient.Set(context.Background(), "blacklist:"+token, "1", time.Hour)
+	if resp := ts.request(t, token, "POST", "/api/dispatch/drivers/driver-1/location", location); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("revoked token = %d, want 401", resp.StatusCode)
+	}
+}
+
+// Drivers connect to their own socket with their user token, in the header
+// or, for browsers, the access_token parameter
+func TestDriverWebSocketNeedsToken(t *testing.T) {
+	ts := startTestService(t)
+	url := "ws" + strings.TrimPrefix(ts.http.URL, "http") + "/ws/drivers/driver-1"
+	dial := func(url string, header http.Header) int {
+		conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+		if err == nil {
+			conn.Close()
+			return http.StatusSwitchingProtocols
+		}
+		if resp == nil {
+			t.Fatalf("dial %s: %v", url, err)
+		}
+		return resp.StatusCode
+	}
+	bearer := func(token string) http.Header {
+		return http.Header{"Authorization": {"Bearer " + token}}
+	}
+
+	if status := dial(url, nil); status != http.StatusUnauthorized {
+		t.Errorf("without a token = %d, want 401", status)
+	}
+	if status := dial(url, bearer(userToken("driver-2", time.Now().Add(time.Hour)))); status != http.StatusForbidden {
+		t.Errorf("another driver's token = %d, want 403", status)
+	}
+	if status := dial(url+"?access_token="+userToken("driver-1", time.Now().Add(time.Hour)), nil); status != http.StatusSwitchingProtocols {
+		t.Errorf("own token as access_token = %d, want 101", status)
+	}
+	if status := dial(url, bearer("test-token")); status != http.StatusSwitchingProtocols {
+		t.Errorf("admin token = %d, want 101", status)
+	}
+}
+
+func TestAdminAuditLogPages(t *testing.T) {
+	ts := startTestService(t)
+	for i := 0; i < 5; i++ {
+		ts.server.recordAdminAction(context.Background(), "hold_order", fmt.Sprintf("order-%d", i), "testing", nil)
+	}
+
+	page := func(query string) []AdminAction {
+		var actions []AdminAction
+		json.NewDecoder(ts.adminRequest(t, "GET", "/api/dispatch/admin/audit"+query, nil).Body).Decode(&actions)
+		return actions
+	}
+	first := page("?limit=3")
+	if len(first) != 3 || first[0].Target != "order-4" || first[2].Target != "order-2" {
+		t.Fatalf("first page = %+v", first)
+	}
+	second := page("?limit=3&before=" + first[2].ID)
+	if len(second) != 2 || second[0].Target != "order-1" || second[1].Target != "order-0" {
+		t.Fatalf("second page = %+v", second)
+	}
+	if resp := ts.adminRequest(t, "GET", "/api/dispatch/admin/audit?before=nonsense", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bad cursor status = %d, want 400", resp.StatusCode)
+	}
+}
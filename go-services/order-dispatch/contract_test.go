@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/foodo/shared/contract"
+)
+
+// Payloads published on each channel, shared with the other services
+const contractsDir = "../contracts"
+
+func TestNewOrderContract(t *testing.T) {
+	contract.Verify(t, contractsDir, contract.Contract{
+		Channel:  "new_order",
+		Type:     Order{},
+		Required: []string{"id", "orderNumber", "restaurantId", "userId", "status"},
+	})
+}
+
+func TestOrderStatusUpdateContract(t *testing.T) {
+	contract.Verify(t, contractsDir, contract.Contract{
+		Channel:  "order_status_update",
+		Type:     OrderStatusUpdate{},
+		Required: []string{"orderId", "status"},
+	})
+}
+
+func TestSubscribedChannelsArePublished(t *testing.T) {
+	published, err := contract.Channels(contractsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	has := make(map[string]bool)
+	for _, channel := range published {
+		has[channel] = true
+	}
+	for _, channel := range orderChannels {
+		if !has[channel] {
+			t.Errorf("%s: subscribed to but has no payloads in %s", channel, contractsDir)
+		}
+	}
+}
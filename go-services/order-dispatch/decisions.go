@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/foodo/shared/auth"
+	"github.com/gorilla/mux"
+)
+
+// Reasons a driver was left out of a dispatch decision
+const (
+	filterNotAvailable   = "not_available"
+	filterNotConnected   = "not_connected"
+	filterNoInsulatedBag = "no_insulated_bag"
+	filterTooFar         = "too_far"
+	filterOverCapacity   = "over_capacity"
+)
+
+// DispatchDecision records which drivers were considered for an order and
+// why. An "offer" decision is made when the order arrives and lists the
+// drivers it was offered to in rank order; an "assignment" decision is made
+// when a driver gets the order and names the winner.
+type DispatchDecision struct {
+	ID         string              `json:"id"`
+	OrderID    string              `json:"orderId"`
+	Kind       string              `json:"kind"`               // offer, assignment
+	Trigger    string              `json:"trigger"`            // new_order, api, admin
+	Actor      string              `json:"actor,omitempty"`    // operator for admin decisions
+	Pickup     *GeoPoint           `json:"pickup,omitempty"`   // restaurant location, when known
+	Zone       string              `json:"zone,omitempty"`     // order's delivery zone
+	Borrowed   bool                `json:"borrowed,omitempty"` // offered to neighbouring zones' drivers
+	Winner     string              `json:"winner,omitempty"`   // assigned driver
+	Offered    []string            `json:"offered,omitempty"`  // drivers offered the order, best first
+	Candidates []DecisionCandidate `json:"candidates"`
+	At         time.Time           `json:"at"`
+}
+
+// DecisionCandidate is one driver's standing in a decision
+type DecisionCandidate struct {
+	DriverID   string   `json:"driverId"`
+	Status     string   `json:"status,omitempty"`
+	Zone       string   `json:"zone,omitempty"`
+	Vehicle    string   `json:"vehicle,omitempty"`
+	Connected  bool     `json:"connected"`
+	DistanceKm *float64 `json:"distanceKm,omitempty"`
+	Score      float64  `json:"score"`
+	Eligible   bool     `json:"eligible"`
+	Filter     string   `json:"filter,omitempty"`
+	Rank       int      `json:"rank,omitempty"`
+}
+
+// GeoPoint is a latitude/longitude pair
+type GeoPoint struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// Evaluate every known driver for order. Drivers that are available,
+// connected and have a vehicle that can manage the order are eligible and
+// ranked by score, which favours the closest to the pickup; the rest carry
+// the filter that ruled them out.
+func (s *Server) evaluateCandidates(order Order, drivers []Driver) DispatchDecision {
+	decision := DispatchDecision{
+		ID:         newID(),
+		OrderID:    order.ID,
+		Pickup:     order.pickup(),
+		Zone:       order.ZoneID,
+		Candidates: make([]DecisionCandidate, 0, len(drivers)),
+		At:         time.Now().UTC(),
+	}
+
+	for _, driver := range drivers {
+		candidate := DecisionCandidate{DriverID: driver.ID, Status: driver.Status, Zone: driver.ZoneID}
+		_, candidate.Connected = s.Hub.Get(driver.ID)
+		if driver.Vehicle != nil {
+			candidate.Vehicle = driver.Vehicle.Type
+		}
+
+		candidate.DistanceKm = pickupDistanceKm(decision.Pickup, driver)
+		if candidate.DistanceKm != nil {
+			candidate.Score = math.Round(10000/(1+*candidate.DistanceKm)) / 10000
+		}
+
+		switch {
+		case driver.Status != "available":
+			candidate.Filter = filterNotAvailable
+		case !candidate.Connected:
+			candidate.Filter = filterNotConnected
+		default:
+			candidate.Filter = vehicleFilter(driver.Vehicle, order.Requirements, candidate.DistanceKm)
+			candidate.Eligible = candidate.Filter == ""
+		}
+		decision.Candidates = append(decision.Candidates, candidate)
+	}
+
+	// Eligible drivers first, best score first, then by ID for a stable order
+	sort.Slice(decision.Candidates, func(i, j int) bool {
+		a, b := decision.Candidates[i], decision.Candidates[j]
+		if a.Eligible != b.Eligible {
+			return a.Eligible
+		}
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		return a.DriverID < b.DriverID
+	})
+	for i := range decision.Candidates {
+		if !decision.Candidates[i].Eligible {
+			break
+		}
+		decision.Candidates[i].Rank = i + 1
+	}
+
+	return decision
+}
+
+// The driver's distance to the pickup in kilometres, if both are known
+func pickupDistanceKm(pickup *GeoPoint, driver Driver) *float64 {
+	// Drivers that never reported a location sit at 0,0
+	if pickup == nil || (driver.Latitude == 0 && driver.Longitude == 0) {
+		return nil
+	}
+	distance := distanceKm(*pickup, GeoPoint{Latitude: driver.Latitude, Longitude: driver.Longitude})
+	distance = math.Round(distance*1000) / 1000
+	return &distance
+}
+
+// Whether driverID is among the candidates
+func (d DispatchDecision) considered(driverID string) bool {
+	for _, candidate := range d.Candidates {
+		if candidate.DriverID == driverID {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether any candidate could be offered the order
+func (d DispatchDecision) hasEligible() bool {
+	return len(d.Candidates) > 0 && d.Candidates[0].Eligible
+}
+
+// Record the decision behind an assignment to driverID. The candidates are
+// the drivers the order would have been offered to, evaluated as they stood
+// just before the assignment. A winner from outside them, such as one an
+// operator picked from another zone, is added at the end.
+func (s *Server) recordAssignmentDecision(ctx context.Context, order Order, driverID string) {
+	decision, err := s.zoneCandidates(ctx, order)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get drivers for decision log", "error", err)
+		return
+	}
+	if !decision.considered(driverID) {
+		if winner, err := s.Drivers.Get(ctx, driverID); err == nil {
+			candidate := s.evaluateCandidates(order, []Driver{winner}).Candidates[0]
+			candidate.Rank = 0
+			decision.Candidates = append(decision.Candidates, candidate)
+		}
+	}
+
+	decision.Kind = "assignment"
+	decision.Trigger = "api"
+	if actor := auth.AdminActor(ctx); actor != "" {
+		decision.Trigger = "admin"
+		decision.Actor = actor
+	}
+	decision.Winner = driverID
+	s.recordDispatchDecision(ctx, decision)
+}
+
+// Append a decision to the order's log
+func (s *Server) recordDispatchDecision(ctx context.Context, decision DispatchDecision) {
+	if err := s.Decisions.Record(ctx, decision); err != nil {
+		slog.ErrorContext(ctx, "Failed to record dispatch decision", "kind", decision.Kind, "error", err)
+		return
+	}
+	slog.DebugContext(ctx, "Dispatch decision recorded",
+		"kind", decision.Kind,
+		"candidates", len(decision.Candidates),
+		"winner", decision.Winner,
+	)
+}
+
+// Get the dispatch decisions for an order, oldest first
+func (s *Server) getOrderDecisionsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+	orderID := mux.Vars(r)["id"]
+
+	decisions, err := s.Decisions.List(ctx, orderID)
+	if err != nil {
+		http.Error(w, "Failed to get decisions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(decisions)
+}
+
+// Great-circle distance between two points in kilometres
+func distanceKm(a, b GeoPoint) float64 {
+	const earthRadiusKm = 6371.0
+	lat1 := a.Latitude * math.Pi / 180
+	lat2 := b.Latitude * math.Pi / 180
+	dLat := lat2 - lat1
+	dLon := (b.Longitude - a.Longitude) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/foodo/shared/auth"
+	"github.com/foodo/shared/config"
+	"github.com/foodo/shared/eventbus"
+	"github.com/foodo/shared/wshub"
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// testService is order-dispatch running against miniredis, with its router
+// behind an httptest server and the order event subscriber running
+type testService struct {
+	server *Server
+	http   *httptest.Server
+}
+
+func startTestService(t *testing.T) *testService {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	t.Setenv("REDIS_ADDR", mr.Addr())
+	t.Setenv("REDIS_ALLOW_NO_AUTH", "true")
+	t.Setenv("ADMIN_TOKENS", "ops=test-token")
+	t.Setenv("JWT_SECRET", testJWTSecret)
+	// Webhook receivers are httptest servers on loopback
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE_TARGETS", "true")
+	t.Setenv("WEBHOOK_BACKOFF_MS", "1")
+
+	var err error
+	cfg, err = config.Load("order-dispatch", "0", nil)
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	redisClient, err = config.NewRedisClient(cfg.Redis)
+	if err != nil {
+		t.Fatalf("create Redis client: %v", err)
+	}
+
+	// Wired as in main, without Postgres or rate limits
+	s := &Server{
+		Config:      cfg,
+		Redis:       redisClient,
+		Drivers:     NewRedisDriverStore(redisClient),
+		Orders:      NewRedisOrderQueue(redisClient),
+		Assignments: NewRedisAssignmentStore(redisClient),
+		Decisions:   NewRedisDecisionLog(redisClient, time.Hour),
+		Audit:       NewRedisAuditLog(redisClient),
+		Events:      eventbus.NewRedis(redisClient),
+		Hub:         wshub.New(cfg),
+		Webhooks:    NewWebhookDispatcher(cfg, NewRedisWebhookStore(redisClient)),
+		Locations:   NewRedisLocations(redisClient),
+		AdminTokens: auth.ParseAdminTokens(cfg.List("ADMIN_TOKENS")),
+		Users:       auth.NewUsers(cfg.String("JWT_SECRET", ""), auth.RevokedInRedis(redisClient)),
+	}
+	s.setupHealthChecks()
+	r, err := s.newRouter()
+	if err != nil {
+		t.Fatalf("build router: %v", err)
+	}
+	srv := httptest.NewServer(r)
+
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.subscribeToOrderEvents(ctx)
+	}()
+	t.Cleanup(func() {
+		stop()
+		<-done
+		srv.Close()
+		s.Webhooks.Wait(context.Background())
+		s.Hub.Close(context.Background(), websocket.CloseGoingAway, "test over")
+		redisClient.Close()
+	})
+
+	waitFor(t, "order event subscriber", s.OrderEvents.Running)
+	return &testService{server: s, http: srv}
+}
+
+// Save a driver record directly, as the NestJS API would
+func (ts *testService) addDriver(t *testing.T, driver Driver) {
+	t.Helper()
+	if err := ts.server.Drivers.Save(context.Background(), driver); err != nil {
+		t.Fatalf("save driver: %v", err)
+	}
+}
+
+// Publish an event the way the other services do
+func (ts *testService) publish(t *testing.T, channel string, event interface{}) {
+	t.Helper()
+	payload, _ := json.Marshal(event)
+	if err := redisClient.Publish(context.Background(), channel, payload).Err(); err != nil {
+		t.Fatalf("publish %s: %v", channel, err)
+	}
+}
+
+// Connect a driver's WebSocket and wait until the hub has registered it
+func (ts *testService) connectDriver(t *testing.T, driverID string) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(ts.http.URL, "http") + "/ws/drivers/" + driverID
+	header := http.Header{"Authorization": {"Bearer " + userToken(driverID, time.Now().Add(time.Hour))}}
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("dial %s: %v", url, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	waitFor(t, "driver "+driverID+" to register", func() bool {
+		_, ok := ts.server.Hub.Get(driverID)
+		return ok
+	})
+	return conn
+}
+
+// The secret the test API signs user tokens with
+const testJWTSecret = "test-jwt-secret"
+
+// Sign a user token the way the API does at login
+func userToken(userID string, expiresAt time.Time) string {
+	encode := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	unsigned := encode(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." +
+		encode(map[string]interface{}{"sub": userID, "exp": expiresAt.Unix()})
+	mac := hmac.New(sha256.New, []byte(testJWTSecret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Call the API with the admin token, JSON-encoding body if it isn't nil
+func (ts *testService) adminRequest(t *testing.T, method, path string, body interface{}) *http.Response {
+	t.Helper()
+	return ts.request(t, "test-token", method, path, body)
+}
+
+// Call the API as a driver, with a user token for them
+func (ts *testService) driverRequest(t *testing.T, driverID, method, path string, body interface{}) *http.Response {
+	t.Helper()
+	return ts.request(t, userToken(driverID, time.Now().Add(time.Hour)), method, path, body)
+}
+
+// Call the API with a bearer token, if given
+func (ts *testService) request(t *testing.T, token, method, path string, body interface{}) *http.Response {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		payload, _ := json.Marshal(body)
+		reader = bytes.NewReader(payload)
+	}
+	req, _ := http.NewRequest(method, ts.http.URL+path, reader)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func (ts *testService) driver(t *testing.T, driverID string) Driver {
+	t.Helper()
+	driver, err := ts.server.Drivers.Get(context.Background(), driverID)
+	if err != nil {
+		t.Fatalf("get driver %s: %v", driverID, err)
+	}
+	return driver
+}
+
+func (ts *testService) pendingOrders(t *testing.T) []Order {
+	t.Helper()
+	resp, err := http.Get(ts.http.URL + "/api/dispatch/orders")
+	if err != nil {
+		t.Fatalf("get orders: %v", err)
+	}
+	defer resp.Body.Close()
+	var orders []Order
+	if err := json.NewDecoder(resp.Body).Decode(&orders); err != nil {
+		t.Fatalf("decode orders: %v", err)
+	}
+	return orders
+}
+
+// Read messages until one of the wanted type arrives
+func readMessage(t *testing.T, conn *websocket.Conn, wantType string) map[string]interface{} {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		var msg map[string]interface{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for %s: %v", wantType, err)
+		}
+		if msg["type"] == wantType {
+			return msg
+		}
+	}
+}
+
+// Poll cond until it holds or five seconds pass
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewOrderIsQueuedAndOfferedToConnectedDrivers(t *testing.T) {
+	ts := startTestService(t)
+	ts.addDriver(t, Driver{ID: "near", Name: "Near", Status: "available", Latitude: 40.7128, Longitude: -74.0060})
+	ts.addDriver(t, Driver{ID: "busy", Name: "Busy", Status: "busy", Latitude: 40.7128, Longitude: -74.0060})
+	ts.addDriver(t, Driver{ID: "away", Name: "Away", Status: "available"})
+	near := ts.connectDriver(t, "near")
+	busy := ts.connectDriver(t, "busy")
+
+	lat, lng := 40.72, -74.0
+	ts.publish(t, "new_order", Order{
+		ID:           "order-1",
+		RestaurantID: "restaurant-1",
+		Restaurant:   &OrderRestaurant{ID: "restaurant-1", Latitude: &lat, Longitude: &lng},
+	})
+
+	// The connected, available driver gets the offer
+	offer := readMessage(t, near, "new_order_available")
+	order, _ := offer["order"].(map[string]interface{})
+	if order["id"] != "order-1" {
+		t.Fatalf("offer order = %v, want order-1", order["id"])
+	}
+
+	// The order waits in the queue until someone takes it
+	waitFor(t, "order to be queued", func() bool { return len(ts.pendingOrders(t)) == 1 })
+
+	// The decision log explains who was offered it and why others weren't
+	decisions, err := ts.server.Decisions.List(context.Background(), "order-1")
+	if err != nil || len(decisions) != 1 {
+		t.Fatalf("decisions = %v, %v; want one", decisions, err)
+	}
+	decision := decisions[0]
+	if decision.Kind != "offer" || len(decision.Offered) != 1 || decision.Offered[0] != "near" {
+		t.Fatalf("decision = %+v, want offer to near", decision)
+	}
+	filters := map[string]string{}
+	for _, candidate := range decision.Candidates {
+		filters[candidate.DriverID] = candidate.Filter
+	}
+	if filters["busy"] != "not_available" || filters["away"] != "not_connected" {
+		t.Fatalf("candidate filters = %v", filters)
+	}
+
+	// The busy driver isn't offered anything
+	busy.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, msg, err := busy.ReadMessage(); err == nil {
+		t.Fatalf("busy driver got %s", msg)
+	}
+}
+
+func TestAssignOrder(t *testing.T) {
+	ts := startTestService(t)
+	ts.addDriver(t, Driver{ID: "driver-1", Name: "Dana", Status: "available"})
+	ts.connectDriver(t, "driver-1")
+
+	// Watch for the assignment event other services consume
+	assigned := redisClient.Subscribe(context.Background(), "order_assigned")
+	defer assigned.Close()
+	if _, err := assigned.Receive(context.Background()); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	ts.publish(t, "new_order", Order{ID: "order-1", RestaurantID: "restaurant-1"})
+	waitFor(t, "order to be queued", func() bool { return len(ts.pendingOrders(t)) == 1 })
+
+	resp := ts.driverRequest(t, "driver-1", "POST", "/api/dispatch/orders/order-1/assign", map[string]string{"driverId": "driver-1"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("assign status = %d, want 200", resp.StatusCode)
+	}
+	var assignment OrderAssignment
+	json.NewDecoder(resp.Body).Decode(&assignment)
+	if assignment.OrderID != "order-1" || assignment.DriverID != "driver-1" || assignment.RestaurantID != "restaurant-1" {
+		t.Fatalf("assignment = %+v", assignment)
+	}
+
+	// The order leaves the queue, the driver is busy and the platform hears
+	// about it
+	if orders := ts.pendingOrders(t); len(orders) != 0 {
+		t.Fatalf("pending orders = %v, want none", orders)
+	}
+	if status := ts.driver(t, "driver-1").Status; status != "busy" {
+		t.Fatalf("driver status = %q, want busy", status)
+	}
+	select {
+	case msg := <-assigned.Channel():
+		var event OrderAssignment
+		json.Unmarshal([]byte(msg.Payload), &event)
+		if event.OrderID != "order-1" || event.DriverID != "driver-1" {
+			t.Fatalf("order_assigned event = %s", msg.Payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no order_assigned event")
+	}
+
+	// A second driver can't take the same order
+	resp = ts.driverRequest(t, "driver-2", "POST", "/api/dispatch/orders/order-1/assign", map[string]string{"driverId": "driver-2"})
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("second assign status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestDeliveredOrderFreesDriver(t *testing.T) {
+	ts := startTestService(t)
+	ts.addDriver(t, Driver{ID: "driver-1", Name: "Dana", Status: "available"})
+	conn := ts.connectDriver(t, "driver-1")
+
+	ts.publish(t, "new_order", Order{ID: "order-1", RestaurantID: "restaurant-1"})
+	readMessage(t, conn, "new_order_available")
+
+	ts.driverRequest(t, "driver-1", "POST", "/api/dispatch/orders/order-1/assign", map[string]string{"driverId": "driver-1"})
+	if status := ts.driver(t, "driver-1").Status; status != "busy" {
+		t.Fatalf("driver status after assignment = %q, want busy", status)
+	}
+
+	ts.publish(t, "order_status_update", map[string]string{"orderId": "order-1", "status": "delivered"})
+
+	// The driver is told and can take new orders again
+	completed := readMessage(t, conn, "order_completed")
+	if completed["orderId"] != "order-1" {
+		t.Fatalf("order_completed = %v", completed)
+	}
+	if status := ts.driver(t, "driver-1").Status; status != "available" {
+		t.Fatalf("driver status = %q, want available", status)
+	}
+	if _, err := ts.server.Assignments.Get(context.Background(), "order-1"); err != ErrNotFound {
+		t.Fatalf("assignment after delivery: err = %v, want ErrNotFound", err)
+	}
+}
+
+// new_order payloads from the API carry the request's W3C trace context
+// under _trace, and handling them continues that trace
+func TestNewOrderContinuesPublisherTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+	otel.SetTracerProvider(provider)
+	propagator := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTextMapPropagator(propagator) })
+
+	ts := startTestService(t)
+	payload, err := os.ReadFile(filepath.Join(contractsDir, "new_order", "created.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := redisClient.Publish(context.Background(), "new_order", payload).Err(); err != nil {
+		t.Fatalf("publish new_order: %v", err)
+	}
+	waitFor(t, "order to be queued", func() bool { return len(ts.pendingOrders(t)) == 1 })
+
+	var handled sdktrace.ReadOnlySpan
+	waitFor(t, "handler span", func() bool {
+		for _, span := range recorder.Ended() {
+			if span.Name() == "handle new_order" {
+				handled = span
+				return true
+			}
+		}
+		return false
+	})
+	if got := handled.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("trace ID = %s, want the publisher's", got)
+	}
+	if got := handled.Parent().SpanID().String(); got != "00f067aa0ba902b7" || !handled.Parent().IsRemote() {
+		t.Fatalf("parent span = %s (remote %v), want the publisher's", got, handled.Parent().IsRemote())
+	}
+}
+
+// The subscriber must not be confused by events for orders it never saw
+func TestStatusUpdateForUnknownOrder(t *testing.T) {
+	ts := startTestService(t)
+	ts.addDriver(t, Driver{ID: "driver-1", Status: "busy"})
+
+	ts.publish(t, "order_status_update", map[string]string{"orderId": "missing", "status": "delivered"})
+	ts.publish(t, "new_order", Order{ID: "order-2"})
+	waitFor(t, "later order to be queued", func() bool { return len(ts.pendingOrders(t)) == 1 })
+
+	if status := ts.driver(t, "driver-1").Status; status != "busy" {
+		t.Fatalf("driver status = %q, want busy", status)
+	}
+}
+
+func TestVehicleLimitsFilterOffers(t *testing.T) {
+	ts := startTestService(t)
+	ts.addDriver(t, Driver{ID: "bike", Status: "available", Latitude: 40.7128, Longitude: -74.0060})
+	ts.addDriver(t, Driver{ID: "car", Status: "available", Latitude: 40.7128, Longitude: -74.0060, Vehicle: &Vehicle{Type: "car"}})
+	// A driver who hasn't said what they deliver with is held to a bicycle's
+	// limits
+	ts.addDriver(t, Driver{ID: "walker", Status: "available", Latitude: 40.7128, Longitude: -74.0060})
+	bike := ts.connectDriver(t, "bike")
+	car := ts.connectDriver(t, "car")
+	ts.connectDriver(t, "walker")
+
+	// An operator sets the bike's vehicle, with a reason for the audit log;
+	// its limits can't go past a bicycle's
+	resp := ts.adminRequest(t, "PUT", "/api/dispatch/drivers/bike/vehicle", map[string]interface{}{"type": "bicycle", "maxDistanceKm": 50})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("set vehicle without a reason status = %d, want 400", resp.StatusCode)
+	}
+	resp = ts.adminRequest(t, "PUT", "/api/dispatch/drivers/bike/vehicle", map[string]interface{}{"type": "bicycle", "maxDistanceKm": 50, "reason": "new bike"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("set vehicle status = %d, want 200", resp.StatusCode)
+	}
+	if vehicle := ts.driver(t, "bike").Vehicle; vehicle == nil || vehicle.Type != "bicycle" || vehicle.MaxDistanceKm != 5 {
+		t.Fatalf("bike vehicle = %+v", vehicle)
+	}
+	actions, err := ts.server.Audit.List(context.Background(), "", 10)
+	if err != nil || len(actions) != 1 || actions[0].Action != "set_driver_vehicle" || actions[0].Target != "bike" || actions[0].Reason != "new bike" {
+		t.Fatalf("audit log = %+v, %v", actions, err)
+	}
+
+	// Only known drivers get a vehicle
+	resp = ts.adminRequest(t, "PUT", "/api/dispatch/drivers/ghost/vehicle", map[string]interface{}{"type": "car", "reason": "typo"})
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("set unknown driver's vehicle status = %d, want 404", resp.StatusCode)
+	}
+	if _, err := ts.server.Drivers.Get(context.Background(), "ghost"); err != ErrNotFound {
+		t.Fatalf("unknown driver created: %v", err)
+	}
+
+	// A 12 km catering order is too far for a bicycle
+	lat, lng := 40.72, -74.0
+	ts.publish(t, "new_order", Order{
+		ID:           "catering",
+		RestaurantID: "restaurant-1",
+		Restaurant:   &OrderRestaurant{ID: "restaurant-1", Latitude: &lat, Longitude: &lng},
+		Requirements: &OrderRequirements{DistanceKm: 12, WeightKg: 6, Items: 4},
+	})
+	readMessage(t, car, "new_order_available")
+	waitFor(t, "order to be queued", func() bool { return len(ts.pendingOrders(t)) == 1 })
+
+	decisions, err := ts.server.Decisions.List(context.Background(), "catering")
+	if err != nil || len(decisions) != 1 {
+		t.Fatalf("decisions = %v, %v; want one", decisions, err)
+	}
+	filters := map[string]string{}
+	for _, candidate := range decisions[0].Candidates {
+		filters[candidate.DriverID] = candidate.Filter
+	}
+	if filters["bike"] != "too_far" || filters["walker"] != "too_far" || filters["car"] != "" {
+		t.Fatalf("candidate filters = %v", filters)
+	}
+
+	// A resync offers it to the same drivers, and the bike's first message
+	// is that, not an offer
+	if err := ts.server.resyncDispatchState(context.Background()); err != nil {
+		t.Fatalf("resync: %v", err)
+	}
+	var sync map[string]interface{}
+	bike.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := bike.ReadJSON(&sync); err != nil || sync["type"] != "state_sync" {
+		t.Fatalf("bike's first message = %v, %v; want state_sync", sync, err)
+	}
+	if offers := sync["pendingOrders"].([]interface{}); len(offers) != 0 {
+		t.Fatalf("bike resynced with offers %v", offers)
+	}
+	if offers := readMessage(t, car, "state_sync")["pendingOrders"].([]interface{}); len(offers) != 1 {
+		t.Fatalf("car resynced with offers %v, want the catering order", offers)
+	}
+
+	// The bike can't take it directly either, and the order stays queued
+	resp = ts.driverRequest(t, "bike", "POST", "/api/dispatch/orders/catering/assign", map[string]string{"driverId": "bike"})
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("assign status = %d, want 409", resp.StatusCode)
+	}
+	if orders := ts.pendingOrders(t); len(orders) != 1 {
+		t.Fatalf("pending orders = %v, want the catering order", orders)
+	}
+
+	// Nor can a driver dispatch has no record of, whose vehicle is unknown
+	resp = ts.driverRequest(t, "ghost", "POST", "/api/dispatch/orders/catering/assign", map[string]string{"driverId": "ghost"})
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("assign to unknown driver status = %d, want 404", resp.StatusCode)
+	}
+	if orders := ts.pendingOrders(t); len(orders) != 1 {
+		t.Fatalf("pending orders = %v, want the catering order", orders)
+	}
+}
+
+// An assignment decision weighs the drivers the order would be offered to,
+// not the whole fleet
+func TestAssignmentDecisionUsesOfferCandidates(t *testing.T) {
+	ts := startTestService(t)
+	ctx := context.Background()
+	ts.addDriver(t, Driver{ID: "local", Status: "available", ZoneID: "zone-a"})
+	ts.addDriver(t, Driver{ID: "roaming", Status: "available"})
+	ts.addDriver(t, Driver{ID: "elsewhere", Status: "available", ZoneID: "zone-b"})
+	ts.addDriver(t, Driver{ID: "picked", Status: "available", ZoneID: "zone-c"})
+
+	ts.server.recordAssignmentDecision(ctx, Order{ID: "order-1", ZoneID: "zone-a"}, "picked")
+
+	decisions, err := ts.server.Decisions.List(ctx, "order-1")
+	if err != nil || len(decisions) != 1 {
+		t.Fatalf("decisions = %v, %v; want one", decisions, err)
+	}
+	var ids []string
+	for _, candidate := range decisions[0].Candidates {
+		ids = append(ids, candidate.DriverID)
+	}
+	if len(ids) != 3 || ids[2] != "picked" || decisions[0].Candidates[2].Rank != 0 {
+		t.Fatalf("candidates = %v, want local, roaming and then the winner", ids)
+	}
+	if decisions[0].Winner != "picked" {
+		t.Fatalf("winner = %q", decisions[0].Winner)
+	}
+}
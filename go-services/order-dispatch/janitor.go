@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/foodo/shared/janitor"
+	"github.com/foodo/shared/logging"
+)
+
+// Add the dispatch retention tasks to j. Retention for each family comes from
+// JANITOR_<FAMILY>_RETENTION.
+func (s *Server) addJanitorTasks(j *janitor.Janitor) {
+	driverRetention := s.Config.Duration("JANITOR_DRIVER_RETENTION", 30*24*time.Hour)
+	assignmentRetention := s.Config.Duration("JANITOR_ASSIGNMENT_RETENTION", 12*time.Hour)
+
+	j.Add("assignments", func(ctx context.Context, report *janitor.Report) error {
+		return s.expireAssignments(ctx, report, time.Now().Add(-assignmentRetention))
+	})
+	j.Add("drivers", func(ctx context.Context, report *janitor.Report) error {
+		return s.removeStaleDrivers(ctx, report, time.Now().Add(-driverRetention))
+	})
+}
+
+// Cancel assignments made before cutoff and free their drivers. These are
+// orders whose delivered or cancelled status never arrived.
+func (s *Server) expireAssignments(ctx context.Context, report *janitor.Report, cutoff time.Time) error {
+	assignments, err := s.Assignments.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, assignment := range assignments {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if assignment.AssignedAt.After(cutoff) {
+			continue
+		}
+		orderCtx := logging.WithOrderID(ctx, assignment.OrderID)
+		if _, _, err := s.unassignOrder(orderCtx, assignment.OrderID, "expired"); err != nil {
+			// Finished or cancelled since it was listed
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return err
+		}
+		s.Orders.ClearReceived(orderCtx, assignment.OrderID)
+		slog.InfoContext(orderCtx, "Expired assignment", logging.DriverIDKey, assignment.DriverID, "assigned_at", assignment.AssignedAt)
+		report.Add("assignments_expired", 1)
+	}
+	return nil
+}
+
+// Remove drivers not seen since cutoff. Drivers that are connected here or
+// still hold an assignment are kept.
+func (s *Server) removeStaleDrivers(ctx context.Context, report *janitor.Report, cutoff time.Time) error {
+	ids, err := s.Drivers.Idle(ctx, cutoff)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+
+	assignments, err := s.Assignments.List(ctx)
+	if err != nil {
+		return err
+	}
+	assigned := make(map[string]bool, len(assignments))
+	for _, assignment := range assignments {
+		assigned[assignment.DriverID] = true
+	}
+
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if _, connected := s.Hub.Get(id); connected || assigned[id] {
+			continue
+		}
+		removed, err := s.Drivers.DeleteIdle(ctx, id, cutoff)
+		if err != nil {
+			return err
+		}
+		if removed {
+			report.Add("drivers_removed", 1)
+		}
+	}
+	return nil
+}
+
+// Report the most recent janitor pass from any replica
+func (s *Server) getJanitorReportHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+
+	report, err := s.Janitor.LastReport(ctx)
+	if err != nil {
+		http.Error(w, "Failed to get janitor report", http.StatusInternalServerError)
+		return
+	}
+	if report == nil {
+		http.Error(w, "No recent janitor pass", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
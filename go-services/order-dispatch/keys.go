@@ -0,0 +1,89 @@
+package main
+
+import "github.com/foodo/shared/rediskeys"
+
+// Redis keys. The part in braces is the hash tag, so keys written together
+// land in the same cluster slot: each driver's keys share the driver's tag,
+// the assignment hashes share {assignments}, and each zone's queue, held
+// orders and driver index share the zone's tag. See migrate.go for the
+// layouts these replaced.
+const (
+	// The zones with drivers, so the fleet can be listed zone by zone
+	driverZonesKey = "driver_zones"
+	// The zone each queued or held order is in, for finding an order by ID
+	orderZonesKey = "{orders}:zones"
+	// When each order first arrived
+	orderReceivedAtKey = "{orders}:received_at"
+	// Assignments by order ID
+	assignmentsKey = "{assignments}:active"
+	// The orders behind them
+	assignedOrdersKey = "{assignments}:orders"
+	// Admin actions, a stream in the order they were taken
+	auditLogKey = "admin_audit"
+	// Webhook subscriptions by ID
+	webhookSubscriptionsKey = "webhook_subscriptions"
+	// The snapshot being restored, until the restore finishes
+	snapshotRestoreKey = "snapshot_restore"
+)
+
+// The tag for orders and drivers without a zone
+const unzonedTag = "unzoned"
+
+// A driver's record
+func driverKey(id string) string {
+	return "driver:" + rediskeys.Tag(id) + ":record"
+}
+
+// When a driver was last saved, in Unix milliseconds
+func driverLastSeenKey(id string) string {
+	return "driver:" + rediskeys.Tag(id) + ":last_seen"
+}
+
+// The zone a driver was last added to the index of
+func driverIndexedZoneKey(id string) string {
+	return "driver:" + rediskeys.Tag(id) + ":indexed_zone"
+}
+
+// The pending list for a zone
+func queueKey(zone string) string {
+	return "zone:" + zoneTag(zone) + ":pending_orders"
+}
+
+// The pending orders for a zone by ID, each as its queue entry. It's kept
+// with the queue, so an order can be found and taken without a scan.
+func queuedKey(zone string) string {
+	return "zone:" + zoneTag(zone) + ":queued_orders"
+}
+
+// The held orders for a zone
+func heldKey(zone string) string {
+	return "zone:" + zoneTag(zone) + ":held_orders"
+}
+
+// The driver index for a zone
+func driverZoneKey(zone string) string {
+	return "zone:" + zoneTag(zone) + ":drivers"
+}
+
+// The last known location of a driver or order. location-tracker writes
+// these; order-dispatch only touches them for snapshots.
+func locationKey(kind, id string) string {
+	return kind + ":" + rediskeys.Tag(id) + ":location"
+}
+
+// An order's dispatch decisions
+func decisionsKey(orderID string) string {
+	return "order:" + rediskeys.Tag(orderID) + ":decisions"
+}
+
+// A webhook subscription's delivery log, newest first
+func webhookDeliveriesKey(subscriptionID string) string {
+	return "webhook_deliveries:" + subscriptionID
+}
+
+func zoneTag(zone string) string {
+	if zone == "" {
+		zone = unzonedTag
+	}
+	return rediskeys.Tag(zone)
+}
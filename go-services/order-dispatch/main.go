@@ -3,49 +3,136 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
-	"os/signal"
-	"syscall"
 	"time"
 
+	"github.com/foodo/shared/auth"
+	"github.com/foodo/shared/bootstrap"
+	"github.com/foodo/shared/config"
+	"github.com/foodo/shared/eventbus"
+	"github.com/foodo/shared/health"
+	"github.com/foodo/shared/janitor"
+	"github.com/foodo/shared/logging"
+	"github.com/foodo/shared/metrics"
+	"github.com/foodo/shared/openapi"
+	"github.com/foodo/shared/pubsub"
+	"github.com/foodo/shared/ratelimit"
+	"github.com/foodo/shared/rediskeys"
+	"github.com/foodo/shared/tracing"
+	"github.com/foodo/shared/tracking"
+	"github.com/foodo/shared/wshub"
 	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Order represents an order to be dispatched
 type Order struct {
-	ID                    string    `json:"id"`
-	OrderNumber           string    `json:"orderNumber"`
-	RestaurantID          string    `json:"restaurantId"`
-	UserID                string    `json:"userId"`
-	Status                string    `json:"status"`
-	DeliveryAddress       string    `json:"deliveryAddress"`
-	EstimatedDeliveryTime time.Time `json:"estimatedDeliveryTime"`
+	ID                    string           `json:"id"`
+	OrderNumber           string           `json:"orderNumber"`
+	RestaurantID          string           `json:"restaurantId"`
+	UserID                string           `json:"userId"`
+	Status                string           `json:"status"`
+	DeliveryAddress       string           `json:"deliveryAddress"`
+	EstimatedDeliveryTime time.Time        `json:"estimatedDeliveryTime"`
+	Restaurant            *OrderRestaurant `json:"restaurant,omitempty"`
+	// Delivery zone covering the restaurant, set on arrival ("" if none)
+	ZoneID string `json:"zoneId,omitempty"`
+	// What the delivering vehicle must manage, if the API set it
+	Requirements *OrderRequirements `json:"requirements,omitempty"`
+}
+
+// OrderRestaurant is the restaurant embedded in new_order events
+type OrderRestaurant struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	ZipCode   string   `json:"zipCode"`
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+}
+
+// Where the order is picked up, if the restaurant's location is known
+func (o Order) pickup() *GeoPoint {
+	if o.Restaurant == nil || o.Restaurant.Latitude == nil || o.Restaurant.Longitude == nil {
+		return nil
+	}
+	return &GeoPoint{Latitude: *o.Restaurant.Latitude, Longitude: *o.Restaurant.Longitude}
 }
 
 // Driver represents a delivery driver
 type Driver struct {
-	ID        string  `json:"id"`
-	Name      string  `json:"name"`
-	Phone     string  `json:"phone"`
-	Latitude  float64 `json:"latitude"`
-	Longitude float64 `json:"longitude"`
-	Status    string  `json:"status"` // available, busy, offline
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Phone     string   `json:"phone"`
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Status    string   `json:"status"` // available, busy, offline
+	ZoneID    string   `json:"zoneId,omitempty"`
+	Vehicle   *Vehicle `json:"vehicle,omitempty"`
 }
 
 // OrderAssignment represents an order assigned to a driver
 type OrderAssignment struct {
-	OrderID    string    `json:"orderId"`
-	DriverID   string    `json:"driverId"`
-	AssignedAt time.Time `json:"assignedAt"`
+	OrderID      string    `json:"orderId"`
+	DriverID     string    `json:"driverId"`
+	RestaurantID string    `json:"restaurantId,omitempty"`
+	AssignedAt   time.Time `json:"assignedAt"`
+}
+
+// Server holds what the dispatch handlers depend on; the handlers are its
+// methods. main wires it to Redis, and the in-memory stores let it run
+// without.
+type Server struct {
+	Config *config.Config
+	// Order event subscriptions and readiness checks use it directly
+	Redis redis.UniversalClient
+
+	Drivers     DriverStore
+	Orders      OrderQueue
+	Assignments AssignmentStore
+	Decisions   DecisionLog
+	Audit       AuditLog
+	Events      eventbus.Bus
+
+	// Connected drivers, keyed by driver ID
+	Hub *wshub.Hub
+	// Signed outbound webhooks for partner restaurants
+	Webhooks *WebhookDispatcher
+	// Driver and order locations location-tracker keeps, copied by
+	// snapshots (nil without Redis)
+	Locations *RedisLocations
+	// Background writer for the Postgres OrderTracking table (nil if disabled)
+	Tracking *tracking.Writer
+	// Per-driver limits on writes, shared across replicas (nil if disabled)
+	Limiter *ratelimit.Limiter
+	// Admin API bearer tokens, mapped to the operator's name
+	AdminTokens map[string]string
+	// Verifies the API's user tokens, which drivers act with
+	Users *auth.Users
+	// Retention passes over drivers and assignments (nil if not running)
+	Janitor *janitor.Janitor
+	// Delivery zones from Postgres (nil if not configured)
+	Zones *ZoneDirectory
+	// The API's orders in Postgres, reconciled on resync (nil if not
+	// configured)
+	Ledger OrderLedger
+
+	// Readiness checks served at /readyz
+	Readiness *health.Checker
+	// State of the order event subscriber
+	OrderEvents health.Consumer
 }
 
 var (
-	redisClient *redis.Client
+	cfg         *config.Config
+	redisClient redis.UniversalClient
 	upgrader    = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
@@ -53,76 +140,235 @@ var (
 			return true // Allow all connections in development
 		},
 	}
-	// In-memory storage for active connections
-	driverConnections = make(map[string]*websocket.Conn)
+	tracer = tracing.Tracer("github.com/foodo/order-dispatch")
 )
 
 func main() {
-	// Initialize Redis client with Redis Cloud connection
-	redisClient = redis.NewClient(&redis.Options{
-		Addr:     getEnv("REDIS_ADDR", "redis-18764.c292.ap-southeast-1-1.ec2.redns.redis-cloud.com:18764"),
-		Username: getEnv("REDIS_USERNAME", "default"),
-		Password: getEnv("REDIS_PASSWORD", "dljBc2IR2S1CPZyZMBBtFDb8nwYxhkwb"),
-		DB:       0,
+	// Load configuration from file, environment and flags
+	var err error
+	cfg, err = config.Load("order-dispatch", "8080", os.Args[1:], append(snapshotFlags, rediskeys.MigrateFlag)...)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	logging.Setup(cfg)
+
+	// Initialize Redis client
+	redisClient, err = config.NewRedisClient(cfg.Redis)
+	if err != nil {
+		logging.Fatal("Failed to create Redis client", "error", err)
+	}
+	redisClient.AddHook(metrics.RedisHook{})
+	redisClient.AddHook(tracing.RedisHook{})
+
+	// Move keys to the cluster layout and exit when asked to
+	if cfg.Bool("REDIS_MIGRATE_KEYS", false) {
+		m := rediskeys.NewMigration(redisClient)
+		if err := migrateKeys(context.Background(), m); err != nil {
+			logging.Fatal("Failed to migrate Redis keys", "error", err, "moved", m.Moved)
+		}
+		slog.Info("Redis keys migrated", "moved", m.Moved)
+		redisClient.Close()
+		return
+	}
+
+	// Export traces when an exporter is configured
+	shutdownTracing, err := tracing.Init(context.Background(), cfg)
+	if err != nil {
+		logging.Fatal("Failed to initialize tracing", "error", err)
+	}
+
+	s := &Server{
+		Config:      cfg,
+		Redis:       redisClient,
+		Drivers:     NewRedisDriverStore(redisClient),
+		Orders:      NewRedisOrderQueue(redisClient),
+		Assignments: NewRedisAssignmentStore(redisClient),
+		Decisions:   NewRedisDecisionLog(redisClient, cfg.Duration("DISPATCH_DECISION_RETENTION", 7*24*time.Hour)),
+		Audit:       NewRedisAuditLog(redisClient),
+		Events:      eventbus.NewRedis(redisClient),
+		Locations:   NewRedisLocations(redisClient),
+		AdminTokens: auth.ParseAdminTokens(cfg.List("ADMIN_TOKENS")),
+		Users:       auth.NewUsers(cfg.String("JWT_SECRET", ""), auth.RevokedInRedis(redisClient)),
+	}
+
+	// Export, import or back up a snapshot of the stores and exit when asked to
+	if command := s.snapshotCommand(); command != nil {
+		if err := command(context.Background()); err != nil {
+			logging.Fatal("Snapshot command failed", "error", err)
+		}
+		redisClient.Close()
+		return
+	}
+
+	// Persist dispatch state to Postgres when a database is configured
+	if cfg.DatabaseURL != "" {
+		writer, err := tracking.New(context.Background(), cfg)
+		if err != nil {
+			slog.Warn("Order tracking persistence disabled", "error", err)
+		} else {
+			s.Tracking = writer
+			s.Ledger = NewPostgresOrderLedger(writer.Pool(),
+				cfg.Duration("DISPATCH_RECONCILE_WINDOW", 24*time.Hour),
+				cfg.Duration("DISPATCH_RECONCILE_GRACE", 30*time.Second))
+		}
+
+		// Partition dispatch by the DeliveryZone table
+		zones, err := NewZoneDirectory(context.Background(), cfg)
+		if err != nil {
+			slog.Warn("Delivery zones disabled", "error", err)
+		} else {
+			s.Zones = zones
+		}
+	}
+
+	// Signed outbound webhooks for partner restaurants
+	s.Webhooks = NewWebhookDispatcher(cfg, NewRedisWebhookStore(redisClient))
+
+	// Connected drivers and their send queues
+	s.Hub = wshub.New(cfg)
+
+	// Rate limits, overridable with RATE_LIMIT_<ROUTE>
+	s.Limiter, err = ratelimit.New(cfg, redisClient, map[string]string{
+		"driver_location": "5/s,10",
+		"assign_order":    "2/s,5",
+		"ws_message":      "10/s,20",
 	})
+	if err != nil {
+		logging.Fatal("Invalid rate limit", "error", err)
+	}
 
-	// Create router
-	r := mux.NewRouter()
+	// Queue depth and age gauges
+	registerQueueMetrics(s.Orders)
 
-	// API routes
-	r.HandleFunc("/health", healthCheckHandler).Methods("GET")
-	r.HandleFunc("/api/dispatch/orders", getOrdersHandler).Methods("GET")
-	r.HandleFunc("/api/dispatch/orders/{id}/assign", assignOrderHandler).Methods("POST")
-	r.HandleFunc("/api/dispatch/drivers", getDriversHandler).Methods("GET")
-	r.HandleFunc("/api/dispatch/drivers/{id}/location", updateDriverLocationHandler).Methods("POST")
+	// Remove stale drivers and orphaned assignments, one replica at a time
+	s.Janitor = janitor.New(cfg, redisClient)
+	s.addJanitorTasks(s.Janitor)
 
-	// WebSocket route for real-time driver updates
-	r.HandleFunc("/ws/drivers/{id}", driverWebSocketHandler)
+	// Readiness checks for /readyz
+	s.setupHealthChecks()
 
-	// Start listening for Redis messages in a goroutine
-	go subscribeToOrderEvents()
+	// Create router
+	r, err := s.newRouter()
+	if err != nil {
+		logging.Fatal("Invalid OpenAPI document", "error", err)
+	}
 
-	// Create HTTP server
-	srv := &http.Server{
-		Addr:         ":" + getEnv("PORT", "8080"),
-		Handler:      r,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+	// Refuse to start on settings that didn't parse rather than run with
+	// their defaults
+	drainDelay := cfg.Duration("SHUTDOWN_DRAIN_DELAY", 0)
+	reconnectSpread := cfg.Duration("SHUTDOWN_RECONNECT_SPREAD", 10*time.Second)
+	if err := cfg.Err(); err != nil {
+		logging.Fatal("Invalid configuration", "error", err)
 	}
 
-	// Start server in a goroutine
+	// Start listening for Redis messages in a goroutine
+	subscriberCtx, stopSubscriber := context.WithCancel(context.Background())
+	subscriberDone := make(chan struct{})
 	go func() {
-		log.Printf("Starting server on port %s", getEnv("PORT", "8080"))
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Could not listen on %s: %v", getEnv("PORT", "8080"), err)
+		defer close(subscriberDone)
+		s.subscribeToOrderEvents(subscriberCtx)
+	}()
+	// Catch up on orders placed or finished while the service was down
+	go func() {
+		if err := s.reconcileOrders(subscriberCtx); err != nil {
+			slog.Warn("Failed to reconcile orders with Postgres", "error", err)
 		}
 	}()
+	janitorCtx, stopJanitor := context.WithCancel(context.Background())
+	go s.Janitor.Run(janitorCtx)
+	zonesCtx, stopZones := context.WithCancel(context.Background())
+	go s.Zones.Run(zonesCtx)
+
+	// Run the HTTP server until interrupted
+	srv := bootstrap.NewServer(cfg, r)
+	bootstrap.Run(cfg, srv, func(ctx context.Context) error {
+		// Fail readiness and give load balancers time to notice
+		s.Readiness.Drain(ctx, drainDelay)
+
+		// Stop accepting driver connections, order events and HTTP requests.
+		// Shutdown returns once in-flight requests such as assignments finish.
+		s.Hub.StopAccepting()
+		stopSubscriber()
+		stopJanitor()
+		stopZones()
+		httpDone := make(chan error, 1)
+		go func() { httpDone <- srv.Shutdown(ctx) }()
+
+		// Ask drivers to reconnect elsewhere, spread out over time
+		s.Hub.SendReconnect(reconnectSpread)
+		s.Hub.Flush(ctx)
+
+		// Wait for in-flight event handlers, requests and webhook deliveries
+		select {
+		case <-subscriberDone:
+		case <-ctx.Done():
+		}
+		err := <-httpDone
+		s.Webhooks.Wait(ctx)
 
-	// Wait for interrupt signal to gracefully shutdown the server
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	log.Println("Shutting down server...")
+		// Deliver anything the handlers queued, then close with 1012
+		s.Hub.Close(ctx, websocket.CloseServiceRestart, "server restarting")
 
-	// Create a deadline to wait for
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+		// Flush pending tracking writes
+		s.Tracking.Close()
+		s.Zones.Close()
 
-	// Close all WebSocket connections
-	for _, conn := range driverConnections {
-		conn.Close()
-	}
+		// Close Redis client
+		redisClient.Close()
+
+		// Flush buffered spans
+		shutdownTracing(ctx)
 
-	// Close Redis client
-	redisClient.Close()
+		return err
+	})
+}
 
-	// Shutdown server
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+// Build the router with its middleware, the operational endpoints and the
+// service's routes. Requests are validated against the OpenAPI document.
+func (s *Server) newRouter() (*mux.Router, error) {
+	spec, err := openapi.Load(openAPISpec)
+	if err != nil {
+		return nil, err
 	}
 
-	log.Println("Server exiting")
+	// Authenticate before validating, so anonymous callers learn nothing
+	// about request shapes
+	guard := auth.NewGuard()
+	r := mux.NewRouter()
+	r.Use(tracing.Middleware("order-dispatch"))
+	r.Use(logging.Middleware)
+	r.Use(guard.Middleware)
+	r.Use(spec.Middleware)
+
+	// API routes
+	r.HandleFunc("/health", healthCheckHandler).Methods("GET")
+	r.HandleFunc("/livez", s.Readiness.LivenessHandler).Methods("GET")
+	r.HandleFunc("/readyz", s.Readiness.ReadinessHandler).Methods("GET")
+	r.HandleFunc("/openapi.json", spec.Handler).Methods("GET")
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
+	guard.Require(r.HandleFunc("/debug/log-level", logging.LevelHandler).Methods("GET", "PUT"), auth.Admin(s.AdminTokens))
+	s.registerRoutes(r, guard)
+	return r, nil
+}
+
+// Register the dispatch API, admin API and driver WebSocket routes. Drivers
+// act for themselves with their user token; operators can act for anyone.
+func (s *Server) registerRoutes(r *mux.Router, guard *auth.Guard) {
+	driver := auth.UserOrAdmin(s.Users, s.AdminTokens)
+	r.HandleFunc("/api/dispatch/orders", s.getOrdersHandler).Methods("GET")
+	guard.Require(r.HandleFunc("/api/dispatch/orders/{id}/assign", s.assignOrderHandler).Methods("POST"), driver)
+	r.HandleFunc("/api/dispatch/orders/{id}/decisions", s.getOrderDecisionsHandler).Methods("GET")
+	r.HandleFunc("/api/dispatch/drivers", s.getDriversHandler).Methods("GET")
+	guard.Require(r.HandleFunc("/api/dispatch/drivers/{id}/location", s.updateDriverLocationHandler).Methods("POST"), driver)
+	guard.Require(r.HandleFunc("/api/dispatch/drivers/{id}/vehicle", s.updateDriverVehicleHandler).Methods("PUT"), auth.Admin(s.AdminTokens))
+	r.HandleFunc("/api/dispatch/zones", s.getZonesHandler).Methods("GET")
+
+	// Operator controls
+	s.registerAdminRoutes(r, guard)
+	s.registerWebhookRoutes(r, guard)
+
+	// WebSocket route for real-time driver updates
+	guard.Require(r.HandleFunc("/ws/drivers/{id}", s.driverWebSocketHandler), driver)
 }
 
 // Health check handler
@@ -135,36 +381,32 @@ func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// Get all pending orders
-func getOrdersHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
+// Get all pending orders, or one zone's with ?zone=
+func (s *Server) getOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
 
-	// Get all orders from Redis
-	ordersJSON, err := redisClient.LRange(ctx, "pending_orders", 0, -1).Result()
+	var orders []Order
+	var err error
+	if zone, ok := r.URL.Query()["zone"]; ok {
+		orders, err = s.Orders.ListZone(ctx, zone[0])
+	} else {
+		orders, err = s.Orders.List(ctx)
+	}
 	if err != nil {
 		http.Error(w, "Failed to get orders", http.StatusInternalServerError)
 		return
 	}
 
-	// Parse orders
-	var orders []Order
-	for _, orderJSON := range ordersJSON {
-		var order Order
-		if err := json.Unmarshal([]byte(orderJSON), &order); err != nil {
-			continue
-		}
-		orders = append(orders, order)
-	}
-
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(orders)
 }
 
 // Assign order to driver
-func assignOrderHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
+func (s *Server) assignOrderHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
 	vars := mux.Vars(r)
 	orderID := vars["id"]
+	ctx = logging.WithOrderID(ctx, orderID)
 
 	// Parse request body
 	var requestBody struct {
@@ -174,80 +416,191 @@ func assignOrderHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	ctx = logging.WithDriverID(ctx, requestBody.DriverID)
+	if !auth.ActsFor(ctx, requestBody.DriverID) {
+		http.Error(w, "Drivers can only assign orders to themselves", http.StatusForbidden)
+		return
+	}
+
+	if !s.Limiter.Check(w, r, "assign_order") {
+		return
+	}
+
+	// Only a driver dispatch knows can take an order, so its vehicle is
+	// always checked
+	driver, err := s.Drivers.Get(ctx, requestBody.DriverID)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Driver not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to get driver", http.StatusInternalServerError)
+		return
+	}
 
-	// Get order from Redis
-	orderJSON, err := redisClient.LRem(ctx, "pending_orders", 1, orderID).Result()
-	if err != nil || orderJSON == 0 {
+	// Take the order off the queue; only one caller can win it
+	order, err := s.Orders.Take(ctx, orderID)
+	if err != nil {
 		http.Error(w, "Order not found", http.StatusNotFound)
 		return
 	}
 
+	// Give it back if the driver's vehicle can't manage it
+	if filter := vehicleFilter(driver.Vehicle, order.Requirements, pickupDistanceKm(order.pickup(), driver)); filter != "" {
+		s.Orders.Requeue(ctx, order)
+		http.Error(w, "Driver's vehicle can't take this order: "+filter, http.StatusConflict)
+		return
+	}
+
+	assignment := s.assignOrder(ctx, order, requestBody.DriverID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(assignment)
+}
+
+// Record an assignment and tell the driver, the restaurant and the rest of
+// the platform about it. The order must already be out of the queue.
+func (s *Server) assignOrder(ctx context.Context, order Order, driverID string) OrderAssignment {
+	orderID := order.ID
+
 	// Create assignment
 	assignment := OrderAssignment{
-		OrderID:    orderID,
-		DriverID:   requestBody.DriverID,
-		AssignedAt: time.Now(),
+		OrderID:      orderID,
+		DriverID:     driverID,
+		RestaurantID: order.RestaurantID,
+		AssignedAt:   time.Now(),
 	}
 
-	// Save assignment to Redis
-	assignmentJSON, _ := json.Marshal(assignment)
-	redisClient.HSet(ctx, "order_assignments", orderID, assignmentJSON)
+	// Explain the choice while the other drivers' state is still as it was
+	s.recordAssignmentDecision(ctx, order, driverID)
+
+	// Save assignment, keeping the order so it can be requeued
+	if err := s.Assignments.Save(ctx, assignment, order); err != nil {
+		slog.ErrorContext(ctx, "Failed to save assignment", "error", err)
+	}
 
 	// Update driver status
-	redisClient.HSet(ctx, "drivers", requestBody.DriverID, `{"status": "busy"}`)
+	driver, _ := s.setDriverStatus(ctx, driverID, "busy")
 
 	// Publish assignment event
-	redisClient.Publish(ctx, "order_assigned", assignmentJSON)
+	assignmentJSON, _ := json.Marshal(assignment)
+	s.Events.Publish(ctx, "order_assigned", assignmentJSON)
+	s.recordOrderAssigned(ctx, orderID)
+	slog.InfoContext(ctx, "Order assigned", "restaurant_id", order.RestaurantID)
+
+	// Persist assignment to OrderTracking
+	status := "assigned"
+	update := tracking.Update{
+		OrderID:  orderID,
+		Status:   &status,
+		DriverID: &assignment.DriverID,
+	}
+	if driver.Name != "" {
+		update.DriverName = &driver.Name
+	}
+	if driver.Phone != "" {
+		update.DriverPhone = &driver.Phone
+	}
+	if driver.Latitude != 0 || driver.Longitude != 0 {
+		update.DriverLocation, _ = json.Marshal(map[string]interface{}{
+			"latitude":  driver.Latitude,
+			"longitude": driver.Longitude,
+			"timestamp": time.Now().Unix(),
+		})
+	}
+	if !order.EstimatedDeliveryTime.IsZero() {
+		update.EstimatedArrival = &order.EstimatedDeliveryTime
+	}
+	s.Tracking.Enqueue(update)
+
+	// Notify the restaurant's POS
+	s.Webhooks.Publish(ctx, WebhookEventDriverAssigned, order.RestaurantID, orderID, map[string]interface{}{
+		"orderNumber": order.OrderNumber,
+		"driver": map[string]interface{}{
+			"id":    assignment.DriverID,
+			"name":  driver.Name,
+			"phone": driver.Phone,
+		},
+		"assignedAt": assignment.AssignedAt,
+	})
 
 	// Notify driver via WebSocket if connected
-	if conn, ok := driverConnections[requestBody.DriverID]; ok {
-		conn.WriteJSON(map[string]interface{}{
+	if client, ok := s.Hub.Get(driverID); ok {
+		client.SendJSON(map[string]interface{}{
 			"type":       "order_assigned",
 			"assignment": assignment,
 		})
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(assignment)
+	return assignment
+}
+
+// Set a driver's status, keeping the rest of its record. A driver missing
+// from the store is created.
+func (s *Server) setDriverStatus(ctx context.Context, driverID, status string) (Driver, error) {
+	driver, err := s.Drivers.Get(ctx, driverID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return driver, err
+	}
+	driver.ID = driverID
+	driver.Status = status
+	return driver, s.Drivers.Save(ctx, driver)
+}
+
+// Move a driver to a zone, keeping the rest of its record. A driver
+// missing from the store is created available.
+func (s *Server) setDriverZone(ctx context.Context, driverID, zone string) {
+	driver, err := s.Drivers.Get(ctx, driverID)
+	if errors.Is(err, ErrNotFound) {
+		driver = Driver{ID: driverID, Status: "available"}
+	} else if err != nil {
+		slog.ErrorContext(ctx, "Failed to get driver", "error", err)
+		return
+	}
+	if driver.ZoneID == zone {
+		return
+	}
+	driver.ZoneID = zone
+	if err := s.Drivers.Save(ctx, driver); err != nil {
+		slog.ErrorContext(ctx, "Failed to save driver zone", "error", err)
+	}
 }
 
 // Get all available drivers
-func getDriversHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
+func (s *Server) getDriversHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
 
-	// Get all drivers from Redis
-	driversMap, err := redisClient.HGetAll(ctx, "drivers").Result()
+	drivers, err := s.Drivers.List(ctx)
 	if err != nil {
 		http.Error(w, "Failed to get drivers", http.StatusInternalServerError)
 		return
 	}
 
-	// Parse drivers
-	var drivers []Driver
-	for driverID, driverJSON := range driversMap {
-		var driver Driver
-		if err := json.Unmarshal([]byte(driverJSON), &driver); err != nil {
-			continue
-		}
-		driver.ID = driverID
-		drivers = append(drivers, driver)
-	}
-
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(drivers)
 }
 
 // Update driver location
-func updateDriverLocationHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
+func (s *Server) updateDriverLocationHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
 	vars := mux.Vars(r)
 	driverID := vars["id"]
+	ctx = logging.WithDriverID(ctx, driverID)
+	if !auth.ActsFor(ctx, driverID) {
+		http.Error(w, "Drivers can only update their own location", http.StatusForbidden)
+		return
+	}
+
+	if !s.Limiter.Check(w, r, "driver_location") {
+		return
+	}
 
 	// Parse request body
 	var requestBody struct {
 		Latitude  float64 `json:"latitude"`
 		Longitude float64 `json:"longitude"`
+		ZoneID    *string `json:"zoneId"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -255,32 +608,26 @@ func updateDriverLocationHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get current driver data
-	driverJSON, err := redisClient.HGet(ctx, "drivers", driverID).Result()
+	driver, err := s.Drivers.Get(ctx, driverID)
 	if err != nil {
 		// Driver doesn't exist, create new
-		driver := Driver{
-			ID:        driverID,
-			Latitude:  requestBody.Latitude,
-			Longitude: requestBody.Longitude,
-			Status:    "available",
+		driver = Driver{
+			ID:     driverID,
+			Status: "available",
 		}
-		driverJSONBytes, _ := json.Marshal(driver)
-		driverJSON = string(driverJSONBytes)
-	} else {
-		// Update existing driver
-		var driver Driver
-		json.Unmarshal([]byte(driverJSON), &driver)
-		driver.Latitude = requestBody.Latitude
-		driver.Longitude = requestBody.Longitude
-		driverJSONBytes, _ := json.Marshal(driver)
-		driverJSON = string(driverJSONBytes)
+	}
+	driver.Latitude = requestBody.Latitude
+	driver.Longitude = requestBody.Longitude
+	if requestBody.ZoneID != nil {
+		driver.ZoneID = *requestBody.ZoneID
 	}
 
-	// Save updated driver to Redis
-	redisClient.HSet(ctx, "drivers", driverID, string(driverJSON))
+	// Save updated driver
+	s.Drivers.Save(ctx, driver)
 
 	// Publish driver location update
-	redisClient.Publish(ctx, "driver_location_updated", fmt.Sprintf(`{"driverId": "%s", "latitude": %f, "longitude": %f}`, driverID, requestBody.Latitude, requestBody.Longitude))
+	locationUpdate := fmt.Sprintf(`{"driverId": "%s", "latitude": %f, "longitude": %f}`, driverID, requestBody.Latitude, requestBody.Longitude)
+	s.Events.Publish(ctx, "driver_location_updated", []byte(locationUpdate))
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -288,158 +635,240 @@ func updateDriverLocationHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // WebSocket handler for real-time driver updates
-func driverWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) driverWebSocketHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	driverID := vars["id"]
+	ctx := logging.WithConnectionID(logging.WithDriverID(r.Context(), driverID), "driver:"+driverID)
+
+	// Only the driver, or an operator, can take the driver's offers
+	if !auth.ActsFor(ctx, driverID) {
+		http.Error(w, "Drivers can only connect as themselves", http.StatusForbidden)
+		return
+	}
+
+	// Send new connections elsewhere while draining
+	if s.Hub.Draining() {
+		http.Error(w, "Server is draining", http.StatusServiceUnavailable)
+		return
+	}
 
 	// Upgrade HTTP connection to WebSocket
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("Failed to upgrade connection: %v", err)
+		slog.WarnContext(ctx, "Failed to upgrade connection", "error", err)
 		return
 	}
 
 	// Store connection
-	driverConnections[driverID] = conn
+	client, err := s.Hub.Register(driverID, conn)
+	if err != nil {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseServiceRestart, err.Error()), time.Now().Add(time.Second))
+		conn.Close()
+		return
+	}
+	metrics.WebSocketConnections.WithLabelValues("driver").Inc()
+	slog.InfoContext(ctx, "Driver connected")
 
-	// Clean up on disconnect
+	// Drivers can name their zone when they connect
+	if zone, ok := r.URL.Query()["zoneId"]; ok {
+		s.setDriverZone(context.WithoutCancel(ctx), driverID, zone[0])
+	}
+
+	// Clean up on disconnect, including peers that stopped answering pings
+	var readErr error
 	defer func() {
-		conn.Close()
-		delete(driverConnections, driverID)
+		reason := wshub.DisconnectReason(readErr)
+		current := s.Hub.Unregister(client)
+		metrics.WebSocketConnections.WithLabelValues("driver").Dec()
+		metrics.WebSocketDisconnects.WithLabelValues("driver", reason).Inc()
+		slog.InfoContext(ctx, "Driver disconnected", "reason", reason)
+
+		// A replaced connection or a drain isn't the driver going away
+		if current && !s.Hub.Draining() {
+			s.publishDriverDisconnected(context.WithoutCancel(ctx), driverID, reason)
+		}
 	}()
 
 	// Handle incoming messages
 	for {
-		messageType, p, err := conn.ReadMessage()
+		_, p, err := conn.ReadMessage()
 		if err != nil {
-			log.Printf("Error reading message: %v", err)
+			readErr = err
+			slog.DebugContext(ctx, "Error reading message", "error", err)
 			break
 		}
 
-		// Echo the message back for now
-		if err := conn.WriteMessage(messageType, p); err != nil {
-			log.Printf("Error writing message: %v", err)
-			break
+		// Drop messages over the limit and tell the driver to slow down
+		if result := s.Limiter.Allow(ctx, "ws_message", "driver:"+driverID); !result.Allowed {
+			client.SendJSON(map[string]interface{}{
+				"type":         "throttled",
+				"retryAfterMs": result.RetryAfter.Milliseconds(),
+			})
+			continue
 		}
+
+		// Echo the message back for now
+		client.Send(p)
 	}
 }
 
-// Subscribe to Redis channels for order events
-func subscribeToOrderEvents() {
-	ctx := context.Background()
-	pubsub := redisClient.Subscribe(ctx, "new_order", "order_status_updated")
-	defer pubsub.Close()
-
-	ch := pubsub.Channel()
-	for msg := range ch {
-		switch msg.Channel {
-		case "new_order":
-			handleNewOrder(msg.Payload)
-		case "order_status_updated":
-			handleOrderStatusUpdate(msg.Payload)
-		}
+// Announce that a driver's socket closed so other services can react
+func (s *Server) publishDriverDisconnected(ctx context.Context, driverID, reason string) {
+	event, _ := json.Marshal(map[string]interface{}{
+		"driverId":       driverID,
+		"reason":         reason,
+		"disconnectedAt": time.Now(),
+	})
+	s.Events.Publish(ctx, "driver_disconnected", event)
+}
+
+// The channels order events arrive on
+var orderChannels = []string{"new_order", "order_status_update"}
+
+// Subscribe to Redis channels for order events, resubscribing and
+// resyncing if the connection drops
+func (s *Server) subscribeToOrderEvents(ctx context.Context) {
+	subscriber := pubsub.New(s.Config, s.Redis, orderChannels...)
+	subscriber.Handle = s.handleOrderEvent
+	subscriber.Resync = s.resyncDispatchState
+	subscriber.State = &s.OrderEvents
+	subscriber.Run(ctx)
+}
+
+// Dispatch an order event to its handler
+func (s *Server) handleOrderEvent(msg *redis.Message) {
+	metrics.PubSubMessages.WithLabelValues(msg.Channel).Inc()
+
+	// Continue the publisher's trace if the payload carries one
+	ctx := tracing.ExtractPayload(context.Background(), []byte(msg.Payload))
+	ctx, span := tracer.Start(ctx, "handle "+msg.Channel, trace.WithSpanKind(trace.SpanKindConsumer))
+	defer span.End()
+
+	switch msg.Channel {
+	case "new_order":
+		s.handleNewOrder(ctx, msg.Payload)
+	case "order_status_update":
+		s.handleOrderStatusUpdate(ctx, msg.Payload)
 	}
 }
 
 // Handle new order event
-func handleNewOrder(orderJSON string) {
-	ctx := context.Background()
-
+func (s *Server) handleNewOrder(ctx context.Context, orderJSON string) {
 	// Parse order
 	var order Order
 	if err := json.Unmarshal([]byte(orderJSON), &order); err != nil {
-		log.Printf("Failed to parse order: %v", err)
+		slog.WarnContext(ctx, "Failed to parse order", "error", err)
 		return
 	}
-
-	// Add to pending orders list
-	redisClient.RPush(ctx, "pending_orders", orderJSON)
-
-	// Find nearby drivers
+	ctx = logging.WithOrderID(ctx, order.ID)
+	order.ZoneID = s.Zones.ForOrder(order)
+	slog.InfoContext(ctx, "Order received", "restaurant_id", order.RestaurantID, "zone_id", order.ZoneID)
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("order.id", order.ID),
+		attribute.String("order.zone_id", order.ZoneID),
+	)
+
+	// Add to the zone's pending orders
+	s.Orders.Push(ctx, order)
+	s.Orders.MarkReceived(ctx, order.ID, time.Now())
+
+	// Find drivers in the order's zone
 	// This is a simplified version - in a real app, you'd use geospatial queries
-	driversMap, err := redisClient.HGetAll(ctx, "drivers").Result()
+	decision, err := s.zoneCandidates(ctx, order)
 	if err != nil {
-		log.Printf("Failed to get drivers: %v", err)
+		slog.ErrorContext(ctx, "Failed to get drivers", "error", err)
 		return
 	}
+	decision.Kind = "offer"
+	decision.Trigger = "new_order"
 
-	// Notify available drivers
-	for driverID, driverJSON := range driversMap {
-		var driver Driver
-		if err := json.Unmarshal([]byte(driverJSON), &driver); err != nil {
+	// Notify available drivers, closest first
+	for _, candidate := range decision.Candidates {
+		if !candidate.Eligible {
 			continue
 		}
-
-		if driver.Status == "available" {
-			if conn, ok := driverConnections[driverID]; ok {
-				conn.WriteJSON(map[string]interface{}{
-					"type":  "new_order_available",
-					"order": order,
-				})
-			}
+		if client, ok := s.Hub.Get(candidate.DriverID); ok {
+			client.SendJSON(map[string]interface{}{
+				"type":  "new_order_available",
+				"order": order,
+			})
+			decision.Offered = append(decision.Offered, candidate.DriverID)
+			dispatchOffers.WithLabelValues("sent").Inc()
 		}
 	}
+	s.recordDispatchDecision(ctx, decision)
+}
+
+// OrderStatusUpdate is an order_status_update event
+type OrderStatusUpdate struct {
+	OrderID      string `json:"orderId"`
+	Status       string `json:"status"`
+	RestaurantID string `json:"restaurantId,omitempty"`
 }
 
 // Handle order status update event
-func handleOrderStatusUpdate(updateJSON string) {
+func (s *Server) handleOrderStatusUpdate(ctx context.Context, updateJSON string) {
 	// Parse update
-	var update struct {
-		OrderID string `json:"orderId"`
-		Status  string `json:"status"`
-	}
+	var update OrderStatusUpdate
 	if err := json.Unmarshal([]byte(updateJSON), &update); err != nil {
-		log.Printf("Failed to parse update: %v", err)
+		slog.WarnContext(ctx, "Failed to parse update", "error", err)
 		return
 	}
+	s.applyOrderStatus(logging.WithOrderID(ctx, update.OrderID), update)
+}
+
+// Record a status change and, for finished orders, free the driver
+func (s *Server) applyOrderStatus(ctx context.Context, update OrderStatusUpdate) {
+	slog.InfoContext(ctx, "Order status updated", "status", update.Status)
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("order.id", update.OrderID),
+		attribute.String("order.status", update.Status),
+	)
+
+	// Record every status transition in OrderTracking
+	if update.OrderID != "" && update.Status != "" {
+		status := update.Status
+		s.Tracking.Enqueue(tracking.Update{OrderID: update.OrderID, Status: &status})
+	}
 
-	ctx := context.Background()
+	// Notify restaurant webhooks about driver progress
+	if eventType, ok := statusWebhookEvents[update.Status]; ok {
+		assignment, _ := s.Assignments.Get(ctx, update.OrderID)
+		restaurantID := update.RestaurantID
+		if restaurantID == "" {
+			restaurantID = assignment.RestaurantID
+		}
+		s.Webhooks.Publish(ctx, eventType, restaurantID, update.OrderID, map[string]interface{}{
+			"status":   update.Status,
+			"driverId": assignment.DriverID,
+		})
+	}
 
 	// If order is completed or cancelled, update driver status
 	if update.Status == "delivered" || update.Status == "cancelled" {
-		// Get assignment
-		assignmentJSON, err := redisClient.HGet(ctx, "order_assignments", update.OrderID).Result()
-		if err != nil {
-			return
-		}
+		// Stop counting the order's queue age
+		s.Orders.ClearReceived(ctx, update.OrderID)
 
-		var assignment OrderAssignment
-		if err := json.Unmarshal([]byte(assignmentJSON), &assignment); err != nil {
+		// Remove assignment
+		assignment, _, err := s.Assignments.Remove(ctx, update.OrderID)
+		if err != nil {
 			return
 		}
 
 		// Update driver status to available
-		driverJSON, err := redisClient.HGet(ctx, "drivers", assignment.DriverID).Result()
+		driver, err := s.Drivers.Get(ctx, assignment.DriverID)
 		if err != nil {
 			return
 		}
-
-		var driver Driver
-		if err := json.Unmarshal([]byte(driverJSON), &driver); err != nil {
-			return
-		}
-
 		driver.Status = "available"
-		updatedDriverJSON, _ := json.Marshal(driver)
-		redisClient.HSet(ctx, "drivers", assignment.DriverID, string(updatedDriverJSON))
-
-		// Remove assignment
-		redisClient.HDel(ctx, "order_assignments", update.OrderID)
+		s.Drivers.Save(ctx, driver)
 
 		// Notify driver
-		if conn, ok := driverConnections[assignment.DriverID]; ok {
-			conn.WriteJSON(map[string]interface{}{
+		if client, ok := s.Hub.Get(assignment.DriverID); ok {
+			client.SendJSON(map[string]interface{}{
 				"type":    "order_completed",
 				"orderId": update.OrderID,
 			})
 		}
 	}
 }
-
-// Helper function to get environment variable with fallback
-func getEnv(key, fallback string) string {
-	if value, exists := os.LookupEnv(key); exists {
-		return value
-	}
-	return fallback
-}
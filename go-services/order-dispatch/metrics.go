@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/foodo/shared/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// Time from a new_order event reaching this service to its assignment
+	assignmentLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "dispatch",
+		Name:      "assignment_latency_seconds",
+		Help:      "Time from new_order to assignment.",
+		Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800},
+	})
+
+	// Offers pushed to drivers and how many of those orders were accepted
+	dispatchOffers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "dispatch",
+		Name:      "offers_total",
+		Help:      "Order offers by outcome (sent, accepted).",
+	}, []string{"outcome"})
+)
+
+// Register the queue gauges. Depth and age are read from the queue at
+// scrape time so every replica reports the shared queue rather than its
+// own view.
+func registerQueueMetrics(orders OrderQueue) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "dispatch",
+		Name:      "pending_orders",
+		Help:      "Length of the pending_orders queue.",
+	}, func() float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		length, err := orders.Len(ctx)
+		if err != nil {
+			return 0
+		}
+		return float64(length)
+	})
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "dispatch",
+		Name:      "oldest_pending_order_age_seconds",
+		Help:      "Age of the oldest unassigned order.",
+	}, func() float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		oldest, err := orders.OldestReceived(ctx)
+		if err != nil || oldest.IsZero() {
+			return 0
+		}
+		return time.Since(oldest).Seconds()
+	})
+}
+
+// Observe queue time for an assigned order and forget its arrival time
+func (s *Server) recordOrderAssigned(ctx context.Context, orderID string) {
+	dispatchOffers.WithLabelValues("accepted").Inc()
+
+	receivedAt, err := s.Orders.ClearReceived(ctx, orderID)
+	if err != nil {
+		return
+	}
+	assignmentLatency.Observe(time.Since(receivedAt).Seconds())
+}
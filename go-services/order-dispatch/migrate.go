@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/foodo/shared/rediskeys"
+	"github.com/go-redis/redis/v8"
+)
+
+// Move dispatch data from the flat key layout to the hash-tagged one in
+// keys.go. The flat layout had:
+//
+//	drivers            driver records
+//	pending_orders     the order queue
+//	order_assignments  assignments
+//
+// Run it with every replica stopped. It can be run again after a failure.
+func migrateKeys(ctx context.Context, m *rediskeys.Migration) error {
+	client := m.Client
+
+	// Drivers, each into its own slot, indexed by zone
+	if err := migrateDrivers(ctx, m); err != nil {
+		return err
+	}
+
+	// The queue had no zones, so it becomes the unzoned queue, indexed by
+	// order ID alongside it
+	if err := m.List(ctx, "orders", "pending_orders", queueKey("")); err != nil {
+		return err
+	}
+	if err := indexQueue(ctx, client, ""); err != nil {
+		return err
+	}
+
+	// Assignments. Their orders weren't kept, which a missing order allows
+	// for.
+	return m.Hash(ctx, "assignments", "order_assignments", assignmentsKey)
+}
+
+// Move the driver records in the drivers hash to each driver's keys and
+// index each driver under its zone. Drivers are counted as seen now, since
+// when they were last seen wasn't kept. A driver already moved keeps its
+// record.
+func migrateDrivers(ctx context.Context, m *rediskeys.Migration) error {
+	client := m.Client
+	driversMap, err := client.HGetAll(ctx, "drivers").Result()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UnixMilli()
+	for id, driverJSON := range driversMap {
+		// Some records were written without their ID
+		var driver Driver
+		if err := json.Unmarshal([]byte(driverJSON), &driver); err != nil {
+			return fmt.Errorf("driver %s: %w", id, err)
+		}
+		driver.ID = id
+		record, _ := json.Marshal(driver)
+		pipe := client.TxPipeline()
+		pipe.SetNX(ctx, driverKey(id), record, 0)
+		pipe.SetNX(ctx, driverLastSeenKey(id), now, 0)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+	}
+	for id := range driversMap {
+		// Index the record that won, which may have been saved already
+		driver, err := NewRedisDriverStore(client).Get(ctx, id)
+		if err != nil {
+			return fmt.Errorf("driver %s: %w", id, err)
+		}
+		pipe := client.Pipeline()
+		pipe.SAdd(ctx, driverZoneKey(driver.ZoneID), id)
+		pipe.SAdd(ctx, driverZonesKey, driver.ZoneID)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+		if err := client.Set(ctx, driverIndexedZoneKey(id), driver.ZoneID, 0).Err(); err != nil {
+			return err
+		}
+	}
+
+	return m.Delete(ctx, "drivers", "drivers")
+}
+
+// Index a zone's queued orders by ID, for a queue moved from the flat
+// layout. An entry that doesn't parse fails the migration.
+func indexQueue(ctx context.Context, client redis.UniversalClient, zone string) error {
+	entries, err := client.LRange(ctx, queueKey(zone), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		var order Order
+		if err := json.Unmarshal([]byte(entry), &order); err != nil || order.ID == "" {
+			return fmt.Errorf("pending order in zone %q doesn't parse: %s", zone, entry)
+		}
+		if err := client.HSetNX(ctx, queuedKey(zone), order.ID, entry).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+package main
+
+import _ "embed"
+
+// The OpenAPI document is the source of truth for request validation; see
+// shared/openapi
+//
+//go:embed openapi.json
+var openAPISpec []byte
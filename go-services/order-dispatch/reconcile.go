@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/foodo/shared/logging"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// OrderLedger is the API's record of every order, whether or not its events
+// reached order-dispatch. Reconciling against it recovers new_order and
+// delivered/cancelled events lost while the subscription was down.
+type OrderLedger interface {
+	// Unassigned returns orders still waiting for a driver
+	Unassigned(ctx context.Context) ([]Order, error)
+	// Finished returns the status of those of ids that are delivered or
+	// cancelled
+	Finished(ctx context.Context, ids []string) (map[string]string, error)
+}
+
+// PostgresOrderLedger reads the Order table. Orders are only considered
+// within window of being placed, and not until grace has passed, so an
+// event still on its way isn't handled twice.
+type PostgresOrderLedger struct {
+	pool   *pgxpool.Pool
+	window time.Duration
+	grace  time.Duration
+}
+
+// NewPostgresOrderLedger returns an OrderLedger on pool
+func NewPostgresOrderLedger(pool *pgxpool.Pool, window, grace time.Duration) *PostgresOrderLedger {
+	return &PostgresOrderLedger{pool: pool, window: window, grace: grace}
+}
+
+// Orders placed but not yet assigned. The API moves them through these
+// statuses before pickup; OrderTracking gets a driverId once one is
+// assigned.
+const selectUnassignedOrdersSQL = `
+SELECT o."id", o."orderNumber", o."restaurantId", o."userId", o."status",
+	COALESCE(o."deliveryAddress", ''), o."estimatedDeliveryTime", o."requirements",
+	r."name", r."zipCode", r."latitude", r."longitude"
+FROM "Order" o
+JOIN "Restaurant" r ON r."id" = o."restaurantId"
+LEFT JOIN "OrderTracking" t ON t."orderId" = o."id"
+WHERE o."status" IN ('pending', 'confirmed', 'preparing', 'ready')
+	AND t."driverId" IS NULL
+	AND o."createdAt" BETWEEN $1 AND $2
+ORDER BY o."createdAt"`
+
+const selectFinishedOrdersSQL = `
+SELECT "id", "status"
+FROM "Order"
+WHERE "id" = ANY($1) AND "status" IN ('delivered', 'cancelled')`
+
+func (l *PostgresOrderLedger) Unassigned(ctx context.Context) ([]Order, error) {
+	now := time.Now()
+	rows, err := l.pool.Query(ctx, selectUnassignedOrdersSQL, now.Add(-l.window), now.Add(-l.grace))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []Order
+	for rows.Next() {
+		var order Order
+		var eta *time.Time
+		var requirements []byte
+		restaurant := &OrderRestaurant{}
+		if err := rows.Scan(
+			&order.ID, &order.OrderNumber, &order.RestaurantID, &order.UserID, &order.Status,
+			&order.DeliveryAddress, &eta, &requirements,
+			&restaurant.Name, &restaurant.ZipCode, &restaurant.Latitude, &restaurant.Longitude,
+		); err != nil {
+			return nil, err
+		}
+		restaurant.ID = order.RestaurantID
+		order.Restaurant = restaurant
+		if eta != nil {
+			order.EstimatedDeliveryTime = *eta
+		}
+		if len(requirements) > 0 {
+			json.Unmarshal(requirements, &order.Requirements)
+		}
+		orders = append(orders, order)
+	}
+	return orders, rows.Err()
+}
+
+func (l *PostgresOrderLedger) Finished(ctx context.Context, ids []string) (map[string]string, error) {
+	finished := make(map[string]string)
+	if len(ids) == 0 {
+		return finished, nil
+	}
+	rows, err := l.pool.Query(ctx, selectFinishedOrdersSQL, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, status string
+		if err := rows.Scan(&id, &status); err != nil {
+			return nil, err
+		}
+		finished[id] = status
+	}
+	return finished, rows.Err()
+}
+
+// Bring Redis in line with the ledger: queue orders it never heard about,
+// and finish orders that were delivered or cancelled without it noticing.
+// Does nothing without a ledger.
+func (s *Server) reconcileOrders(ctx context.Context) error {
+	if s.Ledger == nil {
+		return nil
+	}
+
+	// Everything Redis already knows about
+	pending, err := s.Orders.List(ctx)
+	if err != nil {
+		return err
+	}
+	held, err := s.Orders.Held(ctx)
+	if err != nil {
+		return err
+	}
+	assignments, err := s.Assignments.List(ctx)
+	if err != nil {
+		return err
+	}
+	queued := make(map[string]bool, len(pending))
+	var known []string
+	for _, order := range pending {
+		queued[order.ID] = true
+		known = append(known, order.ID)
+	}
+	isHeld := make(map[string]bool, len(held))
+	for _, order := range held {
+		isHeld[order.ID] = true
+		known = append(known, order.ID)
+	}
+	restaurants := make(map[string]string, len(assignments))
+	for _, assignment := range assignments {
+		restaurants[assignment.OrderID] = assignment.RestaurantID
+		known = append(known, assignment.OrderID)
+	}
+
+	// Finish orders whose delivered or cancelled event was missed
+	finished, err := s.Ledger.Finished(ctx, known)
+	if err != nil {
+		return err
+	}
+	for id, status := range finished {
+		orderCtx := logging.WithOrderID(ctx, id)
+		switch {
+		case queued[id]:
+			s.Orders.Take(orderCtx, id)
+			s.Orders.ClearReceived(orderCtx, id)
+		case isHeld[id]:
+			s.Orders.TakeHeld(orderCtx, id)
+			s.Orders.ClearReceived(orderCtx, id)
+		default:
+			s.applyOrderStatus(orderCtx, OrderStatusUpdate{OrderID: id, Status: status, RestaurantID: restaurants[id]})
+		}
+		slog.InfoContext(orderCtx, "Reconciled finished order", "status", status)
+	}
+
+	// Queue orders whose new_order event was missed
+	unassigned, err := s.Ledger.Unassigned(ctx)
+	if err != nil {
+		return err
+	}
+	recovered := 0
+	for _, order := range unassigned {
+		if _, assigned := restaurants[order.ID]; assigned || queued[order.ID] || isHeld[order.ID] {
+			continue
+		}
+		orderCtx := logging.WithOrderID(ctx, order.ID)
+		order.ZoneID = s.Zones.ForOrder(order)
+		if err := s.Orders.Push(orderCtx, order); err != nil {
+			return err
+		}
+		s.Orders.MarkReceived(orderCtx, order.ID, time.Now())
+		slog.InfoContext(orderCtx, "Reconciled missed order", "zone_id", order.ZoneID)
+		recovered++
+	}
+
+	if len(finished) > 0 || recovered > 0 {
+		slog.InfoContext(ctx, "Reconciled orders with Postgres", "finished", len(finished), "recovered", recovered)
+	}
+	return nil
+}
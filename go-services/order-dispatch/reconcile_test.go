@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+)
+
+// fakeLedger stands in for the Order table
+type fakeLedger struct {
+	unassigned []Order
+	finished   map[string]string
+}
+
+func (l *fakeLedger) Unassigned(ctx context.Context) ([]Order, error) {
+	return l.unassigned, nil
+}
+
+func (l *fakeLedger) Finished(ctx context.Context, ids []string) (map[string]string, error) {
+	finished := make(map[string]string)
+	for _, id := range ids {
+		if status, ok := l.finished[id]; ok {
+			finished[id] = status
+		}
+	}
+	return finished, nil
+}
+
+func TestResyncReconcilesWithLedger(t *testing.T) {
+	ts := startTestService(t)
+	ctx := context.Background()
+
+	// Redis heard about these orders
+	ts.addDriver(t, Driver{ID: "driver-1", Status: "busy"})
+	ts.server.Assignments.Save(ctx, OrderAssignment{OrderID: "delivered", DriverID: "driver-1", AssignedAt: time.Now()}, Order{ID: "delivered"})
+	ts.server.Orders.Push(ctx, Order{ID: "cancelled"})
+	ts.server.Orders.Push(ctx, Order{ID: "queued"})
+
+	// Postgres has the rest of the story
+	ts.server.Ledger = &fakeLedger{
+		unassigned: []Order{{ID: "queued"}, {ID: "missed", RestaurantID: "restaurant-1"}},
+		finished:   map[string]string{"delivered": "delivered", "cancelled": "cancelled", "unknown": "delivered"},
+	}
+	if err := ts.server.resyncDispatchState(ctx); err != nil {
+		t.Fatalf("resync: %v", err)
+	}
+
+	var ids []string
+	for _, order := range ts.pendingOrders(t) {
+		ids = append(ids, order.ID)
+	}
+	sort.Strings(ids)
+	if len(ids) != 2 || ids[0] != "missed" || ids[1] != "queued" {
+		t.Fatalf("pending orders = %v, want missed and queued", ids)
+	}
+	if _, err := ts.server.Assignments.Get(ctx, "delivered"); err != ErrNotFound {
+		t.Fatalf("delivered order's assignment: err = %v, want ErrNotFound", err)
+	}
+	if status := ts.driver(t, "driver-1").Status; status != "available" {
+		t.Fatalf("driver status = %q, want available", status)
+	}
+
+	// A second pass changes nothing
+	if err := ts.server.resyncDispatchState(ctx); err != nil {
+		t.Fatalf("resync again: %v", err)
+	}
+	if orders := ts.pendingOrders(t); len(orders) != 2 {
+		t.Fatalf("pending orders after second resync = %v", orders)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Rebuild views that depend on events missed while the subscription was
+// down. Orders are first reconciled with Postgres, which saw every order
+// whether or not its events arrived. Then every connected driver gets a
+// fresh copy of its own record, its assignment and, if it's available, the
+// pending orders it could have been offered, chosen as handleNewOrder
+// chooses whom to offer an order to.
+func (s *Server) resyncDispatchState(ctx context.Context) error {
+	// Without Postgres the drivers still get what Redis holds
+	if err := s.reconcileOrders(ctx); err != nil {
+		slog.WarnContext(ctx, "Failed to reconcile orders with Postgres", "error", err)
+	}
+
+	pending, err := s.Orders.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, order := range pending {
+		// Start the queue-age clock for orders that arrived during the gap
+		s.Orders.MarkReceived(ctx, order.ID, time.Now())
+	}
+
+	drivers, err := s.Drivers.List(ctx)
+	if err != nil {
+		return err
+	}
+	driversByID := make(map[string]Driver, len(drivers))
+	for _, driver := range drivers {
+		driversByID[driver.ID] = driver
+	}
+
+	assignmentList, err := s.Assignments.List(ctx)
+	if err != nil {
+		return err
+	}
+	assignments := make(map[string]OrderAssignment, len(assignmentList))
+	for _, assignment := range assignmentList {
+		assignments[assignment.DriverID] = assignment
+	}
+
+	offers := make(map[string][]Order)
+	for _, order := range pending {
+		decision, err := s.zoneCandidates(ctx, order)
+		if err != nil {
+			return err
+		}
+		for _, candidate := range decision.Candidates {
+			if candidate.Eligible {
+				offers[candidate.DriverID] = append(offers[candidate.DriverID], order)
+			}
+		}
+	}
+
+	clients := s.Hub.Clients()
+	for _, client := range clients {
+		driverID := client.ID
+
+		driver := driversByID[driverID]
+		driver.ID = driverID
+
+		message := map[string]interface{}{
+			"type":   "state_sync",
+			"driver": driver,
+		}
+		if assignment, ok := assignments[driverID]; ok {
+			message["assignment"] = assignment
+		}
+		if driver.Status == "available" {
+			pendingOrders := offers[driverID]
+			if pendingOrders == nil {
+				pendingOrders = []Order{}
+			}
+			message["pendingOrders"] = pendingOrders
+		}
+		client.SendJSON(message)
+	}
+
+	slog.InfoContext(ctx, "Resynced dispatch state",
+		"pending_orders", len(pending),
+		"assignments", len(assignments),
+		"connected_drivers", len(clients),
+	)
+	return nil
+}
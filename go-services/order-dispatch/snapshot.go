@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/foodo/shared/config"
+	"github.com/go-redis/redis/v8"
+)
+
+// Snapshot file format, bumped when it changes incompatibly
+const snapshotVersion = 1
+
+// Reads of the dispatch state made before giving up on it settling
+const snapshotAttempts = 5
+
+// Snapshot is the dispatch state at one moment: who has which order, what
+// is still waiting, and where drivers and orders last were
+type Snapshot struct {
+	Version int       `json:"version"`
+	TakenAt time.Time `json:"takenAt"`
+	Drivers []Driver  `json:"drivers"`
+	// Pending orders grouped by zone, each zone in queue order
+	Pending     []Order              `json:"pending"`
+	Held        []Order              `json:"held"`
+	Assignments []SnapshotAssignment `json:"assignments"`
+	Locations   []SnapshotLocation   `json:"locations"`
+}
+
+// SnapshotAssignment is an assignment with the order it was made for
+type SnapshotAssignment struct {
+	OrderAssignment
+	Order Order `json:"order"`
+}
+
+// SnapshotLocation is the last known location of a driver or an assigned
+// order, as location-tracker stored it
+type SnapshotLocation struct {
+	Kind      string          `json:"kind"`
+	ID        string          `json:"id"`
+	Location  json.RawMessage `json:"location"`
+	ExpiresAt *time.Time      `json:"expiresAt,omitempty"`
+}
+
+// The flags selecting a snapshot command
+var snapshotFlags = []config.Flag{
+	{Name: "snapshot-export", Key: "SNAPSHOT_EXPORT", Usage: "Write a dispatch snapshot to this file (- for stdout) and exit"},
+	{Name: "snapshot-import", Key: "SNAPSHOT_IMPORT", Usage: "Diff a dispatch snapshot file against Redis and exit"},
+	{Name: "snapshot-apply", Key: "SNAPSHOT_APPLY", Usage: "Restore the imported snapshot into an empty Redis (true/false)"},
+	{Name: "snapshot-backup-dir", Key: "SNAPSHOT_BACKUP_DIR", Usage: "Write dispatch snapshots to this directory on a schedule instead of serving"},
+}
+
+// The snapshot command selected by configuration, or nil to serve as usual
+func (s *Server) snapshotCommand() func(ctx context.Context) error {
+	switch {
+	case s.Config.String("SNAPSHOT_EXPORT", "") != "":
+		return func(ctx context.Context) error {
+			return s.exportSnapshot(ctx, s.Config.String("SNAPSHOT_EXPORT", ""))
+		}
+	case s.Config.String("SNAPSHOT_IMPORT", "") != "":
+		return func(ctx context.Context) error {
+			return s.importSnapshot(ctx, s.Config.String("SNAPSHOT_IMPORT", ""), s.Config.Bool("SNAPSHOT_APPLY", false))
+		}
+	case s.Config.String("SNAPSHOT_BACKUP_DIR", "") != "":
+		return func(ctx context.Context) error {
+			return s.backupSnapshots(ctx, s.Config.String("SNAPSHOT_BACKUP_DIR", ""))
+		}
+	}
+	return nil
+}
+
+// Write a snapshot to path, or to stdout for "-"
+func (s *Server) exportSnapshot(ctx context.Context, path string) error {
+	snapshot, err := s.takeSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	if path == "-" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(snapshot)
+	}
+	if err := writeSnapshotFile(path, snapshot); err != nil {
+		return err
+	}
+	snapshot.log("Snapshot exported", "path", path)
+	return nil
+}
+
+// Print how the snapshot at path differs from Redis. With apply, restore it,
+// which is only allowed into a Redis without dispatch state or one left
+// part-way through restoring the same snapshot.
+func (s *Server) importSnapshot(ctx context.Context, path string, apply bool) error {
+	snapshot, err := readSnapshotFile(path)
+	if err != nil {
+		return err
+	}
+	current, err := s.takeSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+
+	changes := diffSnapshots(current, snapshot)
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	if !apply {
+		slog.Info("Dry run, nothing restored; set SNAPSHOT_APPLY=true to restore", "changes", len(changes))
+		return nil
+	}
+
+	// The marker outlives a failed restore, so running it again picks up
+	// where it stopped instead of finding Redis no longer empty
+	restoring, err := s.Redis.Get(ctx, snapshotRestoreKey).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+	if !current.empty() && restoring != snapshot.restoreID() {
+		return errors.New("redis already holds dispatch state; a snapshot can only be restored into an empty Redis")
+	}
+	if err := s.Redis.Set(ctx, snapshotRestoreKey, snapshot.restoreID(), 0).Err(); err != nil {
+		return err
+	}
+	if err := s.restoreSnapshot(ctx, snapshot); err != nil {
+		return fmt.Errorf("%w; run the import again to finish restoring", err)
+	}
+	if err := s.Redis.Del(ctx, snapshotRestoreKey).Err(); err != nil {
+		return err
+	}
+	snapshot.log("Snapshot restored", "path", path)
+	return nil
+}
+
+// Write a snapshot to dir every SNAPSHOT_BACKUP_INTERVAL until interrupted,
+// keeping the newest SNAPSHOT_BACKUP_KEEP
+func (s *Server) backupSnapshots(ctx context.Context, dir string) error {
+	interval := s.Config.Duration("SNAPSHOT_BACKUP_INTERVAL", time.Hour)
+	keep := s.Config.Int("SNAPSHOT_BACKUP_KEEP", 24)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	slog.Info("Writing snapshot backups", "dir", dir, "interval", interval, "keep", keep)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.writeBackup(ctx, dir, keep); err != nil && ctx.Err() == nil {
+			slog.Warn("Failed to write snapshot backup", "error", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (s *Server) writeBackup(ctx context.Context, dir string, keep int) error {
+	snapshot, err := s.takeSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "dispatch-"+snapshot.TakenAt.Format("20060102T150405Z")+".json")
+	if err := writeSnapshotFile(path, snapshot); err != nil {
+		return err
+	}
+	snapshot.log("Snapshot written", "path", path)
+
+	// The timestamped names sort oldest first
+	backups, err := filepath.Glob(filepath.Join(dir, "dispatch-*.json"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(backups)
+	for len(backups) > keep {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// Read the dispatch state until two reads in a row agree on which orders
+// are pending, held and assigned to whom, so no order is caught moving
+// between them. That's all the consistency there is: each read is many
+// commands across slots rather than one MULTI, only the fingerprint is
+// compared, and the second read is the one kept, so driver positions and
+// order details may be newer than the fingerprint, and an order that moved
+// and moved back between reads isn't noticed.
+func (s *Server) takeSnapshot(ctx context.Context) (*Snapshot, error) {
+	previous, err := s.readSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 1; attempt < snapshotAttempts; attempt++ {
+		current, err := s.readSnapshot(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if current.fingerprint() == previous.fingerprint() {
+			return current, nil
+		}
+		previous = current
+	}
+	return nil, errors.New("dispatch state kept changing while it was read")
+}
+
+func (s *Server) readSnapshot(ctx context.Context) (*Snapshot, error) {
+	snapshot := &Snapshot{Version: snapshotVersion, TakenAt: time.Now().UTC()}
+
+	var err error
+	if snapshot.Drivers, err = s.Drivers.List(ctx); err != nil {
+		return nil, err
+	}
+	sort.Slice(snapshot.Drivers, func(i, j int) bool { return snapshot.Drivers[i].ID < snapshot.Drivers[j].ID })
+
+	if snapshot.Pending, err = s.Orders.List(ctx); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(snapshot.Pending, func(i, j int) bool { return snapshot.Pending[i].ZoneID < snapshot.Pending[j].ZoneID })
+
+	if snapshot.Held, err = s.Orders.Held(ctx); err != nil {
+		return nil, err
+	}
+	sort.Slice(snapshot.Held, func(i, j int) bool { return snapshot.Held[i].ID < snapshot.Held[j].ID })
+
+	assignments, err := s.Assignments.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(assignments, func(i, j int) bool { return assignments[i].OrderID < assignments[j].OrderID })
+	for _, assignment := range assignments {
+		order, err := s.Assignments.Order(ctx, assignment.OrderID)
+		if errors.Is(err, ErrNotFound) {
+			order = Order{ID: assignment.OrderID, RestaurantID: assignment.RestaurantID}
+		} else if err != nil {
+			return nil, err
+		}
+		snapshot.Assignments = append(snapshot.Assignments, SnapshotAssignment{OrderAssignment: assignment, Order: order})
+	}
+
+	// Locations are only in Redis
+	if s.Locations == nil {
+		return snapshot, nil
+	}
+	driverIDs := make([]string, len(snapshot.Drivers))
+	for i, driver := range snapshot.Drivers {
+		driverIDs[i] = driver.ID
+	}
+	orderIDs := make([]string, len(snapshot.Assignments))
+	for i, assignment := range snapshot.Assignments {
+		orderIDs[i] = assignment.OrderID
+	}
+	for kind, ids := range map[string][]string{"driver": driverIDs, "order": orderIDs} {
+		locations, err := s.Locations.Read(ctx, kind, ids)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Locations = append(snapshot.Locations, locations...)
+	}
+	sort.Slice(snapshot.Locations, func(i, j int) bool {
+		a, b := snapshot.Locations[i], snapshot.Locations[j]
+		return a.Kind < b.Kind || a.Kind == b.Kind && a.ID < b.ID
+	})
+	return snapshot, nil
+}
+
+// RedisLocations reads and writes the last known locations location-tracker
+// keeps in Redis
+type RedisLocations struct {
+	client redis.UniversalClient
+}
+
+func NewRedisLocations(client redis.UniversalClient) *RedisLocations {
+	return &RedisLocations{client: client}
+}
+
+// Read the locations of the drivers or orders with ids, skipping those
+// without one
+func (l *RedisLocations) Read(ctx context.Context, kind string, ids []string) ([]SnapshotLocation, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	pipe := l.client.Pipeline()
+	gets := make([]*redis.StringCmd, len(ids))
+	ttls := make([]*redis.DurationCmd, len(ids))
+	for i, id := range ids {
+		gets[i] = pipe.Get(ctx, locationKey(kind, id))
+		ttls[i] = pipe.PTTL(ctx, locationKey(kind, id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	var locations []SnapshotLocation
+	for i, id := range ids {
+		locationJSON, err := gets[i].Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		location := SnapshotLocation{Kind: kind, ID: id, Location: json.RawMessage(locationJSON)}
+		if ttl := ttls[i].Val(); ttl > 0 {
+			expiresAt := time.Now().Add(ttl).UTC()
+			location.ExpiresAt = &expiresAt
+		}
+		locations = append(locations, location)
+	}
+	return locations, nil
+}
+
+// Write a snapshot into the stores. Arrival times aren't kept, so restored
+// orders count as arriving when the snapshot was taken. Every step can be
+// repeated, so a restore that failed part-way can be run again: records are
+// overwritten, and an order already queued or held isn't queued again.
+func (s *Server) restoreSnapshot(ctx context.Context, snapshot *Snapshot) error {
+	for _, driver := range snapshot.Drivers {
+		if err := s.Drivers.Save(ctx, driver); err != nil {
+			return err
+		}
+	}
+	for _, order := range append(snapshot.Pending, snapshot.Held...) {
+		if err := s.Orders.Push(ctx, order); err != nil {
+			return err
+		}
+		if err := s.Orders.MarkReceived(ctx, order.ID, snapshot.TakenAt); err != nil {
+			return err
+		}
+	}
+	for _, order := range snapshot.Held {
+		// Not found after the push means it was held by an earlier attempt
+		if err := s.Orders.Hold(ctx, order.ID); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	for _, assignment := range snapshot.Assignments {
+		if err := s.Assignments.Save(ctx, assignment.OrderAssignment, assignment.Order); err != nil {
+			return err
+		}
+	}
+
+	if s.Locations == nil {
+		return nil
+	}
+	for _, location := range snapshot.Locations {
+		if err := s.Locations.Write(ctx, location); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write a location back with the time it had left, unless it has expired
+// since
+func (l *RedisLocations) Write(ctx context.Context, location SnapshotLocation) error {
+	var ttl time.Duration
+	if location.ExpiresAt != nil {
+		if ttl = time.Until(*location.ExpiresAt); ttl <= 0 {
+			return nil
+		}
+	}
+	return l.client.Set(ctx, locationKey(location.Kind, location.ID), []byte(location.Location), ttl).Err()
+}
+
+// What the restore marker holds while this snapshot is being restored
+func (snapshot *Snapshot) restoreID() string {
+	return snapshot.TakenAt.Format(time.RFC3339Nano)
+}
+
+// Whether there is no dispatch state at all
+func (snapshot *Snapshot) empty() bool {
+	return len(snapshot.Drivers) == 0 && len(snapshot.Pending) == 0 && len(snapshot.Held) == 0 && len(snapshot.Assignments) == 0
+}
+
+// Where each driver and order stands, without positions
+func (snapshot *Snapshot) fingerprint() string {
+	var b strings.Builder
+	for _, driver := range snapshot.Drivers {
+		fmt.Fprintf(&b, "driver %s %s %s\n", driver.ID, driver.Status, driver.ZoneID)
+	}
+	for _, order := range snapshot.Pending {
+		fmt.Fprintf(&b, "pending %s %s\n", order.ID, order.ZoneID)
+	}
+	for _, order := range snapshot.Held {
+		fmt.Fprintf(&b, "held %s\n", order.ID)
+	}
+	for _, assignment := range snapshot.Assignments {
+		fmt.Fprintf(&b, "assigned %s %s\n", assignment.OrderID, assignment.DriverID)
+	}
+	return b.String()
+}
+
+func (snapshot *Snapshot) log(msg string, args ...any) {
+	slog.Info(msg, append(args,
+		"taken_at", snapshot.TakenAt,
+		"drivers", len(snapshot.Drivers),
+		"pending", len(snapshot.Pending),
+		"held", len(snapshot.Held),
+		"assignments", len(snapshot.Assignments),
+		"locations", len(snapshot.Locations),
+	)...)
+}
+
+// The changes restoring next over current would make, one per line: "+" for
+// a record only in next, "-" for one only in current and "~" for one in both
+// that differs
+func diffSnapshots(current, next *Snapshot) []string {
+	from, to := current.records(), next.records()
+	var changes []string
+	for _, family := range snapshotFamilies {
+		ids := make([]string, 0, len(from[family])+len(to[family]))
+		for id := range from[family] {
+			ids = append(ids, id)
+		}
+		for id := range to[family] {
+			if _, ok := from[family][id]; !ok {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			was, inCurrent := from[family][id]
+			will, inNext := to[family][id]
+			switch {
+			case !inCurrent:
+				changes = append(changes, "+ "+family+" "+id)
+			case !inNext:
+				changes = append(changes, "- "+family+" "+id)
+			case was != will:
+				changes = append(changes, "~ "+family+" "+id)
+			}
+		}
+	}
+	return changes
+}
+
+// The record families in a snapshot, in the order diffs list them
+var snapshotFamilies = []string{"driver", "pending order", "held order", "assignment", "location"}
+
+// Each family's records as JSON, by ID
+func (snapshot *Snapshot) records() map[string]map[string]string {
+	records := make(map[string]map[string]string, len(snapshotFamilies))
+	for _, family := range snapshotFamilies {
+		records[family] = make(map[string]string)
+	}
+	add := func(family, id string, record any) {
+		recordJSON, _ := json.Marshal(record)
+		records[family][id] = string(recordJSON)
+	}
+	for _, driver := range snapshot.Drivers {
+		add("driver", driver.ID, driver)
+	}
+	for _, order := range snapshot.Pending {
+		add("pending order", order.ID, order)
+	}
+	for _, order := range snapshot.Held {
+		add("held order", order.ID, order)
+	}
+	for _, assignment := range snapshot.Assignments {
+		add("assignment", assignment.OrderID, assignment)
+	}
+	for _, location := range snapshot.Locations {
+		add("location", location.Kind+" "+location.ID, location.Location)
+	}
+	return records
+}
+
+func readSnapshotFile(path string) (*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if snapshot.Version != snapshotVersion {
+		return nil, fmt.Errorf("%s: unsupported snapshot version %d", path, snapshot.Version)
+	}
+	return &snapshot, nil
+}
+
+// Write a snapshot through a temporary file, so a reader never sees half of
+// one
+func writeSnapshotFile(path string, snapshot *Snapshot) error {
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A restore that stopped part-way can be run again, and only then does it
+// write over dispatch state
+func TestRestoreSnapshotCanBeRetried(t *testing.T) {
+	ts := startTestService(t)
+	s := ts.server
+	ctx := context.Background()
+
+	driver := Driver{ID: "driver-1", Status: "busy", ZoneID: "north"}
+	pending := Order{ID: "order-1", ZoneID: "north"}
+	held := Order{ID: "order-2", ZoneID: "north"}
+	assigned := Order{ID: "order-3", ZoneID: "north"}
+	if err := s.Drivers.Save(ctx, driver); err != nil {
+		t.Fatal(err)
+	}
+	for _, order := range []Order{pending, held} {
+		if err := s.Orders.Push(ctx, order); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Orders.Hold(ctx, held.ID); err != nil {
+		t.Fatal(err)
+	}
+	assignment := OrderAssignment{OrderID: assigned.ID, DriverID: driver.ID, AssignedAt: time.Now().UTC()}
+	if err := s.Assignments.Save(ctx, assignment, assigned); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := s.takeSnapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "dispatch.json")
+	if err := writeSnapshotFile(path, snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restore that got as far as the driver and queueing the held order
+	redisClient.FlushAll(ctx)
+	redisClient.Set(ctx, snapshotRestoreKey, snapshot.restoreID(), 0)
+	s.Drivers.Save(ctx, driver)
+	s.Orders.Push(ctx, held)
+
+	if err := s.importSnapshot(ctx, path, true); err != nil {
+		t.Fatalf("retried restore: %v", err)
+	}
+	restored, err := s.takeSnapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.fingerprint() != snapshot.fingerprint() {
+		t.Fatalf("restored state:\n%s\nwant:\n%s", restored.fingerprint(), snapshot.fingerprint())
+	}
+	if n := redisClient.Exists(ctx, snapshotRestoreKey).Val(); n != 0 {
+		t.Error("restore marker left behind")
+	}
+
+	// Finished, the same snapshot no longer goes over what's there
+	if err := s.importSnapshot(ctx, path, true); err == nil {
+		t.Fatal("restored over existing dispatch state")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned by the stores when a record doesn't exist
+var ErrNotFound = errors.New("not found")
+
+// DriverStore holds driver records
+type DriverStore interface {
+	Get(ctx context.Context, id string) (Driver, error)
+	List(ctx context.Context) ([]Driver, error)
+	// ListZone returns the drivers in a zone, or the unzoned drivers for ""
+	ListZone(ctx context.Context, zone string) ([]Driver, error)
+	// Save writes a driver and marks it as seen now
+	Save(ctx context.Context, driver Driver) error
+	// Idle returns the IDs of drivers not saved since before
+	Idle(ctx context.Context, before time.Time) ([]string, error)
+	// DeleteIdle removes a driver unless it has been saved since before,
+	// reporting whether it did
+	DeleteIdle(ctx context.Context, id string, before time.Time) (bool, error)
+}
+
+// OrderQueue holds orders waiting for a driver, in arrival order, and orders
+// an operator has put on hold. Each zone has its own queue, picked by the
+// order's ZoneID. It also remembers when each order arrived so queue time
+// can be measured.
+type OrderQueue interface {
+	// Push adds an order to the back of its zone's queue, unless it's
+	// already queued or held
+	Push(ctx context.Context, order Order) error
+	// Requeue puts an order back at the front of its zone's queue, unless
+	// it's already queued or held
+	Requeue(ctx context.Context, order Order) error
+	// List returns every zone's pending orders
+	List(ctx context.Context) ([]Order, error)
+	// ListZone returns one zone's pending orders, or the unzoned ones for ""
+	ListZone(ctx context.Context, zone string) ([]Order, error)
+	// Len counts every zone's pending orders
+	Len(ctx context.Context) (int64, error)
+	// Take removes a pending order, failing with ErrNotFound if another
+	// caller got there first
+	Take(ctx context.Context, id string) (Order, error)
+
+	// Hold moves a pending order out of the queue
+	Hold(ctx context.Context, id string) error
+	// Release returns a held order to the front of the queue
+	Release(ctx context.Context, id string) (Order, error)
+	// TakeHeld removes a held order
+	TakeHeld(ctx context.Context, id string) (Order, error)
+	Held(ctx context.Context) ([]Order, error)
+
+	// MarkReceived records when an order arrived, unless it already has been
+	MarkReceived(ctx context.Context, id string, at time.Time) error
+	// ClearReceived forgets an order's arrival time and returns it
+	ClearReceived(ctx context.Context, id string) (time.Time, error)
+	// OldestReceived returns the earliest recorded arrival, or the zero time
+	OldestReceived(ctx context.Context) (time.Time, error)
+}
+
+// AssignmentStore holds active assignments along with the order each was
+// made for, so a cancelled assignment's order can be requeued
+type AssignmentStore interface {
+	Save(ctx context.Context, assignment OrderAssignment, order Order) error
+	Get(ctx context.Context, orderID string) (OrderAssignment, error)
+	List(ctx context.Context) ([]OrderAssignment, error)
+	// Order returns the order saved with an assignment
+	Order(ctx context.Context, orderID string) (Order, error)
+	// Remove deletes an assignment and returns it with its order. The order
+	// has only its ID if it wasn't saved with the assignment.
+	Remove(ctx context.Context, orderID string) (OrderAssignment, Order, error)
+}
+
+// DecisionLog holds the dispatch decisions made for each order
+type DecisionLog interface {
+	Record(ctx context.Context, decision DispatchDecision) error
+	// List returns an order's decisions, oldest first
+	List(ctx context.Context, orderID string) ([]DispatchDecision, error)
+}
+
+// AuditLog holds the actions taken through the admin API
+type AuditLog interface {
+	// Record appends an action, giving it an ID
+	Record(ctx context.Context, action AdminAction) error
+	// List returns up to limit actions, newest first, starting after the
+	// action with ID before, or with the newest if before is ""
+	List(ctx context.Context, before string, limit int) ([]AdminAction, error)
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryDriverStore is a DriverStore held in process memory
+type MemoryDriverStore struct {
+	mu       sync.Mutex
+	drivers  map[string]Driver
+	lastSeen map[string]time.Time
+}
+
+// NewMemoryDriverStore returns an empty MemoryDriverStore
+func NewMemoryDriverStore() *MemoryDriverStore {
+	return &MemoryDriverStore{
+		drivers:  make(map[string]Driver),
+		lastSeen: make(map[string]time.Time),
+	}
+}
+
+func (s *MemoryDriverStore) Get(ctx context.Context, id string) (Driver, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	driver, ok := s.drivers[id]
+	if !ok {
+		return Driver{}, ErrNotFound
+	}
+	return driver, nil
+}
+
+func (s *MemoryDriverStore) List(ctx context.Context) ([]Driver, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	drivers := make([]Driver, 0, len(s.drivers))
+	for _, driver := range s.drivers {
+		drivers = append(drivers, driver)
+	}
+	return drivers, nil
+}
+
+func (s *MemoryDriverStore) ListZone(ctx context.Context, zone string) ([]Driver, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var drivers []Driver
+	for _, driver := range s.drivers {
+		if driver.ZoneID == zone {
+			drivers = append(drivers, driver)
+		}
+	}
+	return drivers, nil
+}
+
+func (s *MemoryDriverStore) Save(ctx context.Context, driver Driver) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drivers[driver.ID] = driver
+	s.lastSeen[driver.ID] = time.Now()
+	return nil
+}
+
+func (s *MemoryDriverStore) Idle(ctx context.Context, before time.Time) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for id, seen := range s.lastSeen {
+		if seen.Before(before) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (s *MemoryDriverStore) DeleteIdle(ctx context.Context, id string, before time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen, ok := s.lastSeen[id]
+	if !ok || !seen.Before(before) {
+		return false, nil
+	}
+	delete(s.drivers, id)
+	delete(s.lastSeen, id)
+	return true, nil
+}
+
+// MemoryOrderQueue is an OrderQueue held in process memory
+type MemoryOrderQueue struct {
+	mu         sync.Mutex
+	pending    []Order
+	held       map[string]Order
+	receivedAt map[string]time.Time
+}
+
+// NewMemoryOrderQueue returns an empty MemoryOrderQueue
+func NewMemoryOrderQueue() *MemoryOrderQueue {
+	return &MemoryOrderQueue{
+		held:       make(map[string]Order),
+		receivedAt: make(map[string]time.Time),
+	}
+}
+
+func (q *MemoryOrderQueue) Push(ctx context.Context, order Order) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.hasLocked(order.ID) {
+		q.pending = append(q.pending, order)
+	}
+	return nil
+}
+
+func (q *MemoryOrderQueue) Requeue(ctx context.Context, order Order) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.hasLocked(order.ID) {
+		q.pending = append([]Order{order}, q.pending...)
+	}
+	return nil
+}
+
+func (q *MemoryOrderQueue) List(ctx context.Context) ([]Order, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]Order{}, q.pending...), nil
+}
+
+func (q *MemoryOrderQueue) ListZone(ctx context.Context, zone string) ([]Order, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	orders := []Order{}
+	for _, order := range q.pending {
+		if order.ZoneID == zone {
+			orders = append(orders, order)
+		}
+	}
+	return orders, nil
+}
+
+func (q *MemoryOrderQueue) Len(ctx context.Context) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return int64(len(q.pending)), nil
+}
+
+func (q *MemoryOrderQueue) Take(ctx context.Context, id string) (Order, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.takeLocked(id)
+}
+
+func (q *MemoryOrderQueue) Hold(ctx context.Context, id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	order, err := q.takeLocked(id)
+	if err != nil {
+		return err
+	}
+	q.held[id] = order
+	return nil
+}
+
+func (q *MemoryOrderQueue) Release(ctx context.Context, id string) (Order, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	order, ok := q.held[id]
+	if !ok {
+		return Order{}, ErrNotFound
+	}
+	delete(q.held, id)
+	q.pending = append([]Order{order}, q.pending...)
+	return order, nil
+}
+
+func (q *MemoryOrderQueue) TakeHeld(ctx context.Context, id string) (Order, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	order, ok := q.held[id]
+	if !ok {
+		return Order{}, ErrNotFound
+	}
+	delete(q.held, id)
+	return order, nil
+}
+
+func (q *MemoryOrderQueue) Held(ctx context.Context) ([]Order, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	orders := make([]Order, 0, len(q.held))
+	for _, order := range q.held {
+		orders = append(orders, order)
+	}
+	return orders, nil
+}
+
+func (q *MemoryOrderQueue) MarkReceived(ctx context.Context, id string, at time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.receivedAt[id]; !ok {
+		q.receivedAt[id] = at
+	}
+	return nil
+}
+
+func (q *MemoryOrderQueue) ClearReceived(ctx context.Context, id string) (time.Time, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	at, ok := q.receivedAt[id]
+	if !ok {
+		return time.Time{}, ErrNotFound
+	}
+	delete(q.receivedAt, id)
+	return at, nil
+}
+
+func (q *MemoryOrderQueue) OldestReceived(ctx context.Context) (time.Time, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var oldest time.Time
+	for _, at := range q.receivedAt {
+		if oldest.IsZero() || at.Before(oldest) {
+			oldest = at
+		}
+	}
+	return oldest, nil
+}
+
+// Whether an order is queued or held
+func (q *MemoryOrderQueue) hasLocked(id string) bool {
+	if _, ok := q.held[id]; ok {
+		return true
+	}
+	for _, order := range q.pending {
+		if order.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *MemoryOrderQueue) takeLocked(id string) (Order, error) {
+	for i, order := range q.pending {
+		if order.ID == id {
+			q.pending = append(q.pending[:i:i], q.pending[i+1:]...)
+			return order, nil
+		}
+	}
+	return Order{}, ErrNotFound
+}
+
+// MemoryAssignmentStore is an AssignmentStore held in process memory
+type MemoryAssignmentStore struct {
+	mu          sync.Mutex
+	assignments map[string]OrderAssignment
+	orders      map[string]Order
+}
+
+// NewMemoryAssignmentStore returns an empty MemoryAssignmentStore
+func NewMemoryAssignmentStore() *MemoryAssignmentStore {
+	return &MemoryAssignmentStore{
+		assignments: make(map[string]OrderAssignment),
+		orders:      make(map[string]Order),
+	}
+}
+
+func (s *MemoryAssignmentStore) Save(ctx context.Context, assignment OrderAssignment, order Order) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.assignments[assignment.OrderID] = assignment
+	s.orders[assignment.OrderID] = order
+	return nil
+}
+
+func (s *MemoryAssignmentStore) Get(ctx context.Context, orderID string) (OrderAssignment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assignment, ok := s.assignments[orderID]
+	if !ok {
+		return OrderAssignment{}, ErrNotFound
+	}
+	return assignment, nil
+}
+
+func (s *MemoryAssignmentStore) List(ctx context.Context) ([]OrderAssignment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assignments := make([]OrderAssignment, 0, len(s.assignments))
+	for _, assignment := range s.assignments {
+		assignments = append(assignments, assignment)
+	}
+	return assignments, nil
+}
+
+func (s *MemoryAssignmentStore) Order(ctx context.Context, orderID string) (Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	order, ok := s.orders[orderID]
+	if !ok {
+		return Order{}, ErrNotFound
+	}
+	return order, nil
+}
+
+func (s *MemoryAssignmentStore) Remove(ctx context.Context, orderID string) (OrderAssignment, Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assignment, ok := s.assignments[orderID]
+	if !ok {
+		return OrderAssignment{}, Order{}, ErrNotFound
+	}
+	order, ok := s.orders[orderID]
+	if !ok {
+		order = Order{ID: orderID, RestaurantID: assignment.RestaurantID}
+	}
+	delete(s.assignments, orderID)
+	delete(s.orders, orderID)
+	return assignment, order, nil
+}
+
+// MemoryDecisionLog is a DecisionLog held in process memory. Decisions
+// don't expire.
+type MemoryDecisionLog struct {
+	mu        sync.Mutex
+	decisions map[string][]DispatchDecision
+}
+
+// NewMemoryDecisionLog returns an empty MemoryDecisionLog
+func NewMemoryDecisionLog() *MemoryDecisionLog {
+	return &MemoryDecisionLog{decisions: make(map[string][]DispatchDecision)}
+}
+
+func (l *MemoryDecisionLog) Record(ctx context.Context, decision DispatchDecision) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.decisions[decision.OrderID] = append(l.decisions[decision.OrderID], decision)
+	return nil
+}
+
+func (l *MemoryDecisionLog) List(ctx context.Context, orderID string) ([]DispatchDecision, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]DispatchDecision{}, l.decisions[orderID]...), nil
+}
+
+// MemoryAuditLog is an AuditLog held in process memory, oldest first. IDs
+// are positions in the log, shaped like stream entry IDs.
+type MemoryAuditLog struct {
+	mu      sync.Mutex
+	actions []AdminAction
+}
+
+// NewMemoryAuditLog returns an empty MemoryAuditLog
+func NewMemoryAuditLog() *MemoryAuditLog {
+	return &MemoryAuditLog{}
+}
+
+func (l *MemoryAuditLog) Record(ctx context.Context, action AdminAction) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	action.ID = strconv.Itoa(len(l.actions)+1) + "-0"
+	l.actions = append(l.actions, action)
+	return nil
+}
+
+func (l *MemoryAuditLog) List(ctx context.Context, before string, limit int) ([]AdminAction, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	end := len(l.actions)
+	if before != "" {
+		position, err := strconv.Atoi(strings.TrimSuffix(before, "-0"))
+		if err != nil {
+			return nil, err
+		}
+		end = min(max(position-1, 0), end)
+	}
+	actions := make([]AdminAction, 0, min(limit, end))
+	for i := end - 1; i >= 0 && len(actions) < limit; i-- {
+		actions = append(actions, l.actions[i])
+	}
+	return actions, nil
+}
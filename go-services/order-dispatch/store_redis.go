@@ -0,0 +1,642 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisDriverStore keeps each driver's record and when it was last saved in
+// the driver's own slot, so saves from across the fleet spread over the
+// cluster. Each zone's drivers are indexed in a driverZoneKey set, and the
+// zones with drivers in driverZonesKey. Both indexes are only written when a
+// driver is new or changes zone.
+type RedisDriverStore struct {
+	client redis.UniversalClient
+}
+
+// NewRedisDriverStore returns a DriverStore backed by client
+func NewRedisDriverStore(client redis.UniversalClient) *RedisDriverStore {
+	return &RedisDriverStore{client: client}
+}
+
+func (s *RedisDriverStore) Get(ctx context.Context, id string) (Driver, error) {
+	var driver Driver
+	driverJSON, err := s.client.Get(ctx, driverKey(id)).Result()
+	if err != nil {
+		return driver, notFound(err)
+	}
+	if err := json.Unmarshal([]byte(driverJSON), &driver); err != nil {
+		return driver, err
+	}
+	driver.ID = id
+	return driver, nil
+}
+
+func (s *RedisDriverStore) List(ctx context.Context) ([]Driver, error) {
+	zones, err := s.zones(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var drivers []Driver
+	for _, zone := range zones {
+		zoneDrivers, err := s.ListZone(ctx, zone)
+		if err != nil {
+			return nil, err
+		}
+		drivers = append(drivers, zoneDrivers...)
+	}
+	return drivers, nil
+}
+
+// Drivers that moved zone or were removed are left in their old index until
+// it's next read
+func (s *RedisDriverStore) ListZone(ctx context.Context, zone string) ([]Driver, error) {
+	index := driverZoneKey(zone)
+	ids, err := s.client.SMembers(ctx, index).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	// The records are in as many slots as there are drivers
+	pipe := s.client.Pipeline()
+	gets := make([]*redis.StringCmd, len(ids))
+	for i, id := range ids {
+		gets[i] = pipe.Get(ctx, driverKey(id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	drivers := make([]Driver, 0, len(ids))
+	var moved []interface{}
+	for i, get := range gets {
+		var driver Driver
+		driverJSON, err := get.Result()
+		if errors.Is(err, redis.Nil) || err == nil && (json.Unmarshal([]byte(driverJSON), &driver) != nil || driver.ZoneID != zone) {
+			moved = append(moved, ids[i])
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		driver.ID = ids[i]
+		drivers = append(drivers, driver)
+	}
+	if len(moved) > 0 {
+		s.client.SRem(ctx, index, moved...)
+	}
+	return drivers, nil
+}
+
+// Save writes the record, then indexes the driver under its zone if it
+// isn't already. driverIndexedZoneKey remembers the zone the driver was last
+// indexed under, so an index write that failed, or lost a race with a
+// ListZone cleaning up after a move, is made again on the next save.
+func (s *RedisDriverStore) Save(ctx context.Context, driver Driver) error {
+	driverJSON, _ := json.Marshal(driver)
+	var indexed *redis.StringCmd
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, driverKey(driver.ID), driverJSON, 0)
+		pipe.Set(ctx, driverLastSeenKey(driver.ID), time.Now().UnixMilli(), 0)
+		indexed = pipe.Get(ctx, driverIndexedZoneKey(driver.ID))
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+	if zone, err := indexed.Result(); err == nil && zone == driver.ZoneID {
+		return nil
+	}
+
+	pipe := s.client.Pipeline()
+	pipe.SAdd(ctx, driverZoneKey(driver.ZoneID), driver.ID)
+	pipe.SAdd(ctx, driverZonesKey, driver.ZoneID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	return s.client.Set(ctx, driverIndexedZoneKey(driver.ID), driver.ZoneID, 0).Err()
+}
+
+func (s *RedisDriverStore) Idle(ctx context.Context, before time.Time) ([]string, error) {
+	zones, err := s.zones(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var idle []string
+	for _, zone := range zones {
+		ids, err := s.client.SMembers(ctx, driverZoneKey(zone)).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		pipe := s.client.Pipeline()
+		seen := make([]*redis.StringCmd, len(ids))
+		for i, id := range ids {
+			seen[i] = pipe.Get(ctx, driverLastSeenKey(id))
+		}
+		if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+			return nil, err
+		}
+		for i, id := range ids {
+			// Drivers without a last seen time were removed, or saved
+			// by a tool that doesn't set one; neither is idle yet
+			ms, err := seen[i].Int64()
+			if err == nil && ms < before.UnixMilli() {
+				idle = append(idle, id)
+			}
+		}
+	}
+	return idle, nil
+}
+
+// Delete a driver's record (KEYS[1]), last seen time (KEYS[2]) and indexed
+// zone (KEYS[3]) only if the time is still older than ARGV[1]
+var deleteIdleDriver = redis.NewScript(`
+local seen = redis.call("GET", KEYS[2])
+if seen and tonumber(seen) >= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call("DEL", KEYS[1], KEYS[2], KEYS[3])
+return 1
+`)
+
+// The driver is left in its zone index until the index is next read
+func (s *RedisDriverStore) DeleteIdle(ctx context.Context, id string, before time.Time) (bool, error) {
+	deleted, err := deleteIdleDriver.Run(ctx, s.client, []string{driverKey(id), driverLastSeenKey(id), driverIndexedZoneKey(id)}, before.UnixMilli()).Int()
+	return deleted == 1, err
+}
+
+// The zones with drivers, always including unzoned
+func (s *RedisDriverStore) zones(ctx context.Context) ([]string, error) {
+	members, err := s.client.SMembers(ctx, driverZonesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	zones := []string{""}
+	for _, zone := range members {
+		if zone != "" {
+			zones = append(zones, zone)
+		}
+	}
+	return zones, nil
+}
+
+// RedisOrderQueue keeps each zone's queue in a queueKey list, the same
+// orders by ID in a queuedKey hash and its held orders in a heldKey hash,
+// all in the zone's slot so scripts move orders between them atomically.
+// orderZonesKey maps each queued or held order to its zone so it can be
+// found by ID; it spans slots, so it's written before an order is queued and
+// cleared after it's taken, and a stale entry only costs an empty lookup.
+// orderReceivedAtKey holds arrival times.
+type RedisOrderQueue struct {
+	client redis.UniversalClient
+}
+
+// NewRedisOrderQueue returns an OrderQueue backed by client
+func NewRedisOrderQueue(client redis.UniversalClient) *RedisOrderQueue {
+	return &RedisOrderQueue{client: client}
+}
+
+// Add an order to its zone's queue (KEYS[1]) and queued orders (KEYS[2]),
+// at the front if ARGV[3] is "front". An order already queued or held
+// (KEYS[3]) isn't added again.
+var pushOrder = redis.NewScript(`
+if redis.call("HEXISTS", KEYS[2], ARGV[1]) == 1 or redis.call("HEXISTS", KEYS[3], ARGV[1]) == 1 then
+	return 0
+end
+redis.call("HSET", KEYS[2], ARGV[1], ARGV[2])
+if ARGV[3] == "front" then
+	redis.call("LPUSH", KEYS[1], ARGV[2])
+else
+	redis.call("RPUSH", KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+func (q *RedisOrderQueue) Push(ctx context.Context, order Order) error {
+	return q.push(ctx, order, "back")
+}
+
+func (q *RedisOrderQueue) Requeue(ctx context.Context, order Order) error {
+	return q.push(ctx, order, "front")
+}
+
+func (q *RedisOrderQueue) List(ctx context.Context) ([]Order, error) {
+	zones, err := q.zones(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var orders []Order
+	for _, zone := range zones {
+		zoneOrders, err := q.ListZone(ctx, zone)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, zoneOrders...)
+	}
+	return orders, nil
+}
+
+func (q *RedisOrderQueue) ListZone(ctx context.Context, zone string) ([]Order, error) {
+	ordersJSON, err := q.client.LRange(ctx, queueKey(zone), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseOrders(ordersJSON), nil
+}
+
+func (q *RedisOrderQueue) Len(ctx context.Context) (int64, error) {
+	zones, err := q.zones(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, zone := range zones {
+		length, err := q.client.LLen(ctx, queueKey(zone)).Result()
+		if err != nil {
+			return 0, err
+		}
+		total += length
+	}
+	return total, nil
+}
+
+// Remove a pending order from its zone's queued orders (KEYS[2]) and queue
+// (KEYS[1]), returning it. Only one caller gets a given order.
+var takeOrder = redis.NewScript(`
+local order = redis.call("HGET", KEYS[2], ARGV[1])
+if not order then
+	return false
+end
+redis.call("HDEL", KEYS[2], ARGV[1])
+redis.call("LREM", KEYS[1], 1, order)
+return order
+`)
+
+func (q *RedisOrderQueue) Take(ctx context.Context, id string) (Order, error) {
+	zone, err := q.zoneOf(ctx, id)
+	if err != nil {
+		return Order{}, err
+	}
+	orderJSON, err := takeOrder.Run(ctx, q.client, []string{queueKey(zone), queuedKey(zone)}, id).Text()
+	if err != nil {
+		return Order{}, notFound(err)
+	}
+	q.client.HDel(ctx, orderZonesKey, id)
+	var order Order
+	json.Unmarshal([]byte(orderJSON), &order)
+	return order, nil
+}
+
+// Move an order from its zone's queue (KEYS[1]) and queued orders (KEYS[2])
+// to its held orders (KEYS[3]). The order keeps its zone index entry.
+var holdOrder = redis.NewScript(`
+local order = redis.call("HGET", KEYS[2], ARGV[1])
+if not order then
+	return 0
+end
+redis.call("HDEL", KEYS[2], ARGV[1])
+redis.call("LREM", KEYS[1], 1, order)
+redis.call("HSET", KEYS[3], ARGV[1], order)
+return 1
+`)
+
+func (q *RedisOrderQueue) Hold(ctx context.Context, id string) error {
+	zone, err := q.zoneOf(ctx, id)
+	if err != nil {
+		return err
+	}
+	held, err := holdOrder.Run(ctx, q.client, []string{queueKey(zone), queuedKey(zone), heldKey(zone)}, id).Int()
+	if err != nil {
+		return err
+	}
+	if held == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Move a held order (KEYS[1]) back to the front of its zone's queue
+// (KEYS[2]) and queued orders (KEYS[3]), returning it
+var releaseOrder = redis.NewScript(`
+local order = redis.call("HGET", KEYS[1], ARGV[1])
+if not order then
+	return false
+end
+redis.call("HDEL", KEYS[1], ARGV[1])
+redis.call("LPUSH", KEYS[2], order)
+redis.call("HSET", KEYS[3], ARGV[1], order)
+return order
+`)
+
+func (q *RedisOrderQueue) Release(ctx context.Context, id string) (Order, error) {
+	zone, err := q.zoneOf(ctx, id)
+	if err != nil {
+		return Order{}, err
+	}
+	orderJSON, err := releaseOrder.Run(ctx, q.client, []string{heldKey(zone), queueKey(zone), queuedKey(zone)}, id).Text()
+	if err != nil {
+		return Order{}, notFound(err)
+	}
+	var order Order
+	json.Unmarshal([]byte(orderJSON), &order)
+	return order, nil
+}
+
+// Remove a held order (KEYS[1]), returning it
+var takeHeldOrder = redis.NewScript(`
+local order = redis.call("HGET", KEYS[1], ARGV[1])
+if not order then
+	return false
+end
+redis.call("HDEL", KEYS[1], ARGV[1])
+return order
+`)
+
+func (q *RedisOrderQueue) TakeHeld(ctx context.Context, id string) (Order, error) {
+	zone, err := q.zoneOf(ctx, id)
+	if err != nil {
+		return Order{}, err
+	}
+	orderJSON, err := takeHeldOrder.Run(ctx, q.client, []string{heldKey(zone)}, id).Text()
+	if err != nil {
+		return Order{}, notFound(err)
+	}
+	q.client.HDel(ctx, orderZonesKey, id)
+	var order Order
+	json.Unmarshal([]byte(orderJSON), &order)
+	return order, nil
+}
+
+func (q *RedisOrderQueue) Held(ctx context.Context) ([]Order, error) {
+	zones, err := q.zones(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ordersJSON []string
+	for _, zone := range zones {
+		heldJSON, err := q.client.HVals(ctx, heldKey(zone)).Result()
+		if err != nil {
+			return nil, err
+		}
+		ordersJSON = append(ordersJSON, heldJSON...)
+	}
+	return parseOrders(ordersJSON), nil
+}
+
+func (q *RedisOrderQueue) MarkReceived(ctx context.Context, id string, at time.Time) error {
+	return q.client.HSetNX(ctx, orderReceivedAtKey, id, at.UnixMilli()).Err()
+}
+
+func (q *RedisOrderQueue) ClearReceived(ctx context.Context, id string) (time.Time, error) {
+	value, err := q.client.HGet(ctx, orderReceivedAtKey, id).Result()
+	if err != nil {
+		return time.Time{}, notFound(err)
+	}
+	q.client.HDel(ctx, orderReceivedAtKey, id)
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(ms), nil
+}
+
+func (q *RedisOrderQueue) OldestReceived(ctx context.Context) (time.Time, error) {
+	receivedAt, err := q.client.HVals(ctx, orderReceivedAtKey).Result()
+	if err != nil {
+		return time.Time{}, err
+	}
+	var oldest int64
+	for _, value := range receivedAt {
+		if ms, err := strconv.ParseInt(value, 10, 64); err == nil && (oldest == 0 || ms < oldest) {
+			oldest = ms
+		}
+	}
+	if oldest == 0 {
+		return time.Time{}, nil
+	}
+	return time.UnixMilli(oldest), nil
+}
+
+// Index an order under its zone, then add it to the zone's queue
+func (q *RedisOrderQueue) push(ctx context.Context, order Order, end string) error {
+	orderJSON, _ := json.Marshal(order)
+	if err := q.client.HSet(ctx, orderZonesKey, order.ID, order.ZoneID).Err(); err != nil {
+		return err
+	}
+	keys := []string{queueKey(order.ZoneID), queuedKey(order.ZoneID), heldKey(order.ZoneID)}
+	return pushOrder.Run(ctx, q.client, keys, order.ID, orderJSON, end).Err()
+}
+
+// The zones with queued or held orders, always including unzoned
+func (q *RedisOrderQueue) zones(ctx context.Context) ([]string, error) {
+	orderZones, err := q.client.HVals(ctx, orderZonesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{"": true}
+	zones := []string{""}
+	for _, zone := range orderZones {
+		if !seen[zone] {
+			seen[zone] = true
+			zones = append(zones, zone)
+		}
+	}
+	return zones, nil
+}
+
+// The zone a queued or held order is in. Orders without an index entry are
+// taken to be unzoned.
+func (q *RedisOrderQueue) zoneOf(ctx context.Context, id string) (string, error) {
+	zone, err := q.client.HGet(ctx, orderZonesKey, id).Result()
+	if err != nil && err != redis.Nil {
+		return "", err
+	}
+	return zone, nil
+}
+
+// RedisAssignmentStore keeps assignments in the assignmentsKey hash and
+// their orders in assignedOrdersKey, both in the {assignments} slot
+type RedisAssignmentStore struct {
+	client redis.UniversalClient
+}
+
+// NewRedisAssignmentStore returns an AssignmentStore backed by client
+func NewRedisAssignmentStore(client redis.UniversalClient) *RedisAssignmentStore {
+	return &RedisAssignmentStore{client: client}
+}
+
+func (s *RedisAssignmentStore) Save(ctx context.Context, assignment OrderAssignment, order Order) error {
+	assignmentJSON, _ := json.Marshal(assignment)
+	orderJSON, _ := json.Marshal(order)
+	pipe := s.client.TxPipeline()
+	pipe.HSet(ctx, assignmentsKey, assignment.OrderID, assignmentJSON)
+	pipe.HSet(ctx, assignedOrdersKey, assignment.OrderID, orderJSON)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *RedisAssignmentStore) Get(ctx context.Context, orderID string) (OrderAssignment, error) {
+	var assignment OrderAssignment
+	assignmentJSON, err := s.client.HGet(ctx, assignmentsKey, orderID).Result()
+	if err != nil {
+		return assignment, notFound(err)
+	}
+	err = json.Unmarshal([]byte(assignmentJSON), &assignment)
+	return assignment, err
+}
+
+func (s *RedisAssignmentStore) List(ctx context.Context) ([]OrderAssignment, error) {
+	assignmentsMap, err := s.client.HGetAll(ctx, assignmentsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	assignments := make([]OrderAssignment, 0, len(assignmentsMap))
+	for _, assignmentJSON := range assignmentsMap {
+		var assignment OrderAssignment
+		if err := json.Unmarshal([]byte(assignmentJSON), &assignment); err != nil {
+			continue
+		}
+		assignments = append(assignments, assignment)
+	}
+	return assignments, nil
+}
+
+func (s *RedisAssignmentStore) Order(ctx context.Context, orderID string) (Order, error) {
+	var order Order
+	orderJSON, err := s.client.HGet(ctx, assignedOrdersKey, orderID).Result()
+	if err != nil {
+		return order, notFound(err)
+	}
+	err = json.Unmarshal([]byte(orderJSON), &order)
+	return order, err
+}
+
+func (s *RedisAssignmentStore) Remove(ctx context.Context, orderID string) (OrderAssignment, Order, error) {
+	assignment, err := s.Get(ctx, orderID)
+	if err != nil {
+		return assignment, Order{}, err
+	}
+	order := Order{ID: orderID, RestaurantID: assignment.RestaurantID}
+	if orderJSON, err := s.client.HGet(ctx, assignedOrdersKey, orderID).Result(); err == nil {
+		json.Unmarshal([]byte(orderJSON), &order)
+	}
+
+	// Only one caller gets to remove a given assignment
+	removed, err := s.client.HDel(ctx, assignmentsKey, orderID).Result()
+	if err != nil {
+		return assignment, order, err
+	}
+	if removed == 0 {
+		return assignment, order, ErrNotFound
+	}
+	s.client.HDel(ctx, assignedOrdersKey, orderID)
+	return assignment, order, nil
+}
+
+// RedisDecisionLog keeps each order's decisions in a decisionsKey list that
+// expires retention after the last decision
+type RedisDecisionLog struct {
+	client    redis.UniversalClient
+	retention time.Duration
+}
+
+// NewRedisDecisionLog returns a DecisionLog backed by client
+func NewRedisDecisionLog(client redis.UniversalClient, retention time.Duration) *RedisDecisionLog {
+	return &RedisDecisionLog{client: client, retention: retention}
+}
+
+func (l *RedisDecisionLog) Record(ctx context.Context, decision DispatchDecision) error {
+	key := decisionsKey(decision.OrderID)
+	decisionJSON, _ := json.Marshal(decision)
+	pipe := l.client.TxPipeline()
+	pipe.RPush(ctx, key, decisionJSON)
+	pipe.Expire(ctx, key, l.retention)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (l *RedisDecisionLog) List(ctx context.Context, orderID string) ([]DispatchDecision, error) {
+	entries, err := l.client.LRange(ctx, decisionsKey(orderID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	decisions := make([]DispatchDecision, 0, len(entries))
+	for _, entry := range entries {
+		var decision DispatchDecision
+		if err := json.Unmarshal([]byte(entry), &decision); err != nil {
+			continue
+		}
+		decisions = append(decisions, decision)
+	}
+	return decisions, nil
+}
+
+// RedisAuditLog keeps admin actions in the auditLogKey stream. The stream
+// is never trimmed, since the log is the record of who did what; an
+// action's ID is its stream entry ID.
+type RedisAuditLog struct {
+	client redis.UniversalClient
+}
+
+// NewRedisAuditLog returns an AuditLog backed by client
+func NewRedisAuditLog(client redis.UniversalClient) *RedisAuditLog {
+	return &RedisAuditLog{client: client}
+}
+
+func (l *RedisAuditLog) Record(ctx context.Context, action AdminAction) error {
+	action.ID = ""
+	actionJSON, _ := json.Marshal(action)
+	return l.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: auditLogKey,
+		Values: map[string]interface{}{"action": actionJSON},
+	}).Err()
+}
+
+func (l *RedisAuditLog) List(ctx context.Context, before string, limit int) ([]AdminAction, error) {
+	end := "+"
+	if before != "" {
+		end = "(" + before
+	}
+	entries, err := l.client.XRevRangeN(ctx, auditLogKey, end, "-", int64(limit)).Result()
+	if err != nil {
+		return nil, err
+	}
+	actions := make([]AdminAction, 0, len(entries))
+	for _, entry := range entries {
+		actionJSON, _ := entry.Values["action"].(string)
+		var action AdminAction
+		if err := json.Unmarshal([]byte(actionJSON), &action); err != nil {
+			continue
+		}
+		action.ID = entry.ID
+		actions = append(actions, action)
+	}
+	return actions, nil
+}
+
+func parseOrders(ordersJSON []string) []Order {
+	orders := make([]Order, 0, len(ordersJSON))
+	for _, orderJSON := range ordersJSON {
+		var order Order
+		if err := json.Unmarshal([]byte(orderJSON), &order); err != nil {
+			continue
+		}
+		orders = append(orders, order)
+	}
+	return orders
+}
+
+// Translate a Redis miss into ErrNotFound
+func notFound(err error) error {
+	if errors.Is(err, redis.Nil) {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/foodo/shared/rediskeys"
+)
+
+// Each zone's queue and its orders by ID move together, and an order is
+// queued once however often it arrives
+func TestRedisOrderQueueKeepsQueueAndIndexTogether(t *testing.T) {
+	startTestService(t)
+	ctx := context.Background()
+	q := NewRedisOrderQueue(redisClient)
+
+	order := Order{ID: "order-1", ZoneID: "north"}
+	for i := 0; i < 2; i++ {
+		if err := q.Push(ctx, order); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := redisClient.LLen(ctx, queueKey("north")).Val(); n != 1 {
+		t.Fatalf("queue length after a repeated push = %d, want 1", n)
+	}
+
+	if err := q.Hold(ctx, order.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Push(ctx, order); err != nil {
+		t.Fatal(err)
+	}
+	if n := redisClient.LLen(ctx, queueKey("north")).Val(); n != 0 {
+		t.Fatalf("held order was queued again")
+	}
+	if _, err := q.Release(ctx, order.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	taken, err := q.Take(ctx, order.ID)
+	if err != nil || taken.ID != order.ID {
+		t.Fatalf("take = %+v, %v", taken, err)
+	}
+	if _, err := q.Take(ctx, order.ID); err != ErrNotFound {
+		t.Fatalf("second take = %v, want ErrNotFound", err)
+	}
+	for _, key := range []string{queueKey("north"), queuedKey("north"), heldKey("north")} {
+		if n := redisClient.Exists(ctx, key).Val(); n != 0 {
+			t.Errorf("%s left behind", key)
+		}
+	}
+	if redisClient.HExists(ctx, orderZonesKey, order.ID).Val() {
+		t.Error("zone index entry left behind")
+	}
+}
+
+// Drivers, the queue and assignments move from the flat layout, and a
+// rerun doesn't queue an order twice
+func TestMigrateKeys(t *testing.T) {
+	ts := startTestService(t)
+	ctx := context.Background()
+	start := time.Now()
+
+	redisClient.HSet(ctx, "drivers", "driver-1", `{"id":"driver-1","status":"available"}`)
+	redisClient.HSet(ctx, "drivers", "driver-2", `{"status": "busy"}`)
+	redisClient.RPush(ctx, "pending_orders", `{"id":"order-1"}`, `{"id":"order-2"}`)
+	redisClient.HSet(ctx, "order_assignments", "order-3", `{"orderId":"order-3","driverId":"driver-2"}`)
+	// A run that stopped after copying the queue
+	redisClient.RPush(ctx, queueKey(""), `{"id":"order-1"}`, `{"id":"order-2"}`)
+
+	for run := 0; run < 2; run++ {
+		if err := migrateKeys(ctx, rediskeys.NewMigration(redisClient)); err != nil {
+			t.Fatalf("migrate: %v", err)
+		}
+	}
+
+	drivers, err := ts.server.Drivers.ListZone(ctx, "")
+	if err != nil || len(drivers) != 2 {
+		t.Fatalf("drivers = %+v, %v", drivers, err)
+	}
+	for _, driver := range drivers {
+		if driver.ID == "" {
+			t.Errorf("driver moved without its ID: %+v", driver)
+		}
+	}
+	if idle, _ := ts.server.Drivers.Idle(ctx, start.Add(-time.Minute)); len(idle) != 0 {
+		t.Errorf("moved drivers counted as idle: %v", idle)
+	}
+	if n := redisClient.LLen(ctx, queueKey("")).Val(); n != 2 {
+		t.Fatalf("queue length = %d, want 2", n)
+	}
+	if _, err := ts.server.Orders.Take(ctx, "order-1"); err != nil {
+		t.Fatalf("take moved order: %v", err)
+	}
+	if _, err := ts.server.Assignments.Get(ctx, "order-3"); err != nil {
+		t.Fatalf("moved assignment: %v", err)
+	}
+	for _, key := range []string{"drivers", "pending_orders", "order_assignments"} {
+		if n := redisClient.Exists(ctx, key).Val(); n != 0 {
+			t.Errorf("%s is still there", key)
+		}
+	}
+}
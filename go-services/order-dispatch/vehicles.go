@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/foodo/shared/logging"
+	"github.com/gorilla/mux"
+)
+
+// Vehicle is what a driver delivers with. Limits left at 0 take the
+// defaults for the vehicle type.
+type Vehicle struct {
+	Type string `json:"type"` // bicycle, scooter, car
+	// Longest trip, to the pickup and on to the customer
+	MaxDistanceKm float64 `json:"maxDistanceKm,omitempty"`
+	MaxWeightKg   float64 `json:"maxWeightKg,omitempty"`
+	MaxItems      int     `json:"maxItems,omitempty"`
+	InsulatedBag  bool    `json:"insulatedBag,omitempty"`
+}
+
+// OrderRequirements is what an order needs from the vehicle delivering it.
+// Anything left at 0 isn't checked.
+type OrderRequirements struct {
+	// Restaurant to customer
+	DistanceKm   float64 `json:"distanceKm,omitempty"`
+	WeightKg     float64 `json:"weightKg,omitempty"`
+	Items        int     `json:"items,omitempty"`
+	InsulatedBag bool    `json:"insulatedBag,omitempty"`
+}
+
+// Drivers who haven't said what they deliver with are held to the most
+// restrictive type's limits
+var unknownVehicle = Vehicle{Type: "bicycle"}
+
+// The limits of each vehicle type. 0 is no limit.
+var vehicleDefaults = map[string]Vehicle{
+	"bicycle": {MaxDistanceKm: 5, MaxWeightKg: 8, MaxItems: 6},
+	"scooter": {MaxDistanceKm: 12, MaxWeightKg: 15, MaxItems: 12},
+	"car":     {MaxWeightKg: 40},
+}
+
+// The vehicle's limits, with the type's defaults filled in
+func (v Vehicle) limits() Vehicle {
+	defaults := vehicleDefaults[v.Type]
+	if v.MaxDistanceKm == 0 {
+		v.MaxDistanceKm = defaults.MaxDistanceKm
+	}
+	if v.MaxWeightKg == 0 {
+		v.MaxWeightKg = defaults.MaxWeightKg
+	}
+	if v.MaxItems == 0 {
+		v.MaxItems = defaults.MaxItems
+	}
+	return v
+}
+
+// The vehicle with its limits capped at the type's, so an override can't
+// stretch a bicycle into a car
+func (v Vehicle) clamped() Vehicle {
+	defaults := vehicleDefaults[v.Type]
+	if defaults.MaxDistanceKm > 0 && v.MaxDistanceKm > defaults.MaxDistanceKm {
+		v.MaxDistanceKm = defaults.MaxDistanceKm
+	}
+	if defaults.MaxWeightKg > 0 && v.MaxWeightKg > defaults.MaxWeightKg {
+		v.MaxWeightKg = defaults.MaxWeightKg
+	}
+	if defaults.MaxItems > 0 && v.MaxItems > defaults.MaxItems {
+		v.MaxItems = defaults.MaxItems
+	}
+	return v
+}
+
+// The filter ruling the vehicle out for an order, or "" if it can take it.
+// toPickupKm is the driver's distance to the restaurant, if known. Drivers
+// without a vehicle are taken to have unknownVehicle, and orders without
+// requirements aren't checked.
+func vehicleFilter(vehicle *Vehicle, requirements *OrderRequirements, toPickupKm *float64) string {
+	if requirements == nil {
+		return ""
+	}
+	if vehicle == nil {
+		vehicle = &unknownVehicle
+	}
+	limits := vehicle.limits()
+
+	trip := requirements.DistanceKm
+	if toPickupKm != nil {
+		trip += *toPickupKm
+	}
+	switch {
+	case requirements.InsulatedBag && !limits.InsulatedBag:
+		return filterNoInsulatedBag
+	case limits.MaxDistanceKm > 0 && trip > limits.MaxDistanceKm:
+		return filterTooFar
+	case limits.MaxWeightKg > 0 && requirements.WeightKg > limits.MaxWeightKg,
+		limits.MaxItems > 0 && requirements.Items > limits.MaxItems:
+		return filterOverCapacity
+	}
+	return ""
+}
+
+// Set the vehicle a driver delivers with
+func (s *Server) updateDriverVehicleHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+	driverID := mux.Vars(r)["id"]
+	ctx = logging.WithDriverID(ctx, driverID)
+
+	var requestBody struct {
+		adminRequest
+		Vehicle
+	}
+	if !decodeAdminRequest(w, r, &requestBody) {
+		return
+	}
+	vehicle := requestBody.Vehicle
+	if _, ok := vehicleDefaults[vehicle.Type]; !ok {
+		http.Error(w, "type must be bicycle, scooter or car", http.StatusBadRequest)
+		return
+	}
+	if vehicle.MaxDistanceKm < 0 || vehicle.MaxWeightKg < 0 || vehicle.MaxItems < 0 {
+		http.Error(w, "limits can't be negative", http.StatusBadRequest)
+		return
+	}
+	vehicle = vehicle.clamped()
+
+	driver, err := s.Drivers.Get(ctx, driverID)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Driver not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to get driver", http.StatusInternalServerError)
+		return
+	}
+	previous := driver.Vehicle
+	driver.Vehicle = &vehicle
+	if err := s.Drivers.Save(ctx, driver); err != nil {
+		http.Error(w, "Failed to update driver", http.StatusInternalServerError)
+		return
+	}
+
+	s.recordAdminAction(ctx, "set_driver_vehicle", driverID, requestBody.Reason, map[string]interface{}{
+		"from": previous,
+		"to":   vehicle,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(driver)
+}
@@ -0,0 +1,667 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/foodo/shared/auth"
+	"github.com/foodo/shared/config"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Webhook event types delivered to restaurant subscriptions
+const (
+	WebhookEventDriverAssigned  = "driver.assigned"
+	WebhookEventDriverPickingUp = "driver.picking_up"
+	WebhookEventDriverArriving  = "driver.arriving"
+	WebhookEventOrderDelivered  = "order.delivered"
+	WebhookEventOrderCancelled  = "order.cancelled"
+)
+
+var webhookEventTypes = map[string]bool{
+	WebhookEventDriverAssigned:  true,
+	WebhookEventDriverPickingUp: true,
+	WebhookEventDriverArriving:  true,
+	WebhookEventOrderDelivered:  true,
+	WebhookEventOrderCancelled:  true,
+}
+
+// The API's order statuses that map onto webhook events. A ready order is
+// being picked up by its driver, and one out for delivery is on its way to
+// the customer.
+var statusWebhookEvents = map[string]string{
+	"ready":            WebhookEventDriverPickingUp,
+	"out_for_delivery": WebhookEventDriverArriving,
+	"delivered":        WebhookEventOrderDelivered,
+	"cancelled":        WebhookEventOrderCancelled,
+}
+
+// WebhookSubscription is a restaurant's registration for dispatch events
+type WebhookSubscription struct {
+	ID           string     `json:"id"`
+	RestaurantID string     `json:"restaurantId"`
+	URL          string     `json:"url"`
+	Secret       string     `json:"secret,omitempty"`
+	Events       []string   `json:"events"` // empty means all events
+	Active       bool       `json:"active"`
+	FailureCount int        `json:"failureCount"` // consecutive failed deliveries
+	CreatedAt    time.Time  `json:"createdAt"`
+	DisabledAt   *time.Time `json:"disabledAt,omitempty"`
+}
+
+// WebhookEvent is the JSON body posted to subscribers
+type WebhookEvent struct {
+	ID           string      `json:"id"`
+	Type         string      `json:"type"`
+	RestaurantID string      `json:"restaurantId"`
+	OrderID      string      `json:"orderId"`
+	OccurredAt   time.Time   `json:"occurredAt"`
+	Data         interface{} `json:"data"`
+}
+
+// WebhookDelivery is one entry in a subscription's delivery log
+type WebhookDelivery struct {
+	EventID    string    `json:"eventId"`
+	EventType  string    `json:"eventType"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Success    bool      `json:"success"`
+	DurationMs int64     `json:"durationMs"`
+	At         time.Time `json:"at"`
+}
+
+func (s *WebhookSubscription) wants(eventType string) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, e := range s.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDispatcher signs and delivers events to subscribed restaurants
+type WebhookDispatcher struct {
+	Subscriptions *RedisWebhookStore
+	client        *http.Client
+	allowPrivate  bool
+	maxAttempts   int
+	baseBackoff   time.Duration
+	disableAfter  int
+	deliveryLogSz int64
+	inFlight      sync.WaitGroup
+	// Cancelled when Wait gives up, abandoning deliveries still retrying
+	stop   context.Context
+	cancel context.CancelFunc
+}
+
+// errPrivateWebhookTarget is returned for URLs that resolve to loopback,
+// private or link-local addresses, so subscriptions can't reach into the
+// cluster
+var errPrivateWebhookTarget = errors.New("webhook target is not a public address")
+
+// NewWebhookDispatcher creates a dispatcher for the subscriptions in store
+// from the service configuration. Targets must be public addresses unless
+// WEBHOOK_ALLOW_PRIVATE_TARGETS is set.
+func NewWebhookDispatcher(cfg *config.Config, store *RedisWebhookStore) *WebhookDispatcher {
+	allowPrivate := cfg.Bool("WEBHOOK_ALLOW_PRIVATE_TARGETS", false)
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if !allowPrivate {
+		// Checked on the address actually dialled, so DNS changes and
+		// redirects can't get around it
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return errPrivateWebhookTarget
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	stop, cancel := context.WithCancel(context.Background())
+	return &WebhookDispatcher{
+		Subscriptions: store,
+		client: &http.Client{
+			Timeout:   time.Duration(cfg.Int("WEBHOOK_TIMEOUT_SECONDS", 10)) * time.Second,
+			Transport: transport,
+		},
+		allowPrivate:  allowPrivate,
+		maxAttempts:   cfg.Int("WEBHOOK_MAX_ATTEMPTS", 5),
+		baseBackoff:   time.Duration(cfg.Int("WEBHOOK_BACKOFF_MS", 1000)) * time.Millisecond,
+		disableAfter:  cfg.Int("WEBHOOK_DISABLE_AFTER", 10),
+		deliveryLogSz: int64(cfg.Int("WEBHOOK_DELIVERY_LOG_SIZE", 100)),
+		stop:          stop,
+		cancel:        cancel,
+	}
+}
+
+// Whether ip is reachable from outside the deployment
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+// Check a subscription URL when it's registered. Hosts are resolved so
+// obviously internal targets are refused up front; the dialer checks again
+// on every delivery.
+func checkWebhookURL(ctx context.Context, rawURL string, allowPrivate bool) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http(s) URL")
+	}
+	if allowPrivate {
+		return nil
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errPrivateWebhookTarget
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if !isPublicIP(ip) {
+			return errPrivateWebhookTarget
+		}
+		return nil
+	}
+	// A host that doesn't resolve yet is left to the delivery-time check
+	addrs, _ := net.DefaultResolver.LookupIPAddr(ctx, host)
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return errPrivateWebhookTarget
+		}
+	}
+	return nil
+}
+
+// Publish fans an event out to every active subscription for the restaurant
+// that wants it. Deliveries run in the background.
+func (d *WebhookDispatcher) Publish(ctx context.Context, eventType, restaurantID, orderID string, data interface{}) {
+	if d == nil || restaurantID == "" {
+		return
+	}
+
+	subscriptions, err := d.Subscriptions.List(ctx, restaurantID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to load webhook subscriptions", "restaurant_id", restaurantID, "error", err)
+		return
+	}
+
+	event := WebhookEvent{
+		ID:           newID(),
+		Type:         eventType,
+		RestaurantID: restaurantID,
+		OrderID:      orderID,
+		OccurredAt:   time.Now().UTC(),
+		Data:         data,
+	}
+
+	for _, sub := range subscriptions {
+		if sub.Active && sub.wants(eventType) {
+			d.inFlight.Add(1)
+			go func(sub WebhookSubscription) {
+				defer d.inFlight.Done()
+				// Outlive the request, but not the dispatcher
+				ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+				defer cancel()
+				defer context.AfterFunc(d.stop, cancel)()
+				d.deliver(ctx, sub, event)
+			}(sub)
+		}
+	}
+}
+
+// Wait blocks until background deliveries finish or ctx is done, then
+// abandons any still retrying
+func (d *WebhookDispatcher) Wait(ctx context.Context) {
+	if d == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		d.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		d.cancel()
+	}
+}
+
+// Deliver an event with exponential backoff, recording each attempt.
+// Responses that will fail the same way again end the retries early.
+func (d *WebhookDispatcher) deliver(ctx context.Context, sub WebhookSubscription, event WebhookEvent) {
+	ctx, span := tracer.Start(ctx, "webhook deliver", trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(
+		attribute.String("webhook.id", sub.ID),
+		attribute.String("webhook.event", event.Type),
+	))
+	defer span.End()
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to encode webhook event", "event_id", event.ID, "error", err)
+		return
+	}
+
+	backoff := d.baseBackoff
+	attempt := 1
+	for ; ; attempt++ {
+		delivery, retry := d.attempt(ctx, sub, event, body, attempt)
+		if ctx.Err() != nil {
+			slog.WarnContext(ctx, "Webhook delivery abandoned at shutdown", "webhook_id", sub.ID, "event_id", event.ID, "attempts", attempt)
+			return
+		}
+		if err := d.Subscriptions.RecordDelivery(ctx, sub.ID, delivery, d.deliveryLogSz); err != nil {
+			slog.WarnContext(ctx, "Failed to record webhook delivery", "webhook_id", sub.ID, "error", err)
+		}
+
+		if delivery.Success {
+			d.updateHealth(ctx, sub.ID, true)
+			return
+		}
+		if !retry || attempt >= d.maxAttempts {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			slog.WarnContext(ctx, "Webhook delivery abandoned at shutdown", "webhook_id", sub.ID, "event_id", event.ID, "attempts", attempt)
+			return
+		}
+	}
+
+	slog.WarnContext(ctx, "Webhook delivery gave up", "webhook_id", sub.ID, "event_id", event.ID, "attempts", attempt)
+	d.updateHealth(ctx, sub.ID, false)
+}
+
+// Make one delivery attempt, reporting whether a failure is worth retrying.
+// Timeouts, rate limits, server errors and connection failures are; other
+// 4xx responses and refused targets aren't.
+func (d *WebhookDispatcher) attempt(ctx context.Context, sub WebhookSubscription, event WebhookEvent, body []byte, attempt int) (WebhookDelivery, bool) {
+	delivery := WebhookDelivery{
+		EventID:   event.ID,
+		EventType: event.Type,
+		Attempt:   attempt,
+		At:        time.Now().UTC(),
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery, false
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "foodo-order-dispatch/webhooks")
+	req.Header.Set("X-Foodo-Event", event.Type)
+	req.Header.Set("X-Foodo-Delivery", event.ID)
+	req.Header.Set("X-Foodo-Timestamp", timestamp)
+	req.Header.Set("X-Foodo-Signature", "sha256="+signWebhookPayload(sub.Secret, timestamp, body))
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	start := time.Now()
+	resp, err := d.client.Do(req)
+	delivery.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery, !errors.Is(err, errPrivateWebhookTarget)
+	}
+	resp.Body.Close()
+
+	delivery.StatusCode = resp.StatusCode
+	delivery.Success = resp.StatusCode >= 200 && resp.StatusCode < 300
+	switch {
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		return delivery, true
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return delivery, false
+	}
+	return delivery, !delivery.Success
+}
+
+// signWebhookPayload computes the hex HMAC-SHA256 of "timestamp.body".
+// Including the timestamp lets receivers reject replayed deliveries.
+func signWebhookPayload(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// RedisWebhookStore keeps webhook subscriptions in one Redis hash and each
+// subscription's delivery log in a capped list
+type RedisWebhookStore struct {
+	client redis.UniversalClient
+}
+
+func NewRedisWebhookStore(client redis.UniversalClient) *RedisWebhookStore {
+	return &RedisWebhookStore{client: client}
+}
+
+// List the subscriptions for one restaurant, or every subscription for ""
+func (s *RedisWebhookStore) List(ctx context.Context, restaurantID string) ([]WebhookSubscription, error) {
+	subsMap, err := s.client.HGetAll(ctx, webhookSubscriptionsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var subscriptions []WebhookSubscription
+	for _, subJSON := range subsMap {
+		var sub WebhookSubscription
+		if err := json.Unmarshal([]byte(subJSON), &sub); err != nil {
+			continue
+		}
+		if restaurantID == "" || sub.RestaurantID == restaurantID {
+			subscriptions = append(subscriptions, sub)
+		}
+	}
+	return subscriptions, nil
+}
+
+// Get a subscription, or redis.Nil if there is none
+func (s *RedisWebhookStore) Get(ctx context.Context, id string) (WebhookSubscription, error) {
+	var sub WebhookSubscription
+	subJSON, err := s.client.HGet(ctx, webhookSubscriptionsKey, id).Result()
+	if err != nil {
+		return sub, err
+	}
+	err = json.Unmarshal([]byte(subJSON), &sub)
+	return sub, err
+}
+
+func (s *RedisWebhookStore) Save(ctx context.Context, sub WebhookSubscription) error {
+	subJSON, _ := json.Marshal(sub)
+	return s.client.HSet(ctx, webhookSubscriptionsKey, sub.ID, subJSON).Err()
+}
+
+// Update read-modify-writes a subscription under WATCH, so concurrent
+// deliveries and operators don't overwrite each other. A subscription
+// deleted in the meantime is left deleted and reported as redis.Nil. change
+// returns false to skip the write.
+func (s *RedisWebhookStore) Update(ctx context.Context, id string, change func(*WebhookSubscription) bool) (WebhookSubscription, error) {
+	var sub WebhookSubscription
+	update := func(tx *redis.Tx) error {
+		subJSON, err := tx.HGet(ctx, webhookSubscriptionsKey, id).Result()
+		if err != nil {
+			return err
+		}
+		sub = WebhookSubscription{}
+		if err := json.Unmarshal([]byte(subJSON), &sub); err != nil {
+			return err
+		}
+		if !change(&sub) {
+			return nil
+		}
+		updated, _ := json.Marshal(sub)
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, webhookSubscriptionsKey, id, updated)
+			return nil
+		})
+		return err
+	}
+
+	// Every subscription is in one hash, so busy ones can collide
+	for i := 0; i < 10; i++ {
+		err := s.client.Watch(ctx, update, webhookSubscriptionsKey)
+		if err != redis.TxFailedErr {
+			return sub, err
+		}
+	}
+	return sub, redis.TxFailedErr
+}
+
+// Delete a subscription and its delivery log, reporting whether it existed
+func (s *RedisWebhookStore) Delete(ctx context.Context, id string) (bool, error) {
+	removed, err := s.client.HDel(ctx, webhookSubscriptionsKey, id).Result()
+	if err != nil || removed == 0 {
+		return false, err
+	}
+	return true, s.client.Del(ctx, webhookDeliveriesKey(id)).Err()
+}
+
+// RecordDelivery appends to the subscription's delivery log, keeping the
+// newest maxEntries
+func (s *RedisWebhookStore) RecordDelivery(ctx context.Context, subscriptionID string, delivery WebhookDelivery, maxEntries int64) error {
+	key := webhookDeliveriesKey(subscriptionID)
+	deliveryJSON, _ := json.Marshal(delivery)
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, key, deliveryJSON)
+		pipe.LTrim(ctx, key, 0, maxEntries-1)
+		return nil
+	})
+	return err
+}
+
+// Deliveries returns the subscription's delivery log, newest first
+func (s *RedisWebhookStore) Deliveries(ctx context.Context, subscriptionID string) ([]WebhookDelivery, error) {
+	entries, err := s.client.LRange(ctx, webhookDeliveriesKey(subscriptionID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make([]WebhookDelivery, 0, len(entries))
+	for _, entry := range entries {
+		var delivery WebhookDelivery
+		if err := json.Unmarshal([]byte(entry), &delivery); err != nil {
+			continue
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+// Track consecutive failures and disable the subscription past the limit
+func (d *WebhookDispatcher) updateHealth(ctx context.Context, subscriptionID string, success bool) {
+	disabled := false
+	sub, err := d.Subscriptions.Update(ctx, subscriptionID, func(sub *WebhookSubscription) bool {
+		if success {
+			if sub.FailureCount == 0 {
+				return false
+			}
+			sub.FailureCount = 0
+			return true
+		}
+		sub.FailureCount++
+		disabled = sub.Active && sub.FailureCount >= d.disableAfter
+		if disabled {
+			now := time.Now().UTC()
+			sub.Active = false
+			sub.DisabledAt = &now
+		}
+		return true
+	})
+	if err != nil {
+		if err != redis.Nil {
+			slog.ErrorContext(ctx, "Failed to update webhook health", "webhook_id", subscriptionID, "error", err)
+		}
+		return
+	}
+	if disabled {
+		slog.WarnContext(ctx, "Disabling webhook after consecutive failures", "webhook_id", sub.ID, "restaurant_id", sub.RestaurantID, "failures", sub.FailureCount)
+	}
+}
+
+// Register the webhook API under /api/dispatch/webhooks. Subscriptions
+// send requests to any URL, so managing them takes an admin token.
+func (s *Server) registerWebhookRoutes(r *mux.Router, guard *auth.Guard) {
+	webhooks := r.PathPrefix("/api/dispatch/webhooks").Subrouter()
+	webhooks.HandleFunc("", s.getWebhooksHandler).Methods("GET")
+	webhooks.HandleFunc("", s.createWebhookHandler).Methods("POST")
+	webhooks.HandleFunc("/{id}", s.deleteWebhookHandler).Methods("DELETE")
+	webhooks.HandleFunc("/{id}/enable", s.enableWebhookHandler).Methods("POST")
+	webhooks.HandleFunc("/{id}/deliveries", s.getWebhookDeliveriesHandler).Methods("GET")
+	guard.RequireAll(webhooks, auth.Admin(s.AdminTokens))
+}
+
+// Create webhook subscription
+func (s *Server) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+
+	// Parse request body
+	var requestBody struct {
+		RestaurantID string   `json:"restaurantId"`
+		URL          string   `json:"url"`
+		Secret       string   `json:"secret"`
+		Events       []string `json:"events"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if requestBody.RestaurantID == "" || requestBody.Secret == "" {
+		http.Error(w, "restaurantId and secret are required", http.StatusBadRequest)
+		return
+	}
+	if err := checkWebhookURL(ctx, requestBody.URL, s.Webhooks.allowPrivate); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, e := range requestBody.Events {
+		if !webhookEventTypes[e] {
+			http.Error(w, fmt.Sprintf("Unknown event type %q", e), http.StatusBadRequest)
+			return
+		}
+	}
+
+	sub := WebhookSubscription{
+		ID:           newID(),
+		RestaurantID: requestBody.RestaurantID,
+		URL:          requestBody.URL,
+		Secret:       requestBody.Secret,
+		Events:       requestBody.Events,
+		Active:       true,
+		CreatedAt:    time.Now().UTC(),
+	}
+	if err := s.Webhooks.Subscriptions.Save(ctx, sub); err != nil {
+		http.Error(w, "Failed to save webhook", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(ctx, "Webhook created", "actor", auth.AdminActor(ctx), "webhook_id", sub.ID, "restaurant_id", sub.RestaurantID)
+
+	// Never echo the secret back
+	sub.Secret = ""
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sub)
+}
+
+// List webhook subscriptions, optionally filtered by restaurant
+func (s *Server) getWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+
+	subscriptions, err := s.Webhooks.Subscriptions.List(ctx, r.URL.Query().Get("restaurantId"))
+	if err != nil {
+		http.Error(w, "Failed to get webhooks", http.StatusInternalServerError)
+		return
+	}
+	for i := range subscriptions {
+		subscriptions[i].Secret = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subscriptions)
+}
+
+// Delete webhook subscription and its delivery log
+func (s *Server) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+	id := mux.Vars(r)["id"]
+
+	removed, err := s.Webhooks.Subscriptions.Delete(ctx, id)
+	if err != nil {
+		http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	slog.InfoContext(ctx, "Webhook deleted", "actor", auth.AdminActor(ctx), "webhook_id", id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Re-enable a subscription that was disabled after repeated failures
+func (s *Server) enableWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+	id := mux.Vars(r)["id"]
+
+	sub, err := s.Webhooks.Subscriptions.Update(ctx, id, func(sub *WebhookSubscription) bool {
+		sub.Active = true
+		sub.FailureCount = 0
+		sub.DisabledAt = nil
+		return true
+	})
+	if err == redis.Nil {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to save webhook", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(ctx, "Webhook enabled", "actor", auth.AdminActor(ctx), "webhook_id", id)
+
+	sub.Secret = ""
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sub)
+}
+
+// Get the delivery log for a subscription, newest first
+func (s *Server) getWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+	id := mux.Vars(r)["id"]
+
+	if _, err := s.Webhooks.Subscriptions.Get(ctx, id); err != nil {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	deliveries, err := s.Webhooks.Subscriptions.Deliveries(ctx, id)
+	if err != nil {
+		http.Error(w, "Failed to get deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// Helper function to generate a random hex identifier
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
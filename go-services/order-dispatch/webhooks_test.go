@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foodo/shared/config"
+)
+
+// webhookReceiver is a restaurant's endpoint. It answers with the queued
+// status codes in turn, then with fallback.
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	fallback int
+	received []receivedWebhook
+}
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+func newWebhookReceiver(t *testing.T) *webhookReceiver {
+	rec := &webhookReceiver{fallback: http.StatusOK}
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		rec.received = append(rec.received, receivedWebhook{header: r.Header.Clone(), body: body})
+		status := rec.fallback
+		if len(rec.statuses) > 0 {
+			status, rec.statuses = rec.statuses[0], rec.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(rec.Close)
+	return rec
+}
+
+func (rec *webhookReceiver) respond(fallback int, statuses ...int) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.fallback = fallback
+	rec.statuses = statuses
+}
+
+func (rec *webhookReceiver) requests() []receivedWebhook {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]receivedWebhook(nil), rec.received...)
+}
+
+func (ts *testService) webhook(t *testing.T, id string) WebhookSubscription {
+	t.Helper()
+	var subscriptions []WebhookSubscription
+	json.NewDecoder(ts.adminRequest(t, "GET", "/api/dispatch/webhooks", nil).Body).Decode(&subscriptions)
+	for _, sub := range subscriptions {
+		if sub.ID == id {
+			return sub
+		}
+	}
+	t.Fatalf("webhook %s not listed", id)
+	return WebhookSubscription{}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	t.Setenv("WEBHOOK_MAX_ATTEMPTS", "3")
+	t.Setenv("WEBHOOK_DISABLE_AFTER", "2")
+	ts := startTestService(t)
+	rec := newWebhookReceiver(t)
+
+	// Managing subscriptions takes an admin token
+	resp, err := http.Post(ts.http.URL+"/api/dispatch/webhooks", "application/json",
+		strings.NewReader(`{"restaurantId": "restaurant-1", "url": "`+rec.URL+`", "secret": "shh"}`))
+	if err != nil {
+		t.Fatalf("create without token: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("create without token status = %d, want 401", resp.StatusCode)
+	}
+
+	resp = ts.adminRequest(t, "POST", "/api/dispatch/webhooks", map[string]interface{}{
+		"restaurantId": "restaurant-1",
+		"url":          rec.URL,
+		"secret":       "shh",
+	})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create status = %d, want 201", resp.StatusCode)
+	}
+	var sub WebhookSubscription
+	json.NewDecoder(resp.Body).Decode(&sub)
+	if sub.Secret != "" {
+		t.Fatal("created subscription echoes the secret")
+	}
+
+	// A server error is retried until it succeeds
+	rec.respond(http.StatusOK, http.StatusInternalServerError)
+	ts.publish(t, "order_status_update", OrderStatusUpdate{OrderID: "order-1", Status: "ready", RestaurantID: "restaurant-1"})
+	waitFor(t, "retried delivery", func() bool { return len(rec.requests()) == 2 })
+
+	for _, req := range rec.requests() {
+		timestamp := req.header.Get("X-Foodo-Timestamp")
+		if got, want := req.header.Get("X-Foodo-Signature"), "sha256="+signWebhookPayload("shh", timestamp, req.body); got != want {
+			t.Fatalf("signature = %q, want %q", got, want)
+		}
+		if req.header.Get("X-Foodo-Event") != WebhookEventDriverPickingUp {
+			t.Fatalf("event header = %q", req.header.Get("X-Foodo-Event"))
+		}
+		var event WebhookEvent
+		json.Unmarshal(req.body, &event)
+		if event.OrderID != "order-1" || event.RestaurantID != "restaurant-1" {
+			t.Fatalf("event = %s", req.body)
+		}
+	}
+
+	// Both attempts are in the history, newest first
+	var deliveries []WebhookDelivery
+	waitFor(t, "delivery history", func() bool {
+		deliveries = nil
+		json.NewDecoder(ts.adminRequest(t, "GET", "/api/dispatch/webhooks/"+sub.ID+"/deliveries", nil).Body).Decode(&deliveries)
+		return len(deliveries) == 2
+	})
+	if !deliveries[0].Success || deliveries[0].Attempt != 2 || deliveries[1].Success || deliveries[1].StatusCode != http.StatusInternalServerError {
+		t.Fatalf("deliveries = %+v", deliveries)
+	}
+
+	// A client error isn't retried, and counts as one failed delivery
+	rec.respond(http.StatusBadRequest)
+	ts.publish(t, "order_status_update", OrderStatusUpdate{OrderID: "order-1", Status: "delivered", RestaurantID: "restaurant-1"})
+	waitFor(t, "first failure", func() bool { return ts.webhook(t, sub.ID).FailureCount == 1 })
+	if n := len(rec.requests()); n != 3 {
+		t.Fatalf("requests after a 400 = %d, want 3", n)
+	}
+
+	// Another failure in a row disables the subscription
+	ts.publish(t, "order_status_update", OrderStatusUpdate{OrderID: "order-2", Status: "cancelled", RestaurantID: "restaurant-1"})
+	waitFor(t, "subscription to be disabled", func() bool { return !ts.webhook(t, sub.ID).Active })
+	if disabled := ts.webhook(t, sub.ID); disabled.DisabledAt == nil || disabled.FailureCount != 2 {
+		t.Fatalf("disabled subscription = %+v", disabled)
+	}
+
+	// Disabled subscriptions get nothing until re-enabled
+	ts.publish(t, "order_status_update", OrderStatusUpdate{OrderID: "order-3", Status: "ready", RestaurantID: "restaurant-1"})
+	ts.server.Webhooks.Wait(context.Background())
+	if n := len(rec.requests()); n != 4 {
+		t.Fatalf("requests while disabled = %d, want 4", n)
+	}
+	rec.respond(http.StatusOK)
+	if resp := ts.adminRequest(t, "POST", "/api/dispatch/webhooks/"+sub.ID+"/enable", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("enable status = %d, want 200", resp.StatusCode)
+	}
+	ts.publish(t, "order_status_update", OrderStatusUpdate{OrderID: "order-3", Status: "delivered", RestaurantID: "restaurant-1"})
+	waitFor(t, "delivery after enabling", func() bool { return len(rec.requests()) == 5 })
+}
+
+// The API's own status payloads, published where it publishes them, reach
+// the restaurant of the order's assignment
+func TestStatusWebhooksFromAPIEvents(t *testing.T) {
+	ts := startTestService(t)
+	rec := newWebhookReceiver(t)
+	ctx := context.Background()
+
+	sub := WebhookSubscription{ID: "hook-1", RestaurantID: "restaurant-1", URL: rec.URL, Secret: "shh", Active: true}
+	if err := ts.server.Webhooks.Subscriptions.Save(ctx, sub); err != nil {
+		t.Fatal(err)
+	}
+	const orderID = "7f3c2a9e-4b1d-4e8a-9c6f-2d5e8b1a4c7d"
+	assignment := OrderAssignment{OrderID: orderID, DriverID: "driver-1", RestaurantID: "restaurant-1", AssignedAt: time.Now()}
+	if err := ts.server.Assignments.Save(ctx, assignment, Order{ID: orderID, RestaurantID: "restaurant-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tc := range []struct{ fixture, event string }{
+		{"ready.json", WebhookEventDriverPickingUp},
+		{"out-for-delivery.json", WebhookEventDriverArriving},
+	} {
+		payload, err := os.ReadFile(filepath.Join(contractsDir, "order_status_update", tc.fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := redisClient.Publish(ctx, "order_status_update", payload).Err(); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, tc.event+" delivery", func() bool { return len(rec.requests()) == i+1 })
+		req := rec.requests()[i]
+		var event WebhookEvent
+		json.Unmarshal(req.body, &event)
+		if req.header.Get("X-Foodo-Event") != tc.event || event.OrderID != orderID || event.RestaurantID != "restaurant-1" {
+			t.Fatalf("%s: event %s = %s", tc.fixture, req.header.Get("X-Foodo-Event"), req.body)
+		}
+	}
+}
+
+func TestWebhookPrivateTargets(t *testing.T) {
+	ctx := context.Background()
+	for _, target := range []string{
+		"http://localhost:8080/hook",
+		"http://127.0.0.1/hook",
+		"http://10.1.2.3/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://[::1]/hook",
+		"http://0.0.0.0/hook",
+	} {
+		if err := checkWebhookURL(ctx, target, false); err == nil {
+			t.Errorf("%s accepted", target)
+		}
+		if err := checkWebhookURL(ctx, target, true); err != nil {
+			t.Errorf("%s refused with private targets allowed: %v", target, err)
+		}
+	}
+	if err := checkWebhookURL(ctx, "https://93.184.216.34/hook", false); err != nil {
+		t.Errorf("public address refused: %v", err)
+	}
+	if err := checkWebhookURL(ctx, "ftp://example.com/hook", false); err == nil {
+		t.Error("ftp URL accepted")
+	}
+}
+
+// Deliveries are checked again when dialling, and a refused target isn't
+// retried
+func TestWebhookDialRefusesPrivateTargets(t *testing.T) {
+	ts := startTestService(t)
+	rec := newWebhookReceiver(t)
+
+	sub := WebhookSubscription{ID: "hook-1", RestaurantID: "restaurant-1", URL: rec.URL, Secret: "shh", Active: true}
+	if err := ts.server.Webhooks.Subscriptions.Save(context.Background(), sub); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE_TARGETS", "false")
+	strict, err := config.Load("order-dispatch", "0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewWebhookDispatcher(strict, ts.server.Webhooks.Subscriptions)
+	d.Publish(context.Background(), WebhookEventDriverAssigned, "restaurant-1", "order-1", nil)
+	d.Wait(context.Background())
+
+	if n := len(rec.requests()); n != 0 {
+		t.Fatalf("receiver got %d requests", n)
+	}
+	var deliveries []WebhookDelivery
+	json.NewDecoder(ts.adminRequest(t, "GET", "/api/dispatch/webhooks/hook-1/deliveries", nil).Body).Decode(&deliveries)
+	if len(deliveries) != 1 || deliveries[0].Success || !strings.Contains(deliveries[0].Error, errPrivateWebhookTarget.Error()) {
+		t.Fatalf("deliveries = %+v", deliveries)
+	}
+}
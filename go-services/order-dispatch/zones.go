@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/foodo/shared/config"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Zone is an active DeliveryZone. An order belongs to the zone covering its
+// restaurant's zip code; a driver belongs to the zone it reports.
+type Zone struct {
+	ID                    string   `json:"id"`
+	Name                  string   `json:"name"`
+	City                  string   `json:"city"`
+	ZipCodes              []string `json:"zipCodes"`
+	DeliveryFee           float64  `json:"deliveryFee"`
+	EstimatedDeliveryTime int      `json:"estimatedDeliveryTime"`
+	// Zones in the same city, which can lend drivers when borrowing is on
+	Neighbours []string `json:"neighbours"`
+}
+
+// ZoneSet is a snapshot of the zones, indexed for lookup
+type ZoneSet struct {
+	zones []Zone
+	byID  map[string]Zone
+	byZip map[string]string
+}
+
+// NewZoneSet indexes zones and works out their neighbours. When two zones
+// claim a zip code the first one wins.
+func NewZoneSet(zones []Zone) *ZoneSet {
+	set := &ZoneSet{
+		byID:  make(map[string]Zone, len(zones)),
+		byZip: make(map[string]string),
+	}
+	byCity := make(map[string][]string)
+	for _, zone := range zones {
+		city := strings.ToLower(strings.TrimSpace(zone.City))
+		byCity[city] = append(byCity[city], zone.ID)
+	}
+	for _, zone := range zones {
+		zone.Neighbours = nil
+		for _, id := range byCity[strings.ToLower(strings.TrimSpace(zone.City))] {
+			if id != zone.ID {
+				zone.Neighbours = append(zone.Neighbours, id)
+			}
+		}
+		for _, zip := range zone.ZipCodes {
+			if _, taken := set.byZip[zip]; !taken {
+				set.byZip[zip] = zone.ID
+			}
+		}
+		set.byID[zone.ID] = zone
+		set.zones = append(set.zones, zone)
+	}
+	sort.Slice(set.zones, func(i, j int) bool { return set.zones[i].Name < set.zones[j].Name })
+	return set
+}
+
+// ZoneDirectory keeps the zones in step with the DeliveryZone table. A nil
+// directory has no zones, so every order and driver is unzoned.
+type ZoneDirectory struct {
+	pool     *pgxpool.Pool
+	interval time.Duration
+	// Whether orders may go to drivers from neighbouring zones when their
+	// own zone has none free
+	Borrow bool
+
+	current atomic.Pointer[ZoneSet]
+}
+
+const selectZonesSQL = `
+SELECT "id", "name", "city", "zipCodes", "deliveryFee"::float8, "estimatedDeliveryTime"
+FROM "DeliveryZone"
+WHERE "isActive"`
+
+// NewZoneDirectory connects to Postgres and loads the zones
+func NewZoneDirectory(ctx context.Context, cfg *config.Config) (*ZoneDirectory, error) {
+	poolConfig, err := pgxpool.ParseConfig(cfg.DatabaseURL)
+	if err != nil {
+		return nil, err
+	}
+	poolConfig.MaxConns = 1
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &ZoneDirectory{
+		pool:     pool,
+		interval: cfg.Duration("ZONE_SYNC_INTERVAL", time.Minute),
+		Borrow:   cfg.Bool("DISPATCH_ZONE_BORROW", false),
+	}
+	if err := d.Sync(ctx); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Sync reloads the zones from Postgres
+func (d *ZoneDirectory) Sync(ctx context.Context) error {
+	rows, err := d.pool.Query(ctx, selectZonesSQL)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var zones []Zone
+	for rows.Next() {
+		var zone Zone
+		var zipCodes string
+		if err := rows.Scan(&zone.ID, &zone.Name, &zone.City, &zipCodes, &zone.DeliveryFee, &zone.EstimatedDeliveryTime); err != nil {
+			return err
+		}
+		for _, zip := range strings.Split(zipCodes, ",") {
+			if zip = strings.TrimSpace(zip); zip != "" {
+				zone.ZipCodes = append(zone.ZipCodes, zip)
+			}
+		}
+		zones = append(zones, zone)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	previous := d.current.Swap(NewZoneSet(zones))
+	if previous == nil || len(previous.zones) != len(zones) {
+		slog.InfoContext(ctx, "Delivery zones loaded", "zones", len(zones))
+	}
+	return nil
+}
+
+// Run resyncs every ZONE_SYNC_INTERVAL until ctx is cancelled, keeping the
+// last good zones when Postgres can't be reached
+func (d *ZoneDirectory) Run(ctx context.Context) {
+	if d == nil {
+		return
+	}
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := d.Sync(ctx); err != nil && ctx.Err() == nil {
+				slog.WarnContext(ctx, "Failed to sync delivery zones", "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close closes the Postgres pool
+func (d *ZoneDirectory) Close() {
+	if d == nil {
+		return
+	}
+	d.pool.Close()
+}
+
+// Zones returns the current zones, sorted by name
+func (d *ZoneDirectory) Zones() []Zone {
+	if d == nil {
+		return nil
+	}
+	return d.current.Load().zones
+}
+
+// Get returns a zone by ID
+func (d *ZoneDirectory) Get(id string) (Zone, bool) {
+	if d == nil {
+		return Zone{}, false
+	}
+	zone, ok := d.current.Load().byID[id]
+	return zone, ok
+}
+
+// ForOrder returns the ID of the zone covering the order's restaurant, or ""
+// if no zone does
+func (d *ZoneDirectory) ForOrder(order Order) string {
+	if d == nil || order.Restaurant == nil {
+		return ""
+	}
+	return d.current.Load().byZip[strings.TrimSpace(order.Restaurant.ZipCode)]
+}
+
+// The drivers to consider for an order: the whole fleet for an unzoned
+// order, otherwise the order's zone and unzoned drivers. With borrowing on,
+// neighbouring zones are added when none of those could take it.
+func (s *Server) zoneCandidates(ctx context.Context, order Order) (DispatchDecision, error) {
+	if order.ZoneID == "" {
+		drivers, err := s.Drivers.List(ctx)
+		if err != nil {
+			return DispatchDecision{}, err
+		}
+		return s.evaluateCandidates(order, drivers), nil
+	}
+
+	drivers, err := s.Drivers.ListZone(ctx, order.ZoneID)
+	if err != nil {
+		return DispatchDecision{}, err
+	}
+	unzoned, err := s.Drivers.ListZone(ctx, "")
+	if err != nil {
+		return DispatchDecision{}, err
+	}
+	drivers = append(drivers, unzoned...)
+	decision := s.evaluateCandidates(order, drivers)
+
+	zone, ok := s.Zones.Get(order.ZoneID)
+	if !ok || !s.Zones.Borrow || decision.hasEligible() {
+		return decision, nil
+	}
+	for _, neighbour := range zone.Neighbours {
+		borrowed, err := s.Drivers.ListZone(ctx, neighbour)
+		if err != nil {
+			return decision, err
+		}
+		drivers = append(drivers, borrowed...)
+	}
+	decision = s.evaluateCandidates(order, drivers)
+	decision.Borrowed = decision.hasEligible()
+	return decision, nil
+}
+
+// ZoneSummary is a zone with its current queue and fleet
+type ZoneSummary struct {
+	Zone
+	PendingOrders    int `json:"pendingOrders"`
+	Drivers          int `json:"drivers"`
+	AvailableDrivers int `json:"availableDrivers"`
+}
+
+// List the delivery zones with their pending orders and drivers
+func (s *Server) getZonesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+
+	zones := s.Zones.Zones()
+	summaries := make([]ZoneSummary, 0, len(zones))
+	for _, zone := range zones {
+		summary := ZoneSummary{Zone: zone}
+		orders, err := s.Orders.ListZone(ctx, zone.ID)
+		if err != nil {
+			http.Error(w, "Failed to get orders", http.StatusInternalServerError)
+			return
+		}
+		summary.PendingOrders = len(orders)
+		drivers, err := s.Drivers.ListZone(ctx, zone.ID)
+		if err != nil {
+			http.Error(w, "Failed to get drivers", http.StatusInternalServerError)
+			return
+		}
+		summary.Drivers = len(drivers)
+		for _, driver := range drivers {
+			if driver.Status == "available" {
+				summary.AvailableDrivers++
+			}
+		}
+		summaries = append(summaries, summary)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summaries)
+}
@@ -0,0 +1,81 @@
+// Package auth authenticates requests to the Go services' HTTP APIs.
+// Operators use bearer tokens from ADMIN_TOKENS; each token is named, and
+// the name is the actor recorded for what they do. Users, drivers among
+// them, use the tokens the API issued them.
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+type adminActorKey struct{}
+
+// ParseAdminTokens parses ADMIN_TOKENS entries, each a name=token pair,
+// into a map from token to name
+func ParseAdminTokens(entries []string) map[string]string {
+	tokens := make(map[string]string)
+	for _, entry := range entries {
+		name, token, ok := strings.Cut(entry, "=")
+		if !ok || name == "" || token == "" {
+			slog.Warn("Ignoring malformed ADMIN_TOKENS entry; expected name=token")
+			continue
+		}
+		tokens[token] = name
+	}
+	return tokens
+}
+
+// Admin admits requests bearing a known admin token and rejects the rest
+// with 401. The operator's name is available from AdminActor.
+func Admin(tokens map[string]string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			actor := adminName(tokens, r)
+			if actor == "" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminActorKey{}, actor)))
+		})
+	}
+}
+
+// The name of the admin token a request bears, or ""
+func adminName(tokens map[string]string, r *http.Request) string {
+	presented := bearerToken(r)
+	actor := ""
+	if presented != "" {
+		for token, name := range tokens {
+			if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1 {
+				actor = name
+			}
+		}
+	}
+	return actor
+}
+
+// The bearer token a request presents, or "". Browsers can't set headers on
+// a WebSocket handshake, so an upgrade may pass it as access_token instead.
+func bearerToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	if websocket.IsWebSocketUpgrade(r) {
+		return r.URL.Query().Get("access_token")
+	}
+	return ""
+}
+
+// AdminActor is the operator behind an admin request, or "" outside one
+func AdminActor(ctx context.Context) string {
+	actor, _ := ctx.Value(adminActorKey{}).(string)
+	return actor
+}
@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Guard authenticates requests ahead of the router's other middleware, so
+// an unauthenticated request is turned away before its body is validated.
+// Routes are registered with the middleware that authenticates them; the
+// rest pass straight through. Install Middleware with Use before any
+// validation middleware.
+type Guard struct {
+	routes map[*mux.Route]mux.MiddlewareFunc
+}
+
+// NewGuard returns a Guard with no protected routes
+func NewGuard() *Guard {
+	return &Guard{routes: make(map[*mux.Route]mux.MiddlewareFunc)}
+}
+
+// Require authenticates route's requests with mw
+func (g *Guard) Require(route *mux.Route, mw mux.MiddlewareFunc) *mux.Route {
+	g.routes[route] = mw
+	return route
+}
+
+// RequireAll authenticates requests to every route registered on router so
+// far with mw
+func (g *Guard) RequireAll(router *mux.Router, mw mux.MiddlewareFunc) {
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		g.routes[route] = mw
+		return nil
+	})
+}
+
+// Middleware runs the matched route's authentication, if it has any
+func (g *Guard) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if mw, ok := g.routes[mux.CurrentRoute(r)]; ok {
+			mw(next).ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+type userIDKey struct{}
+
+// ErrInvalidToken is returned for user tokens that are malformed, badly
+// signed, expired or revoked
+var ErrInvalidToken = errors.New("invalid token")
+
+// Users verifies the tokens the API gives users when they log in: HS256
+// JWTs signed with JWT_SECRET whose subject is the user's ID. A driver's ID
+// is their user ID.
+type Users struct {
+	secret []byte
+	// Reports whether the user logged the token out
+	revoked func(ctx context.Context, token string) (bool, error)
+}
+
+// NewUsers returns a Users verifying tokens signed with secret. revoked
+// reports whether a token was revoked; it may be nil. With an empty secret
+// every token is rejected.
+func NewUsers(secret string, revoked func(ctx context.Context, token string) (bool, error)) *Users {
+	if secret == "" {
+		slog.Warn("JWT_SECRET is empty; user tokens will be rejected")
+	}
+	return &Users{secret: []byte(secret), revoked: revoked}
+}
+
+// Verify checks token and returns the user ID it was issued to
+func (u *Users) Verify(ctx context.Context, token string) (string, error) {
+	if len(u.secret) == 0 {
+		return "", ErrInvalidToken
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return "", ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	mac := hmac.New(sha256.New, u.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return "", ErrInvalidToken
+	}
+
+	var claims struct {
+		Subject   string `json:"sub"`
+		ExpiresAt int64  `json:"exp"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil || claims.Subject == "" {
+		return "", ErrInvalidToken
+	}
+	if claims.ExpiresAt == 0 || time.Now().Unix() >= claims.ExpiresAt {
+		return "", ErrInvalidToken
+	}
+
+	if u.revoked != nil {
+		revoked, err := u.revoked(ctx, token)
+		if err != nil {
+			return "", err
+		}
+		if revoked {
+			return "", ErrInvalidToken
+		}
+	}
+	return claims.Subject, nil
+}
+
+// RevokedInRedis reports whether the API revoked a token. The API sets
+// blacklist:<token> when a user logs out, until the token would have
+// expired.
+func RevokedInRedis(client redis.UniversalClient) func(ctx context.Context, token string) (bool, error) {
+	return func(ctx context.Context, token string) (bool, error) {
+		n, err := client.Exists(ctx, "blacklist:"+token).Result()
+		return n > 0, err
+	}
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// UserOrAdmin admits requests bearing an admin token or a valid user token
+// and rejects the rest with 401. Handlers check who the request acts for
+// with ActsFor.
+func UserOrAdmin(users *Users, tokens map[string]string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if actor := adminName(tokens, r); actor != "" {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminActorKey{}, actor)))
+				return
+			}
+
+			userID, err := users.Verify(r.Context(), bearerToken(r))
+			if errors.Is(err, ErrInvalidToken) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="user"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Failed to check user token", "error", err)
+				http.Error(w, "Failed to check token", http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userIDKey{}, userID)))
+		})
+	}
+}
+
+// UserID is the user behind a request admitted with a user token, or ""
+func UserID(ctx context.Context) string {
+	userID, _ := ctx.Value(userIDKey{}).(string)
+	return userID
+}
+
+// ActsFor reports whether the request may act for userID: operators may act
+// for anyone, users only for themselves
+func ActsFor(ctx context.Context, userID string) bool {
+	if AdminActor(ctx) != "" {
+		return true
+	}
+	subject := UserID(ctx)
+	return subject != "" && subject == userID
+}
@@ -0,0 +1,55 @@
+// Package bootstrap holds the HTTP server lifecycle shared by the services
+package bootstrap
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/foodo/shared/config"
+	"github.com/foodo/shared/logging"
+)
+
+// NewServer returns an http.Server with the timeouts used by every service
+func NewServer(cfg *config.Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         ":" + cfg.Port,
+		Handler:      handler,
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 15 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+}
+
+// Run starts srv in the background and blocks until SIGINT or SIGTERM. It
+// then calls shutdown with a context bounded by cfg.ShutdownTimeout; the
+// callback is responsible for calling srv.Shutdown.
+func Run(cfg *config.Config, srv *http.Server, shutdown func(ctx context.Context) error) {
+	// Start server in a goroutine
+	go func() {
+		slog.Info("Starting server", "port", cfg.Port)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logging.Fatal("Could not listen", "port", cfg.Port, "error", err)
+		}
+	}()
+
+	// Wait for interrupt signal to gracefully shutdown the server
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	slog.Info("Shutting down server")
+
+	// Create a deadline to wait for
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := shutdown(ctx); err != nil {
+		logging.Fatal("Server forced to shutdown", "error", err)
+	}
+
+	slog.Info("Server exiting")
+}
@@ -0,0 +1,307 @@
+// Package config loads settings shared by the Go services.
+//
+// Values are layered, each layer overriding the one before it:
+//
+//  1. a JSON file of KEY: value pairs named by -config or CONFIG_FILE
+//  2. environment variables
+//  3. command-line flags, the common ones below plus any the service
+//     passes to Load
+//
+// The secrets in secretKeys can instead be read from a file by setting
+// KEY_FILE, which is how secrets mounted by Docker or Kubernetes are picked
+// up. KEY_FILE belongs to the layer it's set in, so a KEY flag still
+// overrides a KEY_FILE environment variable.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config holds the settings common to every service plus the raw key/value
+// layers, which services read their own options from
+type Config struct {
+	Service         string
+	Port            string
+	ShutdownTimeout time.Duration
+	DatabaseURL     string
+	Redis           RedisConfig
+
+	values map[string]string
+
+	mu sync.Mutex
+	// Values that were set but didn't parse, by key
+	invalid map[string]error
+}
+
+// Flag is a command-line flag and the key it overrides
+type Flag struct {
+	Name, Key, Usage string
+}
+
+// Command-line flags every service takes
+var flags = []Flag{
+	{"port", "PORT", "HTTP listen port"},
+	{"redis-mode", "REDIS_MODE", "Redis mode: standalone, sentinel or cluster"},
+	{"redis-addr", "REDIS_ADDR", "Comma-separated Redis addresses"},
+	{"redis-username", "REDIS_USERNAME", "Redis ACL username"},
+	{"redis-master", "REDIS_MASTER", "Sentinel master name"},
+	{"redis-tls", "REDIS_TLS", "Enable TLS to Redis (true/false)"},
+	{"shutdown-timeout", "SHUTDOWN_TIMEOUT", "Graceful shutdown deadline, e.g. 10s"},
+}
+
+// Keys that can be read from a file named by KEY_FILE. Other keys ending in
+// _FILE, such as REDIS_TLS_CA_FILE, are plain paths.
+var secretKeys = []string{
+	"REDIS_PASSWORD",
+	"REDIS_SENTINEL_PASSWORD",
+	"DATABASE_URL",
+	"ADMIN_TOKENS",
+	"JWT_SECRET",
+}
+
+// Load builds a Config for a service. args are the command-line arguments
+// without the program name, normally os.Args[1:], and extra the service's
+// own flags.
+func Load(service, defaultPort string, args []string, extra ...Flag) (*Config, error) {
+	cfg, _, err := LoadArgs(service, defaultPort, args, extra...)
+	return cfg, err
+}
+
+// LoadArgs is Load for commands that take arguments after the flags, such
+// as a subcommand. It returns those arguments.
+func LoadArgs(service, defaultPort string, args []string, extra ...Flag) (*Config, []string, error) {
+	known := append(append([]Flag{}, flags...), extra...)
+	fs := flag.NewFlagSet(service, flag.ContinueOnError)
+	configFile := fs.String("config", "", "JSON config file (overrides CONFIG_FILE)")
+	for _, f := range known {
+		fs.String(f.Name, "", f.Usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	// Layer 1: config file
+	fileValues := make(map[string]string)
+	path := *configFile
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	if path != "" {
+		if err := loadFile(path, fileValues); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Layer 2: environment
+	envValues := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			envValues[k] = v
+		}
+	}
+
+	// Layer 3: flags that were set explicitly
+	flagValues := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		for _, k := range known {
+			if k.Name == f.Name {
+				flagValues[k.Key] = f.Value.String()
+			}
+		}
+	})
+
+	values := make(map[string]string)
+	for _, layer := range []map[string]string{fileValues, envValues, flagValues} {
+		if err := resolveSecrets(layer); err != nil {
+			return nil, nil, err
+		}
+		for k, v := range layer {
+			values[k] = v
+		}
+	}
+
+	cfg := &Config{Service: service, values: values}
+
+	cfg.Port = cfg.String("PORT", defaultPort)
+	cfg.ShutdownTimeout = cfg.Duration("SHUTDOWN_TIMEOUT", 10*time.Second)
+	cfg.DatabaseURL = cfg.String("DATABASE_URL", "")
+	cfg.Redis = loadRedisConfig(cfg)
+
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return cfg, fs.Args(), nil
+}
+
+// Validate reports every problem with the configuration at once
+func (c *Config) Validate() error {
+	var errs []error
+	if _, err := strconv.Atoi(c.Port); err != nil {
+		errs = append(errs, fmt.Errorf("PORT must be numeric, got %q", c.Port))
+	}
+	errs = append(errs, c.Redis.validate(c.Bool("REDIS_ALLOW_NO_AUTH", false))...)
+	errs = append(errs, c.Err())
+	return errors.Join(errs...)
+}
+
+// Err reports every value read so far that was set but didn't parse. The
+// getters fall back to their defaults for those, so services check Err once
+// they've read their settings and refuse to start if it's not nil.
+func (c *Config) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.invalid))
+	for key := range c.invalid {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		errs[i] = c.invalid[key]
+	}
+	return errors.Join(errs...)
+}
+
+// Record that key's value doesn't parse, logging it the first time
+func (c *Config) reject(key, value, want string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.invalid[key]; ok {
+		return
+	}
+	if c.invalid == nil {
+		c.invalid = make(map[string]error)
+	}
+	c.invalid[key] = fmt.Errorf("%s must be %s, got %q", key, want, value)
+	slog.Error("Invalid configuration value", "key", key, "value", value, "want", want)
+}
+
+// String returns the value for key, or fallback when it is unset
+func (c *Config) String(key, fallback string) string {
+	if value, ok := c.values[key]; ok {
+		return value
+	}
+	return fallback
+}
+
+// Int returns the integer value for key, or fallback when unset. An invalid
+// value also gives fallback, and is reported by Err.
+func (c *Config) Int(key string, fallback int) int {
+	raw := c.String(key, "")
+	if raw == "" {
+		return fallback
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		c.reject(key, raw, "an integer")
+		return fallback
+	}
+	return value
+}
+
+// Float returns the float value for key, or fallback when unset. An invalid
+// value also gives fallback, and is reported by Err.
+func (c *Config) Float(key string, fallback float64) float64 {
+	raw := c.String(key, "")
+	if raw == "" {
+		return fallback
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		c.reject(key, raw, "a number")
+		return fallback
+	}
+	return value
+}
+
+// Bool returns the boolean value for key, or fallback when unset. An invalid
+// value also gives fallback, and is reported by Err.
+func (c *Config) Bool(key string, fallback bool) bool {
+	raw := c.String(key, "")
+	if raw == "" {
+		return fallback
+	}
+	value, err := strconv.ParseBool(raw)
+	if err != nil {
+		c.reject(key, raw, "true or false")
+		return fallback
+	}
+	return value
+}
+
+// Duration returns the duration value for key, such as "90s" or "5m", or
+// fallback when unset. A number needs a unit, so "5" is invalid rather than
+// guessed at; only "0" may go without. An invalid value also gives fallback,
+// and is reported by Err.
+func (c *Config) Duration(key string, fallback time.Duration) time.Duration {
+	raw := c.String(key, "")
+	if raw == "" {
+		return fallback
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil {
+		c.reject(key, raw, `a duration with a unit, such as "30s" or "5m"`)
+		return fallback
+	}
+	return value
+}
+
+// List returns the comma-separated values for key, or nil when unset
+func (c *Config) List(key string) []string {
+	var items []string
+	for _, item := range strings.Split(c.String(key, ""), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Read a flat JSON object of KEY: value pairs. Non-string values are kept in
+// their JSON form so numbers and booleans parse as expected.
+func loadFile(path string, values map[string]string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	for key, value := range raw {
+		var s string
+		if err := json.Unmarshal(value, &s); err == nil {
+			values[key] = s
+		} else {
+			values[key] = string(value)
+		}
+	}
+	return nil
+}
+
+// Set each secret KEY in a layer from the file named by its KEY_FILE
+func resolveSecrets(layer map[string]string) error {
+	for _, key := range secretKeys {
+		path := layer[key+"_FILE"]
+		if path == "" {
+			continue
+		}
+		secret, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading %s_FILE: %w", key, err)
+		}
+		layer[key] = strings.TrimSpace(string(secret))
+	}
+	return nil
+}
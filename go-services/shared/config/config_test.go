@@ -0,0 +1,60 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Load the config for a test with Redis settings that pass validation
+func loadTestConfig(t *testing.T) *Config {
+	t.Helper()
+	t.Setenv("REDIS_ADDR", "localhost:6379")
+	t.Setenv("REDIS_ALLOW_NO_AUTH", "true")
+	cfg, err := Load("config-test", "0", nil)
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	return cfg
+}
+
+// Unset values give their defaults, and values that don't parse are reported
+// rather than quietly replaced by them
+func TestInvalidValuesAreReported(t *testing.T) {
+	t.Setenv("JANITOR_INTERVAL", "5")
+	t.Setenv("WS_MAX_CONNECTIONS", "lots")
+	t.Setenv("HEALTH_CHECK_TIMEOUT", "2s")
+	cfg := loadTestConfig(t)
+
+	if got := cfg.Duration("HEALTH_CHECK_TIMEOUT", time.Second); got != 2*time.Second {
+		t.Errorf("HEALTH_CHECK_TIMEOUT = %v, want 2s", got)
+	}
+	if got := cfg.Int("WEBHOOK_MAX_ATTEMPTS", 5); got != 5 {
+		t.Errorf("unset WEBHOOK_MAX_ATTEMPTS = %d, want the default", got)
+	}
+	if err := cfg.Err(); err != nil {
+		t.Fatalf("valid and unset values reported: %v", err)
+	}
+
+	cfg.Duration("JANITOR_INTERVAL", time.Minute)
+	cfg.Int("WS_MAX_CONNECTIONS", 0)
+	err := cfg.Err()
+	if err == nil {
+		t.Fatal("invalid values not reported")
+	}
+	for _, key := range []string{"JANITOR_INTERVAL", "WS_MAX_CONNECTIONS"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("error %q doesn't name %s", err, key)
+		}
+	}
+}
+
+// A value Load reads itself stops it
+func TestLoadRejectsInvalidShutdownTimeout(t *testing.T) {
+	t.Setenv("REDIS_ADDR", "localhost:6379")
+	t.Setenv("REDIS_ALLOW_NO_AUTH", "true")
+	t.Setenv("SHUTDOWN_TIMEOUT", "10")
+	if _, err := Load("config-test", "0", nil); err == nil || !strings.Contains(err.Error(), "SHUTDOWN_TIMEOUT") {
+		t.Fatalf("load = %v, want a SHUTDOWN_TIMEOUT error", err)
+	}
+}
@@ -0,0 +1,179 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Redis deployment modes
+const (
+	RedisStandalone = "standalone"
+	RedisSentinel   = "sentinel"
+	RedisCluster    = "cluster"
+)
+
+// RedisConfig describes how to reach Redis
+type RedisConfig struct {
+	Mode     string
+	Addrs    []string // one address, or every sentinel/cluster seed node
+	Username string
+	Password string
+	DB       int
+
+	// Sentinel only
+	MasterName       string
+	SentinelUsername string
+	SentinelPassword string
+
+	TLS TLSConfig
+}
+
+// TLSConfig enables TLS to Redis. The CA file is optional when the server
+// certificate chains to a system root.
+type TLSConfig struct {
+	Enabled            bool
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+func loadRedisConfig(c *Config) RedisConfig {
+	return RedisConfig{
+		Mode:             c.String("REDIS_MODE", RedisStandalone),
+		Addrs:            c.List("REDIS_ADDR"),
+		Username:         c.String("REDIS_USERNAME", ""),
+		Password:         c.String("REDIS_PASSWORD", ""),
+		DB:               c.Int("REDIS_DB", 0),
+		MasterName:       c.String("REDIS_MASTER", ""),
+		SentinelUsername: c.String("REDIS_SENTINEL_USERNAME", ""),
+		SentinelPassword: c.String("REDIS_SENTINEL_PASSWORD", ""),
+		TLS: TLSConfig{
+			Enabled:            c.Bool("REDIS_TLS", false),
+			CAFile:             c.String("REDIS_TLS_CA_FILE", ""),
+			CertFile:           c.String("REDIS_TLS_CERT_FILE", ""),
+			KeyFile:            c.String("REDIS_TLS_KEY_FILE", ""),
+			ServerName:         c.String("REDIS_TLS_SERVER_NAME", ""),
+			InsecureSkipVerify: c.Bool("REDIS_TLS_INSECURE_SKIP_VERIFY", false),
+		},
+	}
+}
+
+func (r RedisConfig) validate(allowNoAuth bool) []error {
+	var errs []error
+
+	if len(r.Addrs) == 0 {
+		errs = append(errs, fmt.Errorf("REDIS_ADDR is required"))
+	}
+	if r.Password == "" && !allowNoAuth {
+		errs = append(errs, fmt.Errorf("REDIS_PASSWORD (or REDIS_PASSWORD_FILE) is required; set REDIS_ALLOW_NO_AUTH=true for an unauthenticated local Redis"))
+	}
+
+	switch r.Mode {
+	case RedisStandalone:
+		if len(r.Addrs) > 1 {
+			errs = append(errs, fmt.Errorf("REDIS_ADDR has %d addresses but REDIS_MODE is standalone", len(r.Addrs)))
+		}
+	case RedisSentinel:
+		if r.MasterName == "" {
+			errs = append(errs, fmt.Errorf("REDIS_MASTER is required in sentinel mode"))
+		}
+	case RedisCluster:
+		if r.DB != 0 {
+			errs = append(errs, fmt.Errorf("REDIS_DB must be 0 in cluster mode"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("REDIS_MODE must be standalone, sentinel or cluster, got %q", r.Mode))
+	}
+
+	if (r.TLS.CertFile == "") != (r.TLS.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("REDIS_TLS_CERT_FILE and REDIS_TLS_KEY_FILE must be set together"))
+	}
+	for _, path := range []string{r.TLS.CAFile, r.TLS.CertFile, r.TLS.KeyFile} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			errs = append(errs, fmt.Errorf("TLS file: %w", err))
+		}
+	}
+
+	return errs
+}
+
+// NewRedisClient connects using the configured mode. The returned client is
+// a *redis.Client, *redis.FailoverClient or *redis.ClusterClient.
+func NewRedisClient(r RedisConfig) (redis.UniversalClient, error) {
+	tlsConfig, err := r.TLS.build()
+	if err != nil {
+		return nil, err
+	}
+
+	switch r.Mode {
+	case RedisSentinel:
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       r.MasterName,
+			SentinelAddrs:    r.Addrs,
+			SentinelUsername: r.SentinelUsername,
+			SentinelPassword: r.SentinelPassword,
+			Username:         r.Username,
+			Password:         r.Password,
+			DB:               r.DB,
+			TLSConfig:        tlsConfig,
+		}), nil
+	case RedisCluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     r.Addrs,
+			Username:  r.Username,
+			Password:  r.Password,
+			TLSConfig: tlsConfig,
+		}), nil
+	default:
+		return redis.NewClient(&redis.Options{
+			Addr:      r.Addrs[0],
+			Username:  r.Username,
+			Password:  r.Password,
+			DB:        r.DB,
+			TLSConfig: tlsConfig,
+		}), nil
+	}
+}
+
+func (t TLSConfig) build() (*tls.Config, error) {
+	if !t.Enabled {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading Redis CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", t.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading Redis client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,373 @@
+// Package contract checks that the messages published on a Redis channel
+// still decode into the Go type a service reads them into.
+//
+// Payloads come from fixture files, one JSON message per file under
+// <dir>/<channel>/, and from event-recorder recordings listed in
+// CONTRACT_RECORDINGS. Each payload is decoded into the type and encoded
+// again, and the two are compared field by field:
+//
+//   - unknown fields are sent but have no field in the type, so are dropped
+//   - missing fields are in the type but weren't sent
+//   - lossy fields decode to something other than what was sent
+//
+// A null or absent value that decodes to the zero value isn't lossy, since
+// the service can't tell them apart anyway. Unknown and missing fields are
+// reported; decode errors, lossy fields and absent required fields are
+// problems.
+package contract
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Contract is the Go type a service decodes a channel's messages into
+type Contract struct {
+	Channel string
+	// A value of the type, such as Order{}
+	Type interface{}
+	// Fields every message must carry, not null, as dotted paths such as
+	// "restaurant.id"
+	Required []string
+	// Top-level fields that aren't part of the message, such as trace
+	// context. DefaultIgnore is used if nil.
+	Ignore []string
+}
+
+// DefaultIgnore is the trace context tracing.InjectPayload adds and
+// tracing.ExtractPayload reads
+var DefaultIgnore = []string{"_trace", "traceparent", "tracestate"}
+
+// Report is what checking a channel's payloads found. Unknown and Missing
+// count the payloads each field path was unknown or missing in.
+type Report struct {
+	Channel  string
+	Payloads int
+	Unknown  map[string]int
+	Missing  map[string]int
+	Problems []string
+}
+
+// OK reports whether every payload decoded losslessly with its required
+// fields
+func (r *Report) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %d payloads, %d problems\n", r.Channel, r.Payloads, len(r.Problems))
+	writeCounts(&b, "unknown", r.Unknown, r.Payloads)
+	writeCounts(&b, "missing", r.Missing, r.Payloads)
+	for _, problem := range r.Problems {
+		fmt.Fprintf(&b, "  problem: %s\n", problem)
+	}
+	return b.String()
+}
+
+func writeCounts(b *strings.Builder, label string, counts map[string]int, total int) {
+	paths := make([]string, 0, len(counts))
+	for path := range counts {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fmt.Fprintf(b, "  %s: %s (%d/%d)\n", label, path, counts[path], total)
+	}
+}
+
+// Check decodes each payload into the contract's type and reports what
+// doesn't match
+func (c Contract) Check(payloads []Payload) *Report {
+	r := &Report{
+		Channel:  c.Channel,
+		Payloads: len(payloads),
+		Unknown:  make(map[string]int),
+		Missing:  make(map[string]int),
+	}
+	ignore := c.Ignore
+	if ignore == nil {
+		ignore = DefaultIgnore
+	}
+	typ := reflect.TypeOf(c.Type)
+
+	for _, payload := range payloads {
+		var sent interface{}
+		if err := json.Unmarshal(payload.Data, &sent); err != nil {
+			r.problem(payload, "", "not JSON: %v", err)
+			continue
+		}
+		if fields, ok := sent.(map[string]interface{}); ok {
+			for _, name := range ignore {
+				delete(fields, name)
+			}
+		}
+
+		// Decode as the service does, then see what survives
+		target := reflect.New(typ)
+		if err := json.Unmarshal(payload.Data, target.Interface()); err != nil {
+			r.problem(payload, "", "doesn't decode: %v", err)
+			continue
+		}
+		encoded, err := json.Marshal(target.Interface())
+		if err != nil {
+			r.problem(payload, "", "doesn't encode again: %v", err)
+			continue
+		}
+		var decoded interface{}
+		json.Unmarshal(encoded, &decoded)
+
+		w := walker{report: r, payload: payload, unknown: make(map[string]bool), missing: make(map[string]bool)}
+		w.walk("", sent, decoded, typ)
+		for path := range w.unknown {
+			r.Unknown[path]++
+		}
+		for path := range w.missing {
+			r.Missing[path]++
+		}
+		for _, path := range c.Required {
+			if value, ok := lookup(sent, path); !ok || value == nil {
+				r.problem(payload, path, "required but not sent")
+			}
+		}
+	}
+	return r
+}
+
+func (r *Report) problem(payload Payload, path, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if path != "" {
+		message = path + ": " + message
+	}
+	r.Problems = append(r.Problems, payload.Source+": "+message)
+}
+
+// walker compares a payload as sent with the same payload decoded into the
+// Go type and encoded again
+type walker struct {
+	report  *Report
+	payload Payload
+	// Field paths unknown or missing in this payload. A field missing from
+	// every element of an array counts once.
+	unknown, missing map[string]bool
+}
+
+var (
+	timeType        = reflect.TypeOf(time.Time{})
+	unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+func (w *walker) walk(path string, sent, decoded interface{}, typ reflect.Type) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	switch {
+	case typ == timeType, reflect.PtrTo(typ).Implements(unmarshalerType):
+		w.compare(path, sent, decoded, typ)
+
+	case typ.Kind() == reflect.Struct:
+		sentFields, ok := sent.(map[string]interface{})
+		if !ok {
+			// null, which leaves the zero value
+			return
+		}
+		decodedFields, _ := decoded.(map[string]interface{})
+		fields := jsonFields(typ)
+		for name, value := range sentFields {
+			field, ok := fields.lookup(name)
+			if !ok {
+				w.unknown[join(path, name)] = true
+				continue
+			}
+			w.walk(join(path, field.name), value, decodedFields[field.name], field.typ)
+		}
+		for _, field := range fields {
+			if _, ok := lookupFold(sentFields, field.name); !ok {
+				w.missing[join(path, field.name)] = true
+			}
+		}
+
+	case typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.Uint8:
+		// []byte is sent as base64
+		w.compare(path, sent, decoded, typ)
+
+	case typ.Kind() == reflect.Slice, typ.Kind() == reflect.Array:
+		sentItems, ok := sent.([]interface{})
+		if !ok {
+			w.compare(path, sent, decoded, typ)
+			return
+		}
+		decodedItems, _ := decoded.([]interface{})
+		if len(decodedItems) != len(sentItems) {
+			w.lossy(path, sent, decoded)
+			return
+		}
+		for i := range sentItems {
+			w.walk(path+"[]", sentItems[i], decodedItems[i], typ.Elem())
+		}
+
+	case typ.Kind() == reflect.Map && typ.Elem().Kind() != reflect.Interface:
+		sentValues, ok := sent.(map[string]interface{})
+		if !ok {
+			w.compare(path, sent, decoded, typ)
+			return
+		}
+		decodedValues, _ := decoded.(map[string]interface{})
+		for key, value := range sentValues {
+			w.walk(path+"{}", value, decodedValues[key], typ.Elem())
+		}
+
+	default:
+		w.compare(path, sent, decoded, typ)
+	}
+}
+
+// Compare a value the Go type holds as a whole
+func (w *walker) compare(path string, sent, decoded interface{}, typ reflect.Type) {
+	if reflect.DeepEqual(sent, decoded) {
+		return
+	}
+	if isZero(sent) && isZero(decoded) {
+		return
+	}
+	if typ == timeType {
+		sentTime, err1 := parseTime(sent)
+		decodedTime, err2 := parseTime(decoded)
+		if err1 == nil && err2 == nil && sentTime.Equal(decodedTime) {
+			return
+		}
+	}
+	w.lossy(path, sent, decoded)
+}
+
+func (w *walker) lossy(path string, sent, decoded interface{}) {
+	sentJSON, _ := json.Marshal(sent)
+	decodedJSON, _ := json.Marshal(decoded)
+	w.report.problem(w.payload, path, "sent %s, decoded as %s", sentJSON, decodedJSON)
+}
+
+// isZero reports whether a decoded JSON value is null or what a zero Go
+// value encodes as
+func isZero(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		if v == "" {
+			return true
+		}
+		t, err := time.Parse(time.RFC3339Nano, v)
+		return err == nil && t.IsZero()
+	case float64:
+		return v == 0
+	case bool:
+		return !v
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+func parseTime(value interface{}) (time.Time, error) {
+	s, ok := value.(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("not a string")
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// Find the value at a dotted path
+func lookup(value interface{}, path string) (interface{}, bool) {
+	for _, name := range strings.Split(path, ".") {
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = lookupFold(fields, name); !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// Find a field by name, falling back to the case-insensitive match
+// encoding/json accepts
+func lookupFold(fields map[string]interface{}, name string) (interface{}, bool) {
+	if value, ok := fields[name]; ok {
+		return value, true
+	}
+	for key, value := range fields {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// A struct field as encoding/json names it
+type field struct {
+	name string
+	typ  reflect.Type
+}
+
+type fieldList []field
+
+func (fields fieldList) lookup(name string) (field, bool) {
+	for _, f := range fields {
+		if f.name == name {
+			return f, true
+		}
+	}
+	for _, f := range fields {
+		if strings.EqualFold(f.name, name) {
+			return f, true
+		}
+	}
+	return field{}, false
+}
+
+// The fields of a struct type as encoding/json sees them, including those
+// of embedded structs
+func jsonFields(typ reflect.Type) fieldList {
+	var fields fieldList
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			embedded := f.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				fields = append(fields, jsonFields(embedded)...)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, field{name: name, typ: f.Type})
+	}
+	return fields
+}
@@ -0,0 +1,125 @@
+package contract
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Payload is a message published on a channel, and the fixture file or
+// recording line it came from
+type Payload struct {
+	Source string
+	Data   []byte
+}
+
+// RecordingsEnv names the environment variable listing event-recorder
+// recordings to check along with the fixtures: comma-separated files or
+// glob patterns
+const RecordingsEnv = "CONTRACT_RECORDINGS"
+
+// Load returns the payloads for channel: each <dir>/<channel>/*.json
+// fixture, then every message on channel in the recordings listed in
+// CONTRACT_RECORDINGS
+func Load(dir, channel string) ([]Payload, error) {
+	files, err := filepath.Glob(filepath.Join(dir, channel, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	var payloads []Payload
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, Payload{Source: file, Data: data})
+	}
+
+	recordings, err := recordingFiles(os.Getenv(RecordingsEnv))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range recordings {
+		recorded, err := readRecording(file, channel)
+		if err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, recorded...)
+	}
+	return payloads, nil
+}
+
+// Channels returns the channels with a fixture directory in dir
+func Channels(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var channels []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			channels = append(channels, entry.Name())
+		}
+	}
+	return channels, nil
+}
+
+func recordingFiles(list string) ([]string, error) {
+	var files []string
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", RecordingsEnv, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("%s: no recordings match %s", RecordingsEnv, pattern)
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// A line of an event-recorder recording
+type recordedEvent struct {
+	Channel string          `json:"channel"`
+	Payload json.RawMessage `json:"payload"`
+	Text    *string         `json:"text"`
+	Gap     bool            `json:"gap"`
+}
+
+// Read the messages on channel from an event-recorder recording
+func readRecording(file, channel string) ([]Payload, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var payloads []Payload
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var event recordedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, line, err)
+		}
+		if event.Gap || event.Channel != channel {
+			continue
+		}
+		data := []byte(event.Payload)
+		if event.Text != nil {
+			data = []byte(*event.Text)
+		}
+		payloads = append(payloads, Payload{Source: fmt.Sprintf("%s:%d", file, line), Data: data})
+	}
+	return payloads, scanner.Err()
+}
@@ -0,0 +1,24 @@
+package contract
+
+import "testing"
+
+// Verify checks the channel's payloads in dir and the configured
+// recordings against c from a test, logging the report and failing the
+// test on any problem or if there are no payloads to check
+func Verify(t testing.TB, dir string, c Contract) *Report {
+	t.Helper()
+	payloads, err := Load(dir, c.Channel)
+	if err != nil {
+		t.Fatalf("load %s payloads: %v", c.Channel, err)
+	}
+	if len(payloads) == 0 {
+		t.Fatalf("no payloads for %s in %s", c.Channel, dir)
+	}
+
+	report := c.Check(payloads)
+	t.Log("\n" + report.String())
+	if !report.OK() {
+		t.Errorf("%s: %d problems", c.Channel, len(report.Problems))
+	}
+	return report
+}
@@ -0,0 +1,85 @@
+// Package eventbus publishes events between the services. Production uses
+// Redis pub/sub; the in-memory bus lets handlers run without Redis.
+package eventbus
+
+import (
+	"context"
+	"sync"
+
+	"github.com/foodo/shared/tracing"
+	"github.com/go-redis/redis/v8"
+)
+
+// Bus publishes a JSON payload on a channel
+type Bus interface {
+	Publish(ctx context.Context, channel string, payload []byte) error
+}
+
+// Redis publishes with Redis pub/sub, carrying the caller's trace context in
+// the payload
+type Redis struct {
+	client redis.UniversalClient
+}
+
+// NewRedis returns a Bus that publishes through client
+func NewRedis(client redis.UniversalClient) *Redis {
+	return &Redis{client: client}
+}
+
+func (b *Redis) Publish(ctx context.Context, channel string, payload []byte) error {
+	return b.client.Publish(ctx, channel, tracing.InjectPayload(ctx, payload)).Err()
+}
+
+// Message is an event published on a Memory bus
+type Message struct {
+	Channel string
+	Payload []byte
+}
+
+// Memory keeps every published message and hands it to the channel's
+// subscribers synchronously
+type Memory struct {
+	mu          sync.Mutex
+	messages    []Message
+	subscribers map[string][]func(Message)
+}
+
+// NewMemory returns an empty in-memory Bus
+func NewMemory() *Memory {
+	return &Memory{subscribers: make(map[string][]func(Message))}
+}
+
+func (b *Memory) Publish(ctx context.Context, channel string, payload []byte) error {
+	msg := Message{Channel: channel, Payload: append([]byte(nil), payload...)}
+
+	b.mu.Lock()
+	b.messages = append(b.messages, msg)
+	subscribers := append([]func(Message){}, b.subscribers[channel]...)
+	b.mu.Unlock()
+
+	for _, handle := range subscribers {
+		handle(msg)
+	}
+	return nil
+}
+
+// Subscribe calls handle for every later message on channel
+func (b *Memory) Subscribe(channel string, handle func(Message)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers[channel] = append(b.subscribers[channel], handle)
+}
+
+// Messages returns the messages published on channel so far, or on every
+// channel if channel is ""
+func (b *Memory) Messages(channel string) []Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var messages []Message
+	for _, msg := range b.messages {
+		if channel == "" || msg.Channel == channel {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
@@ -0,0 +1,69 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Consumer tracks whether a pub/sub or stream consumer loop is running and
+// when it last received a message
+type Consumer struct {
+	running     atomic.Bool
+	lastMessage atomic.Int64 // unix nanoseconds, 0 if none yet
+	startedAt   atomic.Int64
+}
+
+// Started marks the consumer loop as running
+func (c *Consumer) Started() {
+	c.startedAt.Store(time.Now().UnixNano())
+	c.running.Store(true)
+}
+
+// Stopped marks the consumer loop as exited
+func (c *Consumer) Stopped() {
+	c.running.Store(false)
+}
+
+// Received records that a message arrived
+func (c *Consumer) Received() {
+	c.lastMessage.Store(time.Now().UnixNano())
+}
+
+// Running reports whether the consumer loop is active
+func (c *Consumer) Running() bool {
+	return c.running.Load()
+}
+
+// Check fails when the consumer isn't running, or when maxIdle is set and
+// no message has arrived for longer than that
+func (c *Consumer) Check(maxIdle time.Duration) Check {
+	return func(ctx context.Context) (map[string]interface{}, error) {
+		details := map[string]interface{}{
+			"running": c.Running(),
+		}
+
+		// Measure idle time from the last message, or from startup if none
+		since := c.lastMessage.Load()
+		if since != 0 {
+			details["last_message_at"] = time.Unix(0, since).Format(time.RFC3339)
+		} else {
+			since = c.startedAt.Load()
+		}
+		var idle time.Duration
+		if since != 0 {
+			idle = time.Since(time.Unix(0, since))
+			details["idle_seconds"] = int64(idle.Seconds())
+		}
+
+		if !c.Running() {
+			return details, errors.New("consumer is not running")
+		}
+		if maxIdle > 0 && idle > maxIdle {
+			return details, fmt.Errorf("no message for %s, limit %s", idle.Round(time.Second), maxIdle)
+		}
+		return details, nil
+	}
+}
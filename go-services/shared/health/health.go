@@ -0,0 +1,185 @@
+// Package health serves the /livez and /readyz probes. Liveness only says
+// the process is serving HTTP; readiness runs every registered component
+// check and fails while the service is draining for shutdown.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Check reports a component's details, returning an error if it is unhealthy
+type Check func(ctx context.Context) (map[string]interface{}, error)
+
+// Component is one entry in the readiness response
+type Component struct {
+	Status  string                 `json:"status"` // ok, fail
+	Error   string                 `json:"error,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// Checker holds the readiness checks for a service
+type Checker struct {
+	service  string
+	timeout  time.Duration
+	started  time.Time
+	draining atomic.Bool
+
+	mu     sync.RWMutex
+	checks map[string]Check
+}
+
+// NewChecker returns a Checker whose checks each get timeout to finish
+func NewChecker(service string, timeout time.Duration) *Checker {
+	return &Checker{
+		service: service,
+		timeout: timeout,
+		started: time.Now(),
+		checks:  make(map[string]Check),
+	}
+}
+
+// Add registers a named readiness check
+func (c *Checker) Add(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks[name] = check
+}
+
+// SetDraining marks the service as shutting down so readiness fails and
+// load balancers stop routing new work to it
+func (c *Checker) SetDraining() {
+	c.draining.Store(true)
+}
+
+// Drain sets draining and then waits for delay, or until ctx is done, so
+// load balancers polling /readyz can take the instance out of rotation
+// before its listener closes
+func (c *Checker) Drain(ctx context.Context, delay time.Duration) {
+	c.SetDraining()
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+	}
+}
+
+// Draining reports whether SetDraining has been called
+func (c *Checker) Draining() bool {
+	return c.draining.Load()
+}
+
+// Run executes every check concurrently and reports whether all passed
+func (c *Checker) Run(ctx context.Context) (bool, map[string]Component) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	c.mu.RLock()
+	names := make([]string, 0, len(c.checks))
+	for name := range c.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	results := make([]Component, len(names))
+
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			details, err := check(ctx)
+			results[i] = Component{Status: "ok", Details: details}
+			if err != nil {
+				results[i].Status = "fail"
+				results[i].Error = err.Error()
+			}
+		}(i, c.checks[name])
+	}
+	c.mu.RUnlock()
+	wg.Wait()
+
+	ready := true
+	components := make(map[string]Component, len(names))
+	for i, name := range names {
+		components[name] = results[i]
+		if results[i].Status != "ok" {
+			ready = false
+		}
+	}
+	return ready, components
+}
+
+// LivenessHandler answers /livez. It doesn't touch dependencies, so a Redis
+// outage makes the service unready rather than getting it restarted.
+func (c *Checker) LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":         "ok",
+		"service":        c.service,
+		"uptime_seconds": int64(time.Since(c.started).Seconds()),
+	})
+}
+
+// ReadinessHandler answers /readyz with 200 when every check passes and the
+// service isn't draining, or 503 otherwise
+func (c *Checker) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	ready, components := c.Run(r.Context())
+	draining := c.Draining()
+
+	status, code := "ready", http.StatusOK
+	if !ready || draining {
+		status, code = "not_ready", http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":     status,
+		"service":    c.service,
+		"draining":   draining,
+		"timestamp":  time.Now().Format(time.RFC3339),
+		"components": components,
+	})
+}
+
+// RedisCheck pings Redis and fails if the round trip exceeds maxLatency
+func RedisCheck(client redis.UniversalClient, maxLatency time.Duration) Check {
+	return func(ctx context.Context) (map[string]interface{}, error) {
+		start := time.Now()
+		err := client.Ping(ctx).Err()
+		latency := time.Since(start)
+		details := map[string]interface{}{
+			"latency_ms": float64(latency.Microseconds()) / 1000,
+		}
+		if err != nil {
+			return details, err
+		}
+		if maxLatency > 0 && latency > maxLatency {
+			return details, fmt.Errorf("ping took %s, limit %s", latency.Round(time.Millisecond), maxLatency)
+		}
+		return details, nil
+	}
+}
+
+// ConnectionsCheck reports the number of open WebSocket connections and
+// fails once max (if set) is reached, steering new clients to other nodes
+func ConnectionsCheck(open func() int64, max int) Check {
+	return func(ctx context.Context) (map[string]interface{}, error) {
+		n := open()
+		details := map[string]interface{}{"connections": n}
+		if max > 0 {
+			details["max_connections"] = max
+			if n >= int64(max) {
+				return details, fmt.Errorf("%d of %d connections in use", n, max)
+			}
+		}
+		return details, nil
+	}
+}
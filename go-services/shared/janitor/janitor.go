@@ -0,0 +1,185 @@
+// Package janitor runs a service's retention tasks on a schedule, in one
+// replica at a time.
+//
+// Every replica runs a Janitor. At each interval they race for a Redis lease
+// that lasts the interval; the winner runs the pass and the rest wait for the
+// next one. A pass is cut short if it would outlive its lease.
+package janitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/foodo/shared/config"
+	"github.com/foodo/shared/metrics"
+	"github.com/go-redis/redis/v8"
+)
+
+// Task removes or archives one family of records, adding what it did to the
+// report
+type Task func(ctx context.Context, report *Report) error
+
+// Report describes one pass
+type Report struct {
+	Service    string            `json:"service"`
+	Replica    string            `json:"replica"`
+	StartedAt  time.Time         `json:"startedAt"`
+	DurationMs int64             `json:"durationMs"`
+	Counts     map[string]int    `json:"counts"`
+	Errors     map[string]string `json:"errors,omitempty"`
+
+	mu sync.Mutex
+}
+
+// Add counts n records of a kind, such as "drivers_removed"
+func (r *Report) Add(kind string, n int) {
+	if n == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Counts[kind] += n
+	metrics.JanitorRemoved.WithLabelValues(kind).Add(float64(n))
+}
+
+type namedTask struct {
+	name string
+	run  Task
+}
+
+// Janitor runs retention tasks for a service
+type Janitor struct {
+	Client   redis.UniversalClient
+	Service  string
+	Interval time.Duration
+
+	replica string
+	tasks   []namedTask
+}
+
+// New returns a Janitor that runs every JANITOR_INTERVAL (default 5m). The
+// interval is also the lease, so passes across all replicas are at least
+// that far apart.
+func New(cfg *config.Config, client redis.UniversalClient) *Janitor {
+	replica, _ := os.Hostname()
+	return &Janitor{
+		Client:   client,
+		Service:  cfg.Service,
+		Interval: cfg.Duration("JANITOR_INTERVAL", 5*time.Minute),
+		replica:  fmt.Sprintf("%s:%d", replica, os.Getpid()),
+	}
+}
+
+// Add registers a task. Tasks run in the order they were added.
+func (j *Janitor) Add(name string, task Task) {
+	j.tasks = append(j.tasks, namedTask{name: name, run: task})
+}
+
+// Run attempts a pass every interval until ctx is cancelled
+func (j *Janitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			j.RunOnce(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// RunOnce runs a pass if no other replica has within the interval. It
+// returns the report, or nil if another replica holds the lease.
+func (j *Janitor) RunOnce(ctx context.Context) *Report {
+	acquired, err := j.Client.SetNX(ctx, j.leaseKey(), j.replica, j.Interval).Result()
+	if err != nil {
+		slog.WarnContext(ctx, "Janitor could not take its lease", "error", err)
+		return nil
+	}
+	if !acquired {
+		return nil
+	}
+
+	passCtx, cancel := context.WithTimeout(ctx, j.Interval)
+	defer cancel()
+
+	report := &Report{
+		Service:   j.Service,
+		Replica:   j.replica,
+		StartedAt: time.Now().UTC(),
+		Counts:    make(map[string]int),
+	}
+	for _, task := range j.tasks {
+		if err := task.run(passCtx, report); err != nil {
+			if report.Errors == nil {
+				report.Errors = make(map[string]string)
+			}
+			report.Errors[task.name] = err.Error()
+			slog.ErrorContext(ctx, "Janitor task failed", "task", task.name, "error", err)
+		}
+	}
+	report.DurationMs = time.Since(report.StartedAt).Milliseconds()
+
+	result := "ok"
+	if len(report.Errors) > 0 {
+		result = "failed"
+	}
+	metrics.JanitorPasses.WithLabelValues(result).Inc()
+	slog.InfoContext(ctx, "Janitor pass", "duration_ms", report.DurationMs, "counts", formatCounts(report.Counts), "errors", len(report.Errors))
+
+	// Keep the report for operators; it outlives a few missed passes
+	reportJSON, _ := json.Marshal(report)
+	if err := j.Client.Set(ctx, j.reportKey(), reportJSON, 10*j.Interval).Err(); err != nil {
+		slog.WarnContext(ctx, "Failed to save janitor report", "error", err)
+	}
+	return report
+}
+
+// LastReport returns the report of the most recent pass by any replica, or
+// nil if there hasn't been one recently
+func (j *Janitor) LastReport(ctx context.Context) (*Report, error) {
+	reportJSON, err := j.Client.Get(ctx, j.reportKey()).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var report Report
+	if err := json.Unmarshal(reportJSON, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+func (j *Janitor) leaseKey() string {
+	return "janitor:" + j.Service + ":lease"
+}
+
+func (j *Janitor) reportKey() string {
+	return "janitor:" + j.Service + ":last_report"
+}
+
+// Render counts as "kind=n kind=n" in a stable order for the log line
+func formatCounts(counts map[string]int) string {
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	s := ""
+	for i, kind := range kinds {
+		if i > 0 {
+			s += " "
+		}
+		s += fmt.Sprintf("%s=%d", kind, counts[kind])
+	}
+	return s
+}
@@ -0,0 +1,83 @@
+package logging
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RequestIDHeader carries the request ID in and out of the services
+const RequestIDHeader = "X-Request-ID"
+
+// Quiet paths are polled constantly, so their access logs drop to debug
+var quietPaths = map[string]bool{
+	"/health":  true,
+	"/livez":   true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+// Middleware tags each request with the incoming X-Request-ID, or a new one,
+// echoes it in the response and writes an access log line on completion
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		ctx := WithRequestID(r.Context(), id)
+		r = r.WithContext(ctx)
+
+		// WebSocket handlers hijack the connection, so don't wrap the writer
+		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			slog.InfoContext(ctx, "WebSocket upgrade requested", "path", r.URL.Path)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		sw := NewStatusWriter(w)
+		next.ServeHTTP(sw, r)
+
+		level := slog.LevelInfo
+		if quietPaths[r.URL.Path] {
+			level = slog.LevelDebug
+		}
+		slog.LogAttrs(ctx, level, "Request completed",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", sw.Status),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+		)
+	})
+}
+
+// StatusWriter records the status of the response written through it
+type StatusWriter struct {
+	http.ResponseWriter
+	Status int
+}
+
+// NewStatusWriter wraps w to record the response status. A w that's
+// already a StatusWriter, from the tracing middleware say, is reused.
+func NewStatusWriter(w http.ResponseWriter) *StatusWriter {
+	if sw, ok := w.(*StatusWriter); ok {
+		return sw
+	}
+	return &StatusWriter{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (w *StatusWriter) WriteHeader(status int) {
+	w.Status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func newRequestID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,164 @@
+// Package logging configures structured JSON logging for the Go services.
+//
+// Correlation IDs stored on a context with WithRequestID, WithOrderID,
+// WithDriverID and WithConnectionID are added to every record logged with
+// that context, along with the active trace ID, so one order can be followed
+// across services by grepping for its order_id.
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/foodo/shared/config"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Field names shared by every service
+const (
+	RequestIDKey    = "request_id"
+	OrderIDKey      = "order_id"
+	DriverIDKey     = "driver_id"
+	ConnectionIDKey = "connection_id"
+	TraceIDKey      = "trace_id"
+)
+
+// Level is the runtime-adjustable level of the default logger
+var Level = new(slog.LevelVar)
+
+// Setup installs a JSON logger as the slog and log package default. The
+// starting level comes from LOG_LEVEL (debug, info, warn, error).
+func Setup(cfg *config.Config) {
+	if level, ok := ParseLevel(cfg.String("LOG_LEVEL", "info")); ok {
+		Level.Set(level)
+	}
+
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: Level})
+	slog.SetDefault(slog.New(&contextHandler{Handler: handler}).With("service", cfg.Service))
+}
+
+// ParseLevel converts a level name to a slog.Level
+func ParseLevel(name string) (slog.Level, bool) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.ToUpper(name))); err != nil {
+		return 0, false
+	}
+	return level, true
+}
+
+// Fatal logs at error level and exits
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type fieldsKey struct{}
+
+// fields holds correlation IDs; each With* call copies it so contexts
+// derived from a shared parent don't see each other's values
+type fields struct {
+	requestID, orderID, driverID, connectionID string
+}
+
+func fromContext(ctx context.Context) fields {
+	if f, ok := ctx.Value(fieldsKey{}).(fields); ok {
+		return f
+	}
+	return fields{}
+}
+
+// WithRequestID attaches a request ID to ctx
+func WithRequestID(ctx context.Context, id string) context.Context {
+	f := fromContext(ctx)
+	f.requestID = id
+	return context.WithValue(ctx, fieldsKey{}, f)
+}
+
+// WithOrderID attaches an order ID to ctx
+func WithOrderID(ctx context.Context, id string) context.Context {
+	f := fromContext(ctx)
+	f.orderID = id
+	return context.WithValue(ctx, fieldsKey{}, f)
+}
+
+// WithDriverID attaches a driver ID to ctx
+func WithDriverID(ctx context.Context, id string) context.Context {
+	f := fromContext(ctx)
+	f.driverID = id
+	return context.WithValue(ctx, fieldsKey{}, f)
+}
+
+// WithConnectionID attaches a WebSocket connection ID to ctx
+func WithConnectionID(ctx context.Context, id string) context.Context {
+	f := fromContext(ctx)
+	f.connectionID = id
+	return context.WithValue(ctx, fieldsKey{}, f)
+}
+
+// RequestID returns the request ID stored on ctx, if any
+func RequestID(ctx context.Context) string {
+	return fromContext(ctx).requestID
+}
+
+// contextHandler adds correlation IDs from the record's context
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	f := fromContext(ctx)
+	if f.requestID != "" {
+		record.AddAttrs(slog.String(RequestIDKey, f.requestID))
+	}
+	if f.orderID != "" {
+		record.AddAttrs(slog.String(OrderIDKey, f.orderID))
+	}
+	if f.driverID != "" {
+		record.AddAttrs(slog.String(DriverIDKey, f.driverID))
+	}
+	if f.connectionID != "" {
+		record.AddAttrs(slog.String(ConnectionIDKey, f.connectionID))
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.HasTraceID() {
+		record.AddAttrs(slog.String(TraceIDKey, spanContext.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithGroup(name)}
+}
+
+// LevelHandler reports the current log level on GET and changes it on PUT
+// with a body like {"level": "debug"}
+func LevelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var requestBody struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		level, ok := ParseLevel(requestBody.Level)
+		if !ok {
+			http.Error(w, "Unknown log level", http.StatusBadRequest)
+			return
+		}
+		Level.Set(level)
+		slog.InfoContext(r.Context(), "Log level changed", "level", level.String())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"level": strings.ToLower(Level.Level().String()),
+	})
+}
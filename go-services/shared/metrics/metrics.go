@@ -0,0 +1,114 @@
+// Package metrics holds the Prometheus metrics common to the Go services.
+// Service-specific metrics live next to the code that records them.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Namespace prefixes every metric exported by the services
+const Namespace = "foodo"
+
+var (
+	// RedisErrors counts failed Redis commands, excluding redis.Nil misses
+	RedisErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "redis_command_errors_total",
+		Help:      "Redis commands that returned an error.",
+	}, []string{"command"})
+
+	// PubSubMessages counts pub/sub messages handled, by channel
+	PubSubMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "pubsub_messages_processed_total",
+		Help:      "Redis pub/sub messages processed.",
+	}, []string{"channel"})
+
+	// PubSubReconnects counts subscriptions restarted after a failure
+	PubSubReconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "pubsub_reconnects_total",
+		Help:      "Redis pub/sub subscriptions re-established after a failure.",
+	})
+
+	// WebSocketConnections tracks open sockets by connection type
+	WebSocketConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "websocket_connections",
+		Help:      "Currently open WebSocket connections.",
+	}, []string{"type"})
+
+	// WebSocketDisconnects counts closed sockets by type and reason
+	// (timeout, closed, error)
+	WebSocketDisconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "websocket_disconnects_total",
+		Help:      "WebSocket connections removed, by reason.",
+	}, []string{"type", "reason"})
+
+	// RateLimited counts requests and WebSocket messages turned away by a
+	// rate limit, by route
+	RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "rate_limited_total",
+		Help:      "Requests and messages rejected by rate limits.",
+	}, []string{"route"})
+
+	// JanitorPasses counts retention passes by result (ok, failed)
+	JanitorPasses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "janitor_passes_total",
+		Help:      "Retention janitor passes run by this replica.",
+	}, []string{"result"})
+
+	// JanitorRemoved counts what retention passes removed or archived, by
+	// kind, e.g. drivers_removed
+	JanitorRemoved = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "janitor_removed_total",
+		Help:      "Records removed or archived by the retention janitor.",
+	}, []string{"kind"})
+)
+
+// Handler serves the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// RedisHook counts command errors. Install it with client.AddHook.
+type RedisHook struct{}
+
+var _ redis.Hook = RedisHook{}
+
+func (RedisHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (RedisHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	recordRedisError(cmd)
+	return nil
+}
+
+func (RedisHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (RedisHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	for _, cmd := range cmds {
+		recordRedisError(cmd)
+	}
+	return nil
+}
+
+func recordRedisError(cmd redis.Cmder) {
+	if err := cmd.Err(); err != nil && !errors.Is(err, redis.Nil) {
+		RedisErrors.WithLabelValues(cmd.Name()).Inc()
+	}
+}
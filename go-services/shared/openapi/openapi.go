@@ -0,0 +1,147 @@
+// Package openapi validates requests to the Go services against their
+// OpenAPI documents and serves the documents. Invalid requests get a 400
+// with one issue per failing field.
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+)
+
+// ValidationIssue describes one problem with a request
+type ValidationIssue struct {
+	In      string `json:"in"` // path, query, header or body
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// ValidationErrorResponse is returned with 400 when a request fails validation
+type ValidationErrorResponse struct {
+	Error   string            `json:"error"`
+	Details []ValidationIssue `json:"details"`
+}
+
+// Spec is a service's OpenAPI document, loaded for validating requests
+type Spec struct {
+	document []byte
+	router   routers.Router
+}
+
+// Load parses and validates an OpenAPI document, usually one embedded in
+// the service
+func Load(document []byte) (*Spec, error) {
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromData(document)
+	if err != nil {
+		return nil, err
+	}
+	if err := doc.Validate(loader.Context); err != nil {
+		return nil, err
+	}
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return nil, err
+	}
+	return &Spec{document: document, router: router}, nil
+}
+
+// Handler serves the OpenAPI document
+func (s *Spec) Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(s.document)
+}
+
+// Middleware checks parameters and bodies against the OpenAPI document.
+// Routes missing from the document are passed through so the mux router
+// can answer 404/405 as usual. Security requirements aren't checked here;
+// the services authenticate requests with an auth.Guard installed ahead of
+// this middleware.
+func (s *Spec) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, pathParams, err := s.router.FindRoute(r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		input := &openapi3filter.RequestValidationInput{
+			Request:    r,
+			PathParams: pathParams,
+			Route:      route,
+			Options: &openapi3filter.Options{
+				MultiError:         true,
+				AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+			},
+		}
+		if err := openapi3filter.ValidateRequest(r.Context(), input); err != nil {
+			writeValidationError(w, err)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeValidationError(w http.ResponseWriter, err error) {
+	issues := collectValidationIssues(err, "", "")
+	if len(issues) == 0 {
+		issues = []ValidationIssue{{In: "body", Message: err.Error()}}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(ValidationErrorResponse{
+		Error:   "validation_failed",
+		Details: issues,
+	})
+}
+
+// Flatten kin-openapi's nested errors into one issue per failing field.
+// The concrete types are matched directly rather than with errors.As since
+// RequestError unwraps to its inner MultiError and would lose the location.
+func collectValidationIssues(err error, in, field string) []ValidationIssue {
+	switch e := err.(type) {
+	case openapi3.MultiError:
+		var issues []ValidationIssue
+		for _, inner := range e {
+			issues = append(issues, collectValidationIssues(inner, in, field)...)
+		}
+		return issues
+
+	case *openapi3filter.RequestError:
+		in, field = "body", ""
+		if e.Parameter != nil {
+			in, field = e.Parameter.In, e.Parameter.Name
+		}
+		if e.Err != nil {
+			if issues := collectValidationIssues(e.Err, in, field); len(issues) > 0 {
+				return issues
+			}
+		}
+		message := e.Reason
+		if message == "" && e.Err != nil {
+			message = e.Err.Error()
+		}
+		return []ValidationIssue{{In: in, Field: field, Message: message}}
+
+	case *openapi3.SchemaError:
+		if pointer := e.JSONPointer(); len(pointer) > 0 {
+			field = strings.Join(pointer, ".")
+		}
+		return []ValidationIssue{{In: in, Field: field, Message: e.Reason}}
+
+	case *openapi3filter.ParseError:
+		return []ValidationIssue{{In: in, Field: field, Message: e.Error()}}
+	}
+
+	if in == "" {
+		return nil
+	}
+	return []ValidationIssue{{In: in, Field: field, Message: err.Error()}}
+}
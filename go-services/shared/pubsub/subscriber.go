@@ -0,0 +1,165 @@
+// Package pubsub keeps the services' Redis pub/sub subscriptions alive.
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"time"
+
+	"github.com/foodo/shared/config"
+	"github.com/foodo/shared/health"
+	"github.com/foodo/shared/metrics"
+	"github.com/go-redis/redis/v8"
+)
+
+// Subscriber runs a Redis pub/sub subscription under supervision. When the
+// connection drops it resubscribes with jittered exponential backoff, then
+// calls Resync so the service can rebuild anything it missed in the gap.
+type Subscriber struct {
+	Client   redis.UniversalClient
+	Channels []string
+
+	// Handle is called for every message, one at a time
+	Handle func(msg *redis.Message)
+
+	// Resync, if set, runs after every resubscribe (not the first subscribe)
+	Resync func(ctx context.Context) error
+
+	// State is updated as the subscription starts, stops and receives
+	State *health.Consumer
+
+	// MinBackoff and MaxBackoff bound the delay between attempts
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// PingInterval is how long to wait for a message before pinging the
+	// connection to check it's still alive
+	PingInterval time.Duration
+}
+
+// New returns a Subscriber for channels with backoff and ping settings from
+// SUBSCRIBER_MIN_BACKOFF, SUBSCRIBER_MAX_BACKOFF and SUBSCRIBER_PING_INTERVAL.
+// Set Handle, State and optionally Resync before calling Run.
+func New(cfg *config.Config, client redis.UniversalClient, channels ...string) *Subscriber {
+	return &Subscriber{
+		Client:       client,
+		Channels:     channels,
+		MinBackoff:   cfg.Duration("SUBSCRIBER_MIN_BACKOFF", 500*time.Millisecond),
+		MaxBackoff:   cfg.Duration("SUBSCRIBER_MAX_BACKOFF", 30*time.Second),
+		PingInterval: cfg.Duration("SUBSCRIBER_PING_INTERVAL", 30*time.Second),
+	}
+}
+
+// Run subscribes and dispatches messages until ctx is cancelled
+func (s *Subscriber) Run(ctx context.Context) {
+	backoff := s.MinBackoff
+	subscribed := false
+
+	for ctx.Err() == nil {
+		err := s.session(ctx, subscribed, func() {
+			subscribed = true
+			backoff = s.MinBackoff
+		})
+		if ctx.Err() != nil {
+			return
+		}
+
+		metrics.PubSubReconnects.Inc()
+		delay := jitter(backoff)
+		slog.Warn("Subscription lost, reconnecting", "channels", s.Channels, "error", err, "retry_in", delay.String())
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+	}
+}
+
+// session runs one subscription until it fails. connected is called once the
+// subscription is confirmed.
+func (s *Subscriber) session(ctx context.Context, resubscribe bool, connected func()) error {
+	pubsub := s.Client.Subscribe(ctx, s.Channels...)
+	defer pubsub.Close()
+
+	// Reads only honour their own timeout, so unblock them on cancellation
+	stop := context.AfterFunc(ctx, func() { pubsub.Close() })
+	defer stop()
+
+	// Wait for Redis to confirm every channel before counting as connected
+	for range s.Channels {
+		msg, err := pubsub.Receive(ctx)
+		if err != nil {
+			return err
+		}
+		if _, ok := msg.(*redis.Subscription); !ok {
+			return fmt.Errorf("unexpected %T before subscription confirmed", msg)
+		}
+	}
+	connected()
+
+	s.State.Started()
+	defer s.State.Stopped()
+	slog.Info("Subscribed", "channels", s.Channels)
+
+	// Messages published while we were away are gone; let the service catch up
+	if resubscribe && s.Resync != nil {
+		if err := s.Resync(ctx); err != nil {
+			slog.Error("Resync after reconnect failed", "error", err)
+		}
+	}
+
+	pinged := false
+	for {
+		msg, err := pubsub.ReceiveTimeout(ctx, s.PingInterval)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if !isTimeout(err) {
+				return err
+			}
+			// A quiet channel is fine, but an unanswered ping means the
+			// connection is half-open
+			if pinged {
+				return errors.New("no reply to ping")
+			}
+			if err := pubsub.Ping(ctx); err != nil {
+				return err
+			}
+			pinged = true
+			continue
+		}
+		pinged = false
+
+		switch msg := msg.(type) {
+		case *redis.Message:
+			s.State.Received()
+			s.Handle(msg)
+		case *redis.Subscription:
+			if msg.Kind == "unsubscribe" && msg.Count == 0 {
+				return fmt.Errorf("unsubscribed from %s", msg.Channel)
+			}
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	t, ok := err.(interface{ Timeout() bool })
+	return ok && t.Timeout()
+}
+
+// jitter returns a random duration in [d/2, d)
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
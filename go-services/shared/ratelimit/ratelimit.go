@@ -0,0 +1,290 @@
+// Package ratelimit applies token-bucket limits whose state lives in Redis,
+// so every replica of a service draws from the same buckets. Buckets are
+// timed by the Redis clock, so replicas with skewed clocks agree.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foodo/shared/auth"
+	"github.com/foodo/shared/config"
+	"github.com/foodo/shared/metrics"
+	"github.com/go-redis/redis/v8"
+)
+
+// Limit is a bucket refilled at Rate tokens per second that holds at most
+// Burst tokens. The zero Limit disables limiting.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Enabled reports whether l limits anything
+func (l Limit) Enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+// ParseLimit reads a limit written as "<n>/<unit>[,<burst>]", where unit is
+// s, m or h, for example "5/s" or "120/m,20". The burst defaults to n.
+// "off", "0" and "" disable the limit.
+func ParseLimit(s string) (Limit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "off" || s == "0" {
+		return Limit{}, nil
+	}
+
+	spec, burstSpec, hasBurst := strings.Cut(s, ",")
+	countSpec, unit, ok := strings.Cut(spec, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("invalid rate limit %q: expected <n>/<unit>[,<burst>]", s)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(countSpec))
+	if err != nil || count <= 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit %q: count must be a positive integer", s)
+	}
+
+	var period time.Duration
+	switch strings.TrimSpace(unit) {
+	case "s":
+		period = time.Second
+	case "m":
+		period = time.Minute
+	case "h":
+		period = time.Hour
+	default:
+		return Limit{}, fmt.Errorf("invalid rate limit %q: unit must be s, m or h", s)
+	}
+
+	burst := count
+	if hasBurst {
+		burst, err = strconv.Atoi(strings.TrimSpace(burstSpec))
+		if err != nil || burst <= 0 {
+			return Limit{}, fmt.Errorf("invalid rate limit %q: burst must be a positive integer", s)
+		}
+	}
+	return Limit{Rate: float64(count) / period.Seconds(), Burst: burst}, nil
+}
+
+// Result is the outcome of taking a token
+type Result struct {
+	Allowed   bool
+	Remaining int
+	// RetryAfter is how long until a token is available when not allowed
+	RetryAfter time.Duration
+}
+
+// Limiter holds the limits for a service's named routes
+type Limiter struct {
+	client redis.UniversalClient
+	prefix string
+	limits map[string]Limit
+	// Proxies whose X-Forwarded-For is believed
+	trusted []*net.IPNet
+}
+
+// New returns a Limiter for the named routes. Each route's limit is read
+// from RATE_LIMIT_<ROUTE> (route upper-cased), falling back to the default
+// given here. Buckets are per service, so the same route name in two
+// services doesn't share one. TRUSTED_PROXIES lists the addresses or CIDR
+// ranges of the proxies in front of the service.
+func New(cfg *config.Config, client redis.UniversalClient, defaults map[string]string) (*Limiter, error) {
+	trusted, err := ParseTrustedProxies(cfg.List("TRUSTED_PROXIES"))
+	if err != nil {
+		return nil, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+	}
+	l := &Limiter{
+		client:  client,
+		prefix:  "ratelimit:" + cfg.Service + ":",
+		limits:  make(map[string]Limit, len(defaults)),
+		trusted: trusted,
+	}
+	for route, fallback := range defaults {
+		key := "RATE_LIMIT_" + strings.ToUpper(route)
+		limit, err := ParseLimit(cfg.String(key, fallback))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		l.limits[route] = limit
+	}
+	return l, nil
+}
+
+// ParseTrustedProxies parses proxy addresses and CIDR ranges
+func ParseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %q", entry)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// Refill the bucket for the time elapsed since it was last touched, then
+// take a token if there is one. The bucket expires once it would be full
+// again anyway. Time comes from Redis, in milliseconds.
+var tokenBucket = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local clock = redis.call('TIME')
+local now = tonumber(clock[1]) * 1000 + math.floor(tonumber(clock[2]) / 1000)
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+if now > ts then
+	tokens = math.min(burst, tokens + (now - ts) * rate)
+	ts = now
+end
+
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(ts))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate) + 1000)
+return {allowed, math.floor(tokens), wait}
+`)
+
+// Allow takes a token from key's bucket on route. Routes without a limit
+// always allow, as does a nil Limiter. When Redis can't be reached the
+// request is allowed, since refusing all traffic would be worse than
+// briefly not limiting it.
+func (l *Limiter) Allow(ctx context.Context, route, key string) Result {
+	if l == nil {
+		return Result{Allowed: true}
+	}
+	limit := l.limits[route]
+	if !limit.Enabled() {
+		return Result{Allowed: true}
+	}
+
+	// Milliseconds throughout, so rate is tokens per millisecond
+	values, err := tokenBucket.Run(ctx, l.client,
+		[]string{l.prefix + route + ":" + key},
+		limit.Rate/1000, limit.Burst,
+	).Int64Slice()
+	if err != nil || len(values) != 3 {
+		slog.WarnContext(ctx, "Rate limit check failed; allowing", "route", route, "error", err)
+		return Result{Allowed: true}
+	}
+
+	result := Result{
+		Allowed:    values[0] == 1,
+		Remaining:  int(values[1]),
+		RetryAfter: time.Duration(values[2]) * time.Millisecond,
+	}
+	if !result.Allowed {
+		metrics.RateLimited.WithLabelValues(route).Inc()
+	}
+	return result
+}
+
+// Check applies route's limit to an HTTP request, keyed by who made it.
+// Requests over the limit get 429 with Retry-After and Check returns false.
+func (l *Limiter) Check(w http.ResponseWriter, r *http.Request, route string) bool {
+	key := l.Identity(r)
+	result := l.Allow(r.Context(), route, key)
+	if result.Allowed {
+		return true
+	}
+
+	slog.InfoContext(r.Context(), "Rate limited", "route", route, "key", key, "retry_after", result.RetryAfter.String())
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(result.RetryAfter)))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+	return false
+}
+
+// retryAfterSeconds rounds d up to whole seconds, as Retry-After requires
+func retryAfterSeconds(d time.Duration) int {
+	seconds := int(math.Ceil(d.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+// Identity is the bucket key for whoever made a request: the operator or
+// user its token was checked for, otherwise its client's IP address. Only
+// identities the auth middleware established count, so a caller can't
+// spend someone else's tokens by naming them in the request.
+func (l *Limiter) Identity(r *http.Request) string {
+	if actor := auth.AdminActor(r.Context()); actor != "" {
+		return "admin:" + actor
+	}
+	if userID := auth.UserID(r.Context()); userID != "" {
+		return "user:" + userID
+	}
+	return "ip:" + l.ClientIP(r)
+}
+
+// ClientIP returns the address the request came from. X-Forwarded-For is
+// only believed when the request comes through a trusted proxy, and then
+// the client is the last entry not added by one.
+func (l *Limiter) ClientIP(r *http.Request) string {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	if !l.trustedProxy(client) {
+		return client
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			// Anything before a malformed entry can't be trusted
+			break
+		}
+		client = hop
+		if !l.trustedProxy(hop) {
+			break
+		}
+	}
+	return client
+}
+
+func (l *Limiter) trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil || l == nil {
+		return false
+	}
+	for _, network := range l.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
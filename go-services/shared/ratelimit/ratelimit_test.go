@@ -0,0 +1,185 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/foodo/shared/auth"
+	"github.com/foodo/shared/config"
+	"github.com/go-redis/redis/v8"
+)
+
+// A Limiter for the "test" route on miniredis
+func newTestLimiter(t *testing.T, limit, trustedProxies string) (*Limiter, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	t.Setenv("REDIS_ADDR", mr.Addr())
+	t.Setenv("REDIS_ALLOW_NO_AUTH", "true")
+	t.Setenv("TRUSTED_PROXIES", trustedProxies)
+	cfg, err := config.Load("ratelimit-test", "0", nil)
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	l, err := New(cfg, client, map[string]string{"test": limit})
+	if err != nil {
+		t.Fatalf("new limiter: %v", err)
+	}
+	return l, mr
+}
+
+func TestParseLimit(t *testing.T) {
+	for spec, want := range map[string]Limit{
+		"5/s":      {Rate: 5, Burst: 5},
+		"120/m,20": {Rate: 2, Burst: 20},
+		"36/h":     {Rate: 0.01, Burst: 36},
+		"off":      {},
+		"":         {},
+	} {
+		got, err := ParseLimit(spec)
+		if err != nil || got != want {
+			t.Errorf("ParseLimit(%q) = %+v, %v; want %+v", spec, got, err, want)
+		}
+	}
+	for _, spec := range []string{"5", "5/d", "-1/s", "5/s,0", "x/s"} {
+		if _, err := ParseLimit(spec); err == nil {
+			t.Errorf("ParseLimit(%q) accepted", spec)
+		}
+	}
+}
+
+// Buckets refill by the Redis clock, not the replica's
+func TestAllowUsesRedisClock(t *testing.T) {
+	l, mr := newTestLimiter(t, "1/m,2", "")
+	ctx := context.Background()
+	start := time.Now()
+	mr.SetTime(start)
+
+	for i := 0; i < 2; i++ {
+		if result := l.Allow(ctx, "test", "user:1"); !result.Allowed {
+			t.Fatalf("request %d refused", i+1)
+		}
+	}
+	result := l.Allow(ctx, "test", "user:1")
+	if result.Allowed || result.RetryAfter <= 0 || result.RetryAfter > time.Minute {
+		t.Fatalf("third request = %+v, want refused for up to a minute", result)
+	}
+	if result := l.Allow(ctx, "test", "user:2"); !result.Allowed {
+		t.Fatal("another key shares the bucket")
+	}
+
+	// Only Redis's clock moves
+	mr.SetTime(start.Add(time.Minute))
+	if result := l.Allow(ctx, "test", "user:1"); !result.Allowed {
+		t.Fatalf("request after refill = %+v", result)
+	}
+}
+
+func TestCheckRejectsWithRetryAfter(t *testing.T) {
+	l, _ := newTestLimiter(t, "1/m,1", "")
+	check := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.RemoteAddr = "203.0.113.7:4000"
+		if l.Check(rec, req, "test") != (rec.Code == http.StatusOK) {
+			t.Fatal("Check's result doesn't match the response")
+		}
+		return rec
+	}
+	if rec := check(); rec.Code != http.StatusOK {
+		t.Fatalf("first request status = %d", rec.Code)
+	}
+	rec := check()
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("second request status = %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	l, _ := newTestLimiter(t, "off", "10.0.0.0/8,192.0.2.1")
+	for _, tc := range []struct {
+		name, remote, forwarded, want string
+	}{
+		{"direct", "203.0.113.7:4000", "", "203.0.113.7"},
+		{"untrusted peer's header is ignored", "203.0.113.7:4000", "198.51.100.1", "203.0.113.7"},
+		{"through a trusted proxy", "10.1.2.3:4000", "198.51.100.1", "198.51.100.1"},
+		{"spoofed entries before the proxy's are skipped", "10.1.2.3:4000", "1.2.3.4, 198.51.100.1", "198.51.100.1"},
+		{"through a chain of trusted proxies", "10.1.2.3:4000", "198.51.100.1, 192.0.2.1, 10.9.9.9", "198.51.100.1"},
+		{"malformed entries stop the walk", "10.1.2.3:4000", "198.51.100.1, junk", "10.1.2.3"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tc.remote
+		if tc.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		if got := l.ClientIP(req); got != tc.want {
+			t.Errorf("%s: ClientIP = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+// Requests are keyed by who authenticated, not by anything they claim
+func TestIdentity(t *testing.T) {
+	l, _ := newTestLimiter(t, "off", "")
+	identity := func(mw func(http.Handler) http.Handler, token string) string {
+		var got string
+		handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = l.Identity(r)
+		}))
+		req := httptest.NewRequest(http.MethodPost, "/drivers/driver-2/location", nil)
+		req.RemoteAddr = "203.0.113.7:4000"
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		return got
+	}
+
+	admin := auth.Admin(map[string]string{"secret": "ops"})
+	if got := identity(admin, "secret"); got != "admin:ops" {
+		t.Errorf("admin identity = %q", got)
+	}
+	users := auth.UserOrAdmin(auth.NewUsers("jwt-secret", nil), nil)
+	if got := identity(users, userToken("jwt-secret", "driver-1")); got != "user:driver-1" {
+		t.Errorf("user identity = %q", got)
+	}
+	anonymous := func(next http.Handler) http.Handler { return next }
+	if got := identity(anonymous, ""); got != "ip:203.0.113.7" {
+		t.Errorf("anonymous identity = %q", got)
+	}
+}
+
+// Sign a user token the way the API does at login
+func userToken(secret, userID string) string {
+	encode := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	unsigned := encode(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." +
+		encode(map[string]interface{}{"sub": userID, "exp": time.Now().Add(time.Hour).Unix()})
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1", "::1"})
+	if err != nil || len(proxies) != 3 {
+		t.Fatalf("proxies = %v, %v", proxies, err)
+	}
+	for _, entry := range []string{"10.0.0.0/33", "proxy.internal"} {
+		if _, err := ParseTrustedProxies([]string{entry}); err == nil {
+			t.Errorf("%q accepted", entry)
+		}
+	}
+}
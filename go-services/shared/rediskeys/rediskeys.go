@@ -0,0 +1,183 @@
+// Package rediskeys helps the services lay their keys out for Redis Cluster
+// and move data from older layouts.
+//
+// Keys written together in a MULTI or script must hash to the same cluster
+// slot. Redis only hashes the part of a key inside the first {braces}, so
+// keys sharing that hash tag always share a slot. Services name related keys
+// with a common tag, such as "order:{42}:location" and "order:{42}:trail".
+package rediskeys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/foodo/shared/config"
+	"github.com/go-redis/redis/v8"
+)
+
+// MigrateFlag is the flag for services that move their keys with a Migration
+var MigrateFlag = config.Flag{Name: "migrate-keys", Key: "REDIS_MIGRATE_KEYS", Usage: "Move Redis keys to the cluster layout and exit (true/false)"}
+
+// Tag wraps id in braces so keys built from it share a slot. Braces in id
+// are replaced, since the first closing brace would end the tag early.
+func Tag(id string) string {
+	id = strings.NewReplacer("{", "(", "}", ")").Replace(id)
+	return "{" + id + "}"
+}
+
+// Scan calls fn for every key matching pattern. On a cluster every master is
+// scanned.
+func Scan(ctx context.Context, client redis.UniversalClient, pattern string, fn func(key string) error) error {
+	scan := func(ctx context.Context, c redis.Cmdable) error {
+		iter := c.Scan(ctx, 0, pattern, 500).Iterator()
+		for iter.Next(ctx) {
+			if err := fn(iter.Val()); err != nil {
+				return err
+			}
+		}
+		return iter.Err()
+	}
+	if cluster, ok := client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+			return scan(ctx, master)
+		})
+	}
+	return scan(ctx, client)
+}
+
+// Migration moves keys from an old layout, counting what it moved. Moves
+// copy into the new key and then delete the old one, so a migration that is
+// interrupted can be run again. Data already under a new key wins over the
+// old copy.
+type Migration struct {
+	Client redis.UniversalClient
+	// Keys moved, by family
+	Moved map[string]int
+}
+
+// NewMigration returns a Migration using client
+func NewMigration(client redis.UniversalClient) *Migration {
+	return &Migration{Client: client, Moved: make(map[string]int)}
+}
+
+// String moves a string key, keeping its expiry
+func (m *Migration) String(ctx context.Context, family, from, to string) error {
+	value, err := m.Client.Get(ctx, from).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ttl, err := m.ttl(ctx, from)
+	if err != nil {
+		return err
+	}
+	if err := m.Client.SetNX(ctx, to, value, ttl).Err(); err != nil {
+		return err
+	}
+	return m.finish(ctx, family, from)
+}
+
+// Hash moves every field of a hash, keeping fields already in the new one
+func (m *Migration) Hash(ctx context.Context, family, from, to string) error {
+	fields, err := m.Client.HGetAll(ctx, from).Result()
+	if err != nil || len(fields) == 0 {
+		return err
+	}
+	return m.HashFields(ctx, family, from, fields, func(string) string { return to })
+}
+
+// HashFields writes the fields of the hash from, already read, into the
+// hashes chosen by route, then deletes from. It lets one hash be split by
+// field.
+func (m *Migration) HashFields(ctx context.Context, family, from string, fields map[string]string, route func(field string) string) error {
+	pipe := m.Client.Pipeline()
+	for field, value := range fields {
+		pipe.HSetNX(ctx, route(field), field, value)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	return m.finish(ctx, family, from)
+}
+
+// List appends an old list to the new one, oldest first, keeping its expiry.
+// The two keys may be in different slots, so the copy and the delete can't
+// share a MULTI. If the new list already ends with the old one's items, a
+// previous run copied them and stopped before the delete, so they aren't
+// appended again.
+func (m *Migration) List(ctx context.Context, family, from, to string) error {
+	values, err := m.Client.LRange(ctx, from, 0, -1).Result()
+	if err != nil || len(values) == 0 {
+		return err
+	}
+	tail, err := m.Client.LRange(ctx, to, int64(-len(values)), -1).Result()
+	if err != nil {
+		return err
+	}
+	if equal(tail, values) {
+		return m.finish(ctx, family, from)
+	}
+	ttl, err := m.ttl(ctx, from)
+	if err != nil {
+		return err
+	}
+	items := make([]interface{}, len(values))
+	for i, value := range values {
+		items[i] = value
+	}
+	pipe := m.Client.TxPipeline()
+	pipe.RPush(ctx, to, items...)
+	if ttl > 0 {
+		pipe.PExpire(ctx, to, ttl)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	return m.finish(ctx, family, from)
+}
+
+// Whether a and b hold the same strings in the same order
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Delete removes an old key whose contents were rebuilt some other way
+func (m *Migration) Delete(ctx context.Context, family, key string) error {
+	return m.finish(ctx, family, key)
+}
+
+// The key's remaining time to live, or 0 if it doesn't expire
+func (m *Migration) ttl(ctx context.Context, key string) (time.Duration, error) {
+	ttl, err := m.Client.PTTL(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if ttl < 0 {
+		return 0, nil
+	}
+	return ttl, nil
+}
+
+func (m *Migration) finish(ctx context.Context, family, from string) error {
+	deleted, err := m.Client.Del(ctx, from).Result()
+	if err != nil {
+		return fmt.Errorf("delete %s: %w", from, err)
+	}
+	if deleted > 0 {
+		m.Moved[family] += int(deleted)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// PayloadField is the JSON key that carries W3C trace context inside
+// published Redis messages, e.g.
+//
+//	{"id": "...", "_trace": {"traceparent": "00-...-...-01"}}
+//
+// Consumers decoding into structs ignore it, so it can be added to any JSON
+// object payload without breaking older subscribers.
+const PayloadField = "_trace"
+
+// InjectPayload adds the current trace context to a JSON object payload.
+// Payloads that aren't JSON objects, or calls without an active span, are
+// returned unchanged.
+func InjectPayload(ctx context.Context, payload []byte) []byte {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return payload
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return payload
+	}
+	fields[PayloadField], _ = json.Marshal(carrier)
+
+	injected, err := json.Marshal(fields)
+	if err != nil {
+		return payload
+	}
+	return injected
+}
+
+// ExtractPayload returns ctx with any trace context found in payload, read
+// from the _trace object or a top-level traceparent field
+func ExtractPayload(ctx context.Context, payload []byte) context.Context {
+	var fields struct {
+		Trace       map[string]string `json:"_trace"`
+		TraceParent string            `json:"traceparent"`
+		TraceState  string            `json:"tracestate"`
+	}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return ctx
+	}
+
+	carrier := propagation.MapCarrier(fields.Trace)
+	if carrier == nil && fields.TraceParent != "" {
+		carrier = propagation.MapCarrier{"traceparent": fields.TraceParent, "tracestate": fields.TraceState}
+	}
+	if carrier == nil {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
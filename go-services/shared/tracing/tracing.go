@@ -0,0 +1,67 @@
+// Package tracing sets up OpenTelemetry for the Go services and carries
+// trace context across HTTP, Redis commands and Redis pub/sub payloads.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/foodo/shared/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer returns the named tracer from the global provider
+func Tracer(name string) trace.Tracer {
+	return otel.Tracer(name)
+}
+
+// Init installs the global tracer provider and propagator. The exporter is
+// chosen by OTEL_TRACES_EXPORTER: "otlp", "stdout" or "none" (the default).
+// The OTLP exporter honours the standard OTEL_EXPORTER_OTLP_* variables.
+// The returned function flushes and stops the provider.
+func Init(ctx context.Context, cfg *config.Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch name := cfg.String("OTEL_TRACES_EXPORTER", "none"); name {
+	case "none", "":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("OTEL_TRACES_EXPORTER must be otlp, stdout or none, got %q", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(cfg.Service),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.Float("OTEL_TRACES_SAMPLE_RATIO", 1)))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
@@ -0,0 +1,216 @@
+// Package tracking writes the Postgres OrderTracking table for the Go
+// services. Redis stays the hot path; writes are queued and retried off the
+// request goroutine so a slow database never delays a service.
+package tracking
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/foodo/shared/config"
+	"github.com/foodo/shared/logging"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Update is a partial write to the OrderTracking table. Nil fields leave the
+// stored column untouched so callers only send what they know.
+type Update struct {
+	OrderID          string
+	Status           *string
+	DriverID         *string
+	DriverName       *string
+	DriverPhone      *string
+	DriverLocation   json.RawMessage
+	EstimatedArrival *time.Time
+}
+
+// Writer persists Updates in the background. Each order's updates go to the
+// same worker, so they're written in the order they were queued, retries
+// included, and a late retry can't overwrite a newer status.
+type Writer struct {
+	pool       *pgxpool.Pool
+	queues     []chan Update
+	maxRetries int
+	wg         sync.WaitGroup
+}
+
+// Upsert keyed on the unique orderId column. id and updatedAt are Prisma-side
+// defaults, so they have to be filled in explicitly here.
+const upsertSQL = `
+INSERT INTO "OrderTracking" ("id", "orderId", "status", "driverId", "driverName", "driverPhone", "driverLocation", "estimatedArrival", "createdAt", "updatedAt")
+VALUES (gen_random_uuid()::text, $1, $2, $3, $4, $5, $6::jsonb, $7, NOW(), NOW())
+ON CONFLICT ("orderId") DO UPDATE SET
+	"status"           = EXCLUDED."status",
+	"driverId"         = COALESCE($3, "OrderTracking"."driverId"),
+	"driverName"       = COALESCE($4, "OrderTracking"."driverName"),
+	"driverPhone"      = COALESCE($5, "OrderTracking"."driverPhone"),
+	"driverLocation"   = COALESCE($6::jsonb, "OrderTracking"."driverLocation"),
+	"estimatedArrival" = COALESCE($7, "OrderTracking"."estimatedArrival"),
+	"updatedAt"        = NOW()`
+
+// Updates without a status only touch an existing row, since there's no
+// status to create one with. The API creates the row with the order.
+const updateSQL = `
+UPDATE "OrderTracking" SET
+	"driverId"         = COALESCE($2, "driverId"),
+	"driverName"       = COALESCE($3, "driverName"),
+	"driverPhone"      = COALESCE($4, "driverPhone"),
+	"driverLocation"   = COALESCE($5::jsonb, "driverLocation"),
+	"estimatedArrival" = COALESCE($6, "estimatedArrival"),
+	"updatedAt"        = NOW()
+WHERE "orderId" = $1`
+
+// New connects to Postgres and starts TRACKING_WORKERS workers, sharing
+// TRACKING_QUEUE_SIZE queued updates between them
+func New(ctx context.Context, cfg *config.Config) (*Writer, error) {
+	poolConfig, err := pgxpool.ParseConfig(cfg.DatabaseURL)
+	if err != nil {
+		return nil, err
+	}
+	poolConfig.MaxConns = int32(cfg.Int("TRACKING_DB_MAX_CONNS", 4))
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	workers := cfg.Int("TRACKING_WORKERS", 2)
+	if workers < 1 {
+		workers = 1
+	}
+	queueSize := cfg.Int("TRACKING_QUEUE_SIZE", 1024) / workers
+	if queueSize < 1 {
+		queueSize = 1
+	}
+
+	w := &Writer{
+		pool:       pool,
+		queues:     make([]chan Update, workers),
+		maxRetries: cfg.Int("TRACKING_MAX_RETRIES", 5),
+	}
+	for i := range w.queues {
+		w.queues[i] = make(chan Update, queueSize)
+		w.wg.Add(1)
+		go w.run(w.queues[i])
+	}
+	return w, nil
+}
+
+// Pool is the writer's connection pool, for the services' own queries
+func (w *Writer) Pool() *pgxpool.Pool {
+	return w.pool
+}
+
+// Enqueue schedules an update without blocking. A nil writer is a no-op so
+// callers don't need to check whether persistence is configured.
+func (w *Writer) Enqueue(update Update) {
+	if w == nil {
+		return
+	}
+	h := fnv.New32a()
+	h.Write([]byte(update.OrderID))
+	select {
+	case w.queues[h.Sum32()%uint32(len(w.queues))] <- update:
+	default:
+		slog.Warn("Tracking queue full, dropping update", logging.OrderIDKey, update.OrderID)
+	}
+}
+
+// Close stops accepting updates, flushes the queues and closes the pool
+func (w *Writer) Close() {
+	if w == nil {
+		return
+	}
+	for _, queue := range w.queues {
+		close(queue)
+	}
+	w.wg.Wait()
+	w.pool.Close()
+}
+
+func (w *Writer) run(queue chan Update) {
+	defer w.wg.Done()
+	for update := range queue {
+		w.writeWithRetry(update)
+	}
+}
+
+func (w *Writer) writeWithRetry(update Update) {
+	backoff := 200 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := w.write(update)
+		if err == nil {
+			return
+		}
+		if !IsRetryable(err) || attempt >= w.maxRetries {
+			slog.Error("Failed to persist tracking", logging.OrderIDKey, update.OrderID, "attempts", attempt, "error", err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (w *Writer) write(update Update) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var location *string
+	if len(update.DriverLocation) > 0 {
+		s := string(update.DriverLocation)
+		location = &s
+	}
+
+	var err error
+	if update.Status == nil {
+		_, err = w.pool.Exec(ctx, updateSQL,
+			update.OrderID,
+			update.DriverID,
+			update.DriverName,
+			update.DriverPhone,
+			location,
+			update.EstimatedArrival,
+		)
+	} else {
+		_, err = w.pool.Exec(ctx, upsertSQL,
+			update.OrderID,
+			*update.Status,
+			update.DriverID,
+			update.DriverName,
+			update.DriverPhone,
+			location,
+			update.EstimatedArrival,
+		)
+	}
+	return err
+}
+
+// IsForeignKeyViolation reports whether the order a row refers to doesn't
+// exist
+func IsForeignKeyViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23503"
+}
+
+// IsRetryable reports whether err may go away on a retry. Constraint and
+// data errors fail the same way on every attempt.
+func IsRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code[:2] {
+		case "22", "23", "42":
+			return false
+		}
+	}
+	return true
+}
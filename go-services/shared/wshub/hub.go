@@ -0,0 +1,320 @@
+// Package wshub tracks the services' WebSocket connections. Each connection
+// gets a buffered send queue drained by its own writer goroutine, so a slow
+// client never blocks the pub/sub handler that's broadcasting to it. The
+// writer also pings the peer, and a peer that stops answering hits its read
+// deadline so the reading handler can remove it.
+package wshub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/foodo/shared/config"
+	"github.com/gorilla/websocket"
+)
+
+// ErrDraining is returned by Register once the hub has stopped accepting
+var ErrDraining = errors.New("server is draining")
+
+// Hub is a set of connections keyed by an ID such as "driver:42"
+type Hub struct {
+	queueSize      int
+	pingInterval   time.Duration
+	pongWait       time.Duration
+	writeWait      time.Duration
+	maxMessageSize int64
+	draining       atomic.Bool
+
+	mu      sync.RWMutex
+	clients map[string]*Client
+}
+
+// New returns a Hub configured from WS_SEND_QUEUE_SIZE, WS_PING_INTERVAL,
+// WS_PONG_WAIT, WS_WRITE_WAIT and WS_MAX_MESSAGE_SIZE
+func New(cfg *config.Config) *Hub {
+	h := &Hub{
+		queueSize:      cfg.Int("WS_SEND_QUEUE_SIZE", 64),
+		pingInterval:   cfg.Duration("WS_PING_INTERVAL", 25*time.Second),
+		pongWait:       cfg.Duration("WS_PONG_WAIT", 60*time.Second),
+		writeWait:      cfg.Duration("WS_WRITE_WAIT", 10*time.Second),
+		maxMessageSize: int64(cfg.Int("WS_MAX_MESSAGE_SIZE", 4096)),
+		clients:        make(map[string]*Client),
+	}
+	// A ping must be able to arrive and be answered inside the pong window
+	if h.pingInterval >= h.pongWait {
+		h.pingInterval = h.pongWait * 9 / 10
+	}
+	return h
+}
+
+// Register adds a connection, applies the read limit and keepalive
+// deadlines, and starts its writer. A previous connection with the same ID
+// is closed.
+func (h *Hub) Register(id string, conn *websocket.Conn) (*Client, error) {
+	c := &Client{
+		ID:   id,
+		hub:  h,
+		conn: conn,
+		send: make(chan []byte, h.queueSize),
+		done: make(chan struct{}),
+	}
+
+	h.mu.Lock()
+	if h.draining.Load() {
+		h.mu.Unlock()
+		return nil, ErrDraining
+	}
+	previous := h.clients[id]
+	h.clients[id] = c
+	h.mu.Unlock()
+
+	if previous != nil {
+		previous.close(websocket.ClosePolicyViolation, "replaced by a newer connection")
+	}
+
+	// Every pong pushes the read deadline out; silence lets it expire
+	conn.SetReadLimit(h.maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(h.pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(h.pongWait))
+	})
+
+	go c.writePump()
+	return c, nil
+}
+
+// Unregister removes a connection and lets its writer finish. It reports
+// whether c was still the registered connection for its ID, rather than
+// one already replaced or closed by Close.
+func (h *Hub) Unregister(c *Client) bool {
+	h.mu.Lock()
+	current := h.clients[c.ID] == c
+	if current {
+		delete(h.clients, c.ID)
+	}
+	h.mu.Unlock()
+	c.close(websocket.CloseNormalClosure, "")
+	return current
+}
+
+// Get returns the connection registered under id
+func (h *Hub) Get(id string) (*Client, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	c, ok := h.clients[id]
+	return c, ok
+}
+
+// Disconnect closes the connection registered under id with code, after
+// any messages already queued
+func (h *Hub) Disconnect(id string, code int, text string) bool {
+	c, ok := h.Get(id)
+	if !ok {
+		return false
+	}
+	c.close(code, text)
+	return true
+}
+
+// Clients returns a snapshot of the registered connections
+func (h *Hub) Clients() []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	clients := make([]*Client, 0, len(h.clients))
+	for _, c := range h.clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// Len returns the number of registered connections
+func (h *Hub) Len() int64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return int64(len(h.clients))
+}
+
+// StopAccepting makes Register fail from now on
+func (h *Hub) StopAccepting() {
+	h.mu.Lock()
+	h.draining.Store(true)
+	h.mu.Unlock()
+}
+
+// Draining reports whether StopAccepting has been called
+func (h *Hub) Draining() bool {
+	return h.draining.Load()
+}
+
+// SendReconnect asks every client to reconnect, each after a random delay
+// of up to spread so they don't all land on the next instance at once
+func (h *Hub) SendReconnect(spread time.Duration) {
+	for _, c := range h.Clients() {
+		var delay time.Duration
+		if spread > 0 {
+			delay = time.Duration(rand.Int63n(int64(spread)))
+		}
+		c.SendJSON(map[string]interface{}{
+			"type":    "reconnect",
+			"delayMs": delay.Milliseconds(),
+		})
+	}
+}
+
+// Flush waits until every send queue is empty or ctx is done
+func (h *Hub) Flush(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		pending := 0
+		for _, c := range h.Clients() {
+			pending += len(c.send)
+		}
+		if pending == 0 {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close sends every client a close frame with code after its queued
+// messages, then waits for the writers to finish. Connections still open
+// when ctx is done are closed abruptly.
+func (h *Hub) Close(ctx context.Context, code int, text string) {
+	h.mu.Lock()
+	clients := make([]*Client, 0, len(h.clients))
+	for _, c := range h.clients {
+		clients = append(clients, c)
+	}
+	h.clients = make(map[string]*Client)
+	h.mu.Unlock()
+
+	for _, c := range clients {
+		c.close(code, text)
+	}
+	for _, c := range clients {
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			c.conn.Close()
+		}
+	}
+}
+
+// Client is one registered connection
+type Client struct {
+	ID   string
+	hub  *Hub
+	conn *websocket.Conn
+	send chan []byte
+	done chan struct{}
+
+	mu        sync.Mutex
+	closed    bool
+	closeCode int
+	closeText string
+}
+
+// Send queues a message without blocking. A client whose queue is full is
+// disconnected, since it has stopped keeping up.
+func (c *Client) Send(message []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	select {
+	case c.send <- message:
+		return true
+	default:
+		c.closeLocked(websocket.CloseTryAgainLater, "send queue full")
+		return false
+	}
+}
+
+// SendJSON queues v encoded as JSON
+func (c *Client) SendJSON(v interface{}) bool {
+	message, err := json.Marshal(v)
+	if err != nil {
+		return false
+	}
+	return c.Send(message)
+}
+
+func (c *Client) close(code int, text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeLocked(code, text)
+}
+
+func (c *Client) closeLocked(code int, text string) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.closeCode = code
+	c.closeText = text
+	close(c.send)
+}
+
+// writePump writes queued messages and keepalive pings, then the close
+// frame, then closes the connection. It's the only goroutine that writes
+// to conn.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(c.hub.pingInterval)
+	defer ticker.Stop()
+	defer close(c.done)
+	defer c.conn.Close()
+
+	for {
+		var err error
+		select {
+		case message, ok := <-c.send:
+			if !ok {
+				c.mu.Lock()
+				code, text := c.closeCode, c.closeText
+				c.mu.Unlock()
+				c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(c.hub.writeWait))
+				return
+			}
+			c.conn.SetWriteDeadline(time.Now().Add(c.hub.writeWait))
+			err = c.conn.WriteMessage(websocket.TextMessage, message)
+		case <-ticker.C:
+			err = c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.hub.writeWait))
+		}
+
+		if err != nil {
+			// Unblock the reader, then keep draining so Flush doesn't wait
+			// on a dead connection
+			c.conn.Close()
+			for range c.send {
+			}
+			return
+		}
+	}
+}
+
+// DisconnectReason classifies the error that ended a connection's read
+// loop: "timeout" when the peer stopped answering pings, "closed" when it
+// sent a close frame, and "error" otherwise
+func DisconnectReason(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived):
+		return "closed"
+	default:
+		return "error"
+	}
+}
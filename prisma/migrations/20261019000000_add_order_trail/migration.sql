@@ -0,0 +1,18 @@
+-- CreateTable
+CREATE TABLE "OrderTrail" (
+    "id" TEXT NOT NULL,
+    "orderId" TEXT NOT NULL,
+    "driverId" TEXT,
+    "points" JSONB NOT NULL,
+    "startedAt" TIMESTAMP(3) NOT NULL,
+    "endedAt" TIMESTAMP(3) NOT NULL,
+    "createdAt" TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    CONSTRAINT "OrderTrail_pkey" PRIMARY KEY ("id")
+);
+
+-- CreateIndex
+CREATE UNIQUE INDEX "OrderTrail_orderId_key" ON "OrderTrail"("orderId");
+
+-- AddForeignKey
+ALTER TABLE "OrderTrail" ADD CONSTRAINT "OrderTrail_orderId_fkey" FOREIGN KEY ("orderId") REFERENCES "Order"("id") ON DELETE CASCADE ON UPDATE CASCADE;
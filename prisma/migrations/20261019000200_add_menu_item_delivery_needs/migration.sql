@@ -0,0 +1,3 @@
+-- AlterTable
+ALTER TABLE "MenuItem" ADD COLUMN     "needsInsulatedBag" BOOLEAN NOT NULL DEFAULT false,
+ADD COLUMN     "weightKg" DOUBLE PRECISION;
@@ -20,7 +20,7 @@ npx prisma generate
 
 # Create database schema
 echo "Creating database schema..."
-npx prisma db push
+npx prisma migrate deploy
 
 # Seed the database
 echo "Seeding the database..."
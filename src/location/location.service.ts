@@ -41,9 +41,10 @@ export class LocationService {
   /**
    * Geocode an address to coordinates
    * @param address Address to geocode
+   * @param timeoutMs Give up after this many milliseconds; no limit if omitted
    * @returns Geocoding data from Mapbox
    */
-  async geocodeAddress(address: string) {
+  async geocodeAddress(address: string, timeoutMs?: number) {
     try {
       const encodedAddress = encodeURIComponent(address);
       const response = await axios.get(
@@ -53,6 +54,7 @@ export class LocationService {
             access_token: this.mapboxApiKey,
             limit: 1,
           },
+          timeout: timeoutMs,
         },
       );
       return response.data;
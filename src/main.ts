@@ -2,6 +2,7 @@ import { NestFactory } from '@nestjs/core';
 import { ValidationPipe } from '@nestjs/common';
 import { SwaggerModule, DocumentBuilder } from '@nestjs/swagger';
 import { AppModule } from './app.module';
+import { traceContextMiddleware } from './tracing/trace-context';
 
 async function bootstrap() {
   const app = await NestFactory.create(AppModule);
@@ -11,6 +12,9 @@ async function bootstrap() {
   
   // Enable CORS
   app.enableCors();
+
+  // Carry W3C trace context from each request into the events it publishes
+  app.use(traceContextMiddleware);
   
   // Enable validation
   app.useGlobalPipes(
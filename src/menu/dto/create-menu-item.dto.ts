@@ -74,4 +74,16 @@ export class CreateMenuItemDto {
   @IsOptional()
   @Type(() => Number)
   prepTime?: number;
+
+  @ApiProperty({ example: 0.8, required: false, description: 'Packed weight of one, in kg' })
+  @IsNumber()
+  @Min(0)
+  @IsOptional()
+  @Type(() => Number)
+  weightKg?: number;
+
+  @ApiProperty({ example: true, required: false, description: 'Must travel in an insulated bag' })
+  @IsBoolean()
+  @IsOptional()
+  needsInsulatedBag?: boolean;
 }
@@ -115,9 +115,9 @@ export class NotificationsGateway implements OnGatewayInit, OnGatewayConnection,
     // and using Firebase Admin SDK to send push notifications
 
     // Publish to Redis for other services
-    this.redisService.publish('notifications', JSON.stringify({
+    this.redisService.publishEvent('notifications', {
       userId,
       ...notification
-    }));
+    });
   }
 }
@@ -107,7 +107,7 @@ export class OrdersGateway implements OnGatewayInit, OnGatewayConnection, OnGate
     });
 
     // Publish to Redis for Go microservices
-    this.redisService.publish('new_order', JSON.stringify(order));
+    this.redisService.publishEvent('new_order', order);
   }
 
   notifyOrderStatusUpdate(order: any) {
@@ -131,9 +131,9 @@ export class OrdersGateway implements OnGatewayInit, OnGatewayConnection, OnGate
     });
 
     // Publish to Redis for Go microservices
-    this.redisService.publish('order_status_update', JSON.stringify({
+    this.redisService.publishEvent('order_status_update', {
       orderId: order.id,
       status: order.status,
-    }));
+    });
   }
 }
@@ -3,9 +3,11 @@ import { OrdersService } from './orders.service';
 import { OrdersController } from './orders.controller';
 import { OrdersGateway } from './orders.gateway';
 import { CartsModule } from '../carts/carts.module';
+import { LocationModule } from '../location/location.module';
+import { RestaurantsModule } from '../restaurants/restaurants.module';
 
 @Module({
-  imports: [CartsModule],
+  imports: [CartsModule, LocationModule, RestaurantsModule],
   controllers: [OrdersController],
   providers: [OrdersService, OrdersGateway],
   exports: [OrdersService],
@@ -4,6 +4,23 @@ import { CartsService } from '../carts/carts.service';
 import { CreateOrderDto } from './dto/create-order.dto';
 import { UpdateOrderStatusDto } from './dto/update-order-status.dto';
 import { OrdersGateway } from './orders.gateway';
+import { LocationService } from '../location/location.service';
+import { RestaurantsService } from '../restaurants/restaurants.service';
+
+// What the delivering vehicle must manage; order-dispatch only offers the
+// order to drivers whose vehicle can
+export type OrderRequirements = {
+  distanceKm?: number; // Restaurant to customer, in a straight line
+  weightKg: number;
+  items: number;
+  insulatedBag: boolean;
+};
+
+// The weight of a menu item that hasn't been given one
+const DEFAULT_ITEM_WEIGHT_KG = 0.5;
+
+// How long placing an order waits to geocode the delivery address
+const GEOCODE_TIMEOUT_MS = 2000;
 
 @Injectable()
 export class OrdersService {
@@ -11,6 +28,8 @@ export class OrdersService {
     private prisma: PrismaService,
     private cartsService: CartsService,
     private ordersGateway: OrdersGateway,
+    private locationService: LocationService,
+    private restaurantsService: RestaurantsService,
   ) {}
 
   async create(userId: string, createOrderDto: CreateOrderDto) {
@@ -42,6 +61,18 @@ export class OrdersService {
     const tax = subtotal * 0.1; // 10% tax
     const totalAmount = subtotal + deliveryFee + tax + (createOrderDto.tip || 0);
 
+    // What the delivering vehicle must manage, worked out here rather than
+    // taken from the client
+    const requirements: OrderRequirements = {
+      distanceKm: await this.deliveryDistanceKm(cart.restaurantId, createOrderDto.deliveryAddress),
+      weightKg: cart.items.reduce(
+        (sum, item) => sum + (item.menuItem.weightKg ?? DEFAULT_ITEM_WEIGHT_KG) * item.quantity,
+        0,
+      ),
+      items: cart.items.reduce((sum, item) => sum + item.quantity, 0),
+      insulatedBag: cart.items.some(item => item.menuItem.needsInsulatedBag),
+    };
+
     // Generate order number
     const orderNumber = `ORD-${Date.now()}-${Math.floor(Math.random() * 1000)}`;
 
@@ -59,6 +90,7 @@ export class OrdersService {
         paymentMethod: createOrderDto.paymentMethod,
         paymentStatus: createOrderDto.paymentStatus || 'pending',
         specialInstructions: createOrderDto.specialInstructions,
+        requirements,
         estimatedDeliveryTime: new Date(Date.now() + 45 * 60 * 1000), // 45 minutes from now
         items: {
           create: cart.items.map(item => ({
@@ -92,6 +124,45 @@ export class OrdersService {
     return order;
   }
 
+  // The straight-line distance from the restaurant to the delivery address,
+  // or undefined if either can't be placed, in which case dispatch doesn't
+  // check it
+  private async deliveryDistanceKm(restaurantId: string | null, deliveryAddress: string) {
+    if (!restaurantId) {
+      return undefined;
+    }
+    const restaurant = await this.prisma.restaurant.findUnique({
+      where: { id: restaurantId },
+      select: { latitude: true, longitude: true },
+    });
+    if (restaurant?.latitude == null || restaurant?.longitude == null) {
+      return undefined;
+    }
+
+    // Placing the order doesn't wait long on Mapbox; without the distance
+    // dispatch just doesn't check it
+    let center: [number, number] | undefined;
+    try {
+      const geocoded = await this.locationService.geocodeAddress(deliveryAddress, GEOCODE_TIMEOUT_MS);
+      center = geocoded.features?.[0]?.center;
+    } catch {
+      return undefined;
+    }
+    if (!center) {
+      return undefined;
+    }
+    const [longitude, latitude] = center;
+
+    const distance = this.restaurantsService.calculateDistance(
+      restaurant.latitude,
+      restaurant.longitude,
+      latitude,
+      longitude,
+    );
+    // calculateDistance's answer when it can't work one out
+    return distance === Number.MAX_SAFE_INTEGER ? undefined : distance;
+  }
+
   async findAll(userId: string) {
     return this.prisma.order.findMany({
       where: { userId },
@@ -1,6 +1,7 @@
 import { Injectable, OnModuleInit, OnModuleDestroy, Logger } from '@nestjs/common';
 import { ConfigService } from '@nestjs/config';
 import { createClient } from 'redis';
+import { currentTraceFields } from '../tracing/trace-context';
 
 @Injectable()
 export class RedisService implements OnModuleInit, OnModuleDestroy {
@@ -75,6 +76,12 @@ export class RedisService implements OnModuleInit, OnModuleDestroy {
     return this.client.publish(channel, message);
   }
 
+  // Publish a JSON event with the current W3C trace context under `_trace`,
+  // which the Go services continue their spans from
+  async publishEvent(channel: string, payload: Record<string, any>) {
+    return this.publish(channel, JSON.stringify({ ...payload, _trace: currentTraceFields() }));
+  }
+
   async hset(key: string, field: string, value: string) {
     return this.client.hSet(key, field, value);
   }
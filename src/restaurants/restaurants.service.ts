@@ -189,7 +189,7 @@ export class RestaurantsService {
   }
 
   // Helper method to calculate distance between two coordinates using Haversine formula
-  private calculateDistance(
+  calculateDistance(
     lat1: number,
     lng1: number,
     lat2: number,
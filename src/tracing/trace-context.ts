@@ -0,0 +1,65 @@
+import { AsyncLocalStorage } from 'async_hooks';
+import { randomBytes } from 'crypto';
+import { NextFunction, Request, Response } from 'express';
+
+/**
+ * W3C trace context (https://www.w3.org/TR/trace-context/) for the request
+ * being handled, so the Go services can continue its trace from the events
+ * it publishes. The API doesn't export spans itself: it passes on the
+ * caller's traceparent, or starts a trace when there isn't one.
+ */
+interface TraceContext {
+  traceId: string;
+  spanId: string;
+  flags: string;
+  traceState?: string;
+}
+
+/** Trace context fields added to published payloads under `_trace` */
+export interface TraceFields {
+  traceparent: string;
+  tracestate?: string;
+}
+
+const storage = new AsyncLocalStorage<TraceContext>();
+
+const TRACEPARENT = /^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$/;
+
+function randomId(bytes: number): string {
+  return randomBytes(bytes).toString('hex');
+}
+
+function parseTraceparent(header?: string): TraceContext | undefined {
+  const match = header ? TRACEPARENT.exec(header.trim()) : null;
+  if (!match || /^0+$/.test(match[1]) || /^0+$/.test(match[2])) {
+    return undefined;
+  }
+  return { traceId: match[1], spanId: match[2], flags: match[3] };
+}
+
+/** Express middleware running each request in its trace context */
+export function traceContextMiddleware(req: Request, res: Response, next: NextFunction) {
+  const incoming = parseTraceparent(req.header('traceparent'));
+  const context: TraceContext = {
+    traceId: incoming?.traceId ?? randomId(16),
+    spanId: randomId(8),
+    flags: incoming?.flags ?? '01',
+    traceState: incoming ? req.header('tracestate') : undefined,
+  };
+  storage.run(context, next);
+}
+
+/**
+ * The trace context to publish with an event: the current request's, or a
+ * new trace for work outside a request such as scheduled jobs
+ */
+export function currentTraceFields(): TraceFields {
+  const context = storage.getStore() ?? { traceId: randomId(16), spanId: randomId(8), flags: '01' };
+  const fields: TraceFields = {
+    traceparent: `00-${context.traceId}-${context.spanId}-${context.flags}`,
+  };
+  if (context.traceState) {
+    fields.tracestate = context.traceState;
+  }
+  return fields;
+}